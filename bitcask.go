@@ -1,32 +1,37 @@
 package bitcask
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"path/filepath"
 	"sort"
 	"sync"
 	"time"
 
-	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask/flock"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data"
 	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
 	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/internal/manifest"
 	"github.com/prologic/bitcask/internal/metadata"
 	"github.com/prologic/bitcask/scripts/migrations"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
-	lockfile = "lock"
+	lockfile     = "lock"
+	manifestFile = "manifest.json"
+
+	// inMemoryPath is the path of a database opened with OpenInMemory on
+	// its file system held in memory
+	inMemoryPath = "/bitcask"
 )
 
 var (
@@ -61,13 +66,33 @@ var (
 	// ErrMergeInProgress is the error returned if merge is called when already a merge
 	// is in progress
 	ErrMergeInProgress = errors.New("error: merge already in progress")
+
+	// ErrVerifyInProgress is the error returned if merge is called while the
+	// database is being verified
+	ErrVerifyInProgress = errors.New("error: verify in progress")
+
+	// ErrInvalidSyncPolicy is the error returned when the sync policy is
+	// unknown or an interval policy has no positive interval
+	ErrInvalidSyncPolicy = errors.New("error: invalid sync policy")
+
+	// ErrReadOnly is the error returned when writing to a database opened
+	// with WithReadOnly
+	ErrReadOnly = errors.New("error: database opened read only")
 )
 
 // Bitcask is a struct that represents a on-disk LSM and WAL data structure
 // and in-memory hash of key/value pairs as per the Bitcask paper and seen
 // in the Riak database.
 type Bitcask struct {
-	mu sync.RWMutex
+	// mu serializes writes, i.e. the append path, rotations, merge commits
+	// and anything else changing the state of the database. Readers don't
+	// take it: keydirMu guards the keydir and the datafile handles and is only
+	// held to look up where a value lives, never while reading it or while
+	// running callbacks. Readers only take the stripe of keydirMu of the key
+	// they look up. Writers look up the keydir holding mu alone, as reads of
+	// the keydir may run concurrently, and only take keydirMu to change it.
+	mu       sync.Mutex
+	keydirMu *keydirLock
 
 	*flock.Flock
 
@@ -76,30 +101,75 @@ type Bitcask struct {
 	path      string
 	curr      data.Datafile
 	datafiles map[int]data.Datafile
-	trie      art.Tree
+	keydir    index.Keydir
 	indexer   index.Indexer
+	fs        fs.FileSystem
 	metadata  *metadata.MetaData
+	manifest  *manifest.Manifest
 	isMerging bool
+
+	// verifying counts the verifications running, which merges must not
+	// run with, it's guarded by mu
+	verifying int
+
+	// currClean is set while the active datafile is known to hold only
+	// intact entries, so that it's marked clean in the metadata once
+	// sealed. It's guarded by mu.
+	currClean bool
+
+	// filter is the Bloom filter of the keys of the keydir if enabled, it's
+	// guarded by keydirMu
+	filter *index.Filter
+
+	// cache is the cache of the values read if enabled, it has its own lock
+	cache *valueCache
+
+	// checkpoint is closed once the checkpoint of the index being written
+	// in the background is done, it's guarded by mu
+	checkpoint chan struct{}
+
+	// backupFS is the file system Backup writes to, the file system of the
+	// database unless it's held in memory
+	backupFS fs.FileSystem
+
+	// syncMu is held while the active datafile is synced without holding
+	// the write lock or closed, closes counts the closes of active datafiles
+	// and is guarded by keydirMu
+	syncMu sync.Mutex
+	closes int
+	commit *groupCommit
+	quit   chan struct{}
+	wg     sync.WaitGroup
+	stop   sync.Once
 }
 
 // Stats is a struct returned by Stats() on an open Bitcask instance
 type Stats struct {
 	Datafiles int
 	Keys      int
-	Size      int64
+	// KeydirInMemory is the number of keys whose items are held in memory,
+	// fewer than Keys if the keydir is spilled to disk
+	KeydirInMemory int
+	// ValueCacheHits and ValueCacheMisses count the reads of values found
+	// and not found in the value cache, see WithValueCache
+	ValueCacheHits   uint64
+	ValueCacheMisses uint64
+	Size             int64
 }
 
 // Stats returns statistics about the database including the number of
 // data files, keys and overall size on disk of the data
 func (b *Bitcask) Stats() (stats Stats, err error) {
-	if stats.Size, err = internal.DirSize(b.path); err != nil {
+	if stats.Size, err = internal.DirSize(b.fs, b.path); err != nil {
 		return
 	}
 
-	b.mu.RLock()
+	mu := b.keydirMu.RLock(nil)
 	stats.Datafiles = len(b.datafiles)
-	stats.Keys = b.trie.Size()
-	b.mu.RUnlock()
+	stats.Keys = b.keydir.Len()
+	stats.KeydirInMemory = index.InMemory(b.keydir)
+	mu.RUnlock()
+	stats.ValueCacheHits, stats.ValueCacheMisses = b.cache.stats()
 
 	return
 }
@@ -108,16 +178,31 @@ func (b *Bitcask) Stats() (stats Stats, err error) {
 // Close() as this is the only way to cleanup the lock held by the open
 // database.
 func (b *Bitcask) Close() error {
-	b.mu.RLock()
+	b.stopSync()
+	b.waitCheckpoint()
+
+	b.mu.Lock()
 	defer func() {
-		b.mu.RUnlock()
+		b.mu.Unlock()
 		b.Flock.Unlock()
 	}()
 
-	return b.close()
+	err := b.close()
+	if cerr := index.Close(b.keydir); err == nil {
+		err = cerr
+	}
+	if b.commit != nil {
+		// Closing the active datafile synced it for any waiting writers
+		b.commit.closed(err)
+	}
+	return err
 }
 
 func (b *Bitcask) close() error {
+	if b.config.ReadOnly {
+		return b.closeDatafiles()
+	}
+
 	if err := b.saveIndex(); err != nil {
 		return err
 	}
@@ -127,6 +212,11 @@ func (b *Bitcask) close() error {
 		return err
 	}
 
+	return b.closeDatafiles()
+}
+
+// closeDatafiles closes all datafiles including the active datafile
+func (b *Bitcask) closeDatafiles() error {
 	for _, df := range b.datafiles {
 		if err := df.Close(); err != nil {
 			return err
@@ -136,10 +226,15 @@ func (b *Bitcask) close() error {
 	return b.curr.Close()
 }
 
-// Sync flushes all buffers to disk ensuring all data is written
+// Sync flushes all buffers to disk ensuring all data is written regardless
+// of the sync policy
 func (b *Bitcask) Sync() error {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	if b.config.ReadOnly {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
 	if err := b.saveMetadata(); err != nil {
 		return err
@@ -150,8 +245,6 @@ func (b *Bitcask) Sync() error {
 
 // Get fetches value for a key
 func (b *Bitcask) Get(key []byte) ([]byte, error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
 	e, err := b.get(key)
 	if err != nil {
 		return nil, err
@@ -159,16 +252,25 @@ func (b *Bitcask) Get(key []byte) ([]byte, error) {
 	return e.Value, nil
 }
 
-// Has returns true if the key exists in the database, false otherwise.
+// Has returns true if the key exists in the database, false otherwise or if
+// it can't be looked up.
 func (b *Bitcask) Has(key []byte) bool {
-	b.mu.RLock()
-	_, found := b.trie.Search(key)
-	b.mu.RUnlock()
-	return found
+	mu := b.keydirMu.RLock(key)
+	found := b.mayHave(key)
+	var err error
+	if found {
+		_, found, err = b.keydir.Get(key)
+	}
+	mu.RUnlock()
+	return found && err == nil
 }
 
-// Put stores the key and value in the database.
+// Put stores the key and value in the database. See WithGroupCommit for
+// what an error of a group commit means.
 func (b *Bitcask) Put(key, value []byte, options ...PutOptions) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
 	if len(key) == 0 {
 		return ErrEmptyKey
 	}
@@ -186,107 +288,178 @@ func (b *Bitcask) Put(key, value []byte, options ...PutOptions) error {
 	}
 
 	b.mu.Lock()
-	defer b.mu.Unlock()
 	offset, n, err := b.put(key, value, feature)
+	if err == nil {
+		err = b.syncWrite()
+	}
 	if err != nil {
+		b.mu.Unlock()
 		return err
 	}
-
-	if b.config.Sync {
-		if err := b.curr.Sync(); err != nil {
-			return err
-		}
+	if err := b.update(key, offset, n); err != nil {
+		b.mu.Unlock()
+		return err
 	}
+	seq := b.appended(n)
+	b.mu.Unlock()
 
-	// in case of successful `put`, IndexUpToDate will be always be false
-	b.metadata.IndexUpToDate = false
+	return b.waitDurable(seq)
+}
 
-	if oldItem, found := b.trie.Search(key); found {
-		b.metadata.ReclaimableSpace += oldItem.(internal.Item).Size
+// update records a successful put of key at offset in the active datafile.
+// The old item is looked up without keydirMu, which only excludes changes
+// of the keydir and those are serialized by the write lock held.
+func (b *Bitcask) update(key []byte, offset, n int64) error {
+	oldItem, found, err := b.keydir.Get(key)
+	if err != nil {
+		return err
 	}
 
 	item := internal.Item{FileID: b.curr.FileID(), Offset: offset, Size: n}
-	b.trie.Insert(key, item)
-
+	b.keydirMu.Lock()
+	err = b.keydir.Put(key, item)
+	if err == nil && !found && b.filter != nil {
+		b.filter.Add(key)
+	}
+	b.keydirMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if found {
+		b.metadata.ReclaimableSpace += oldItem.Size
+	}
+	b.cache.remove(key)
 	return nil
 }
 
-// Delete deletes the named key.
+// Delete deletes the named key. See WithGroupCommit for what an error of a
+// group commit means.
 func (b *Bitcask) Delete(key []byte) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
 	b.mu.Lock()
-	defer b.mu.Unlock()
-	return b.delete(key)
+	n, err := b.delete(key)
+	if err == nil {
+		err = b.syncWrite()
+	}
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	seq := b.appended(n)
+	b.mu.Unlock()
+
+	return b.waitDurable(seq)
 }
 
-// delete deletes the named key. If the key doesn't exist or an I/O error
-// occurs the error is returned.
-func (b *Bitcask) delete(key []byte) error {
-	_, _, err := b.put(key, []byte{}, Feature{})
+// delete deletes the named key and returns the size of the tombstone
+// written. If the key doesn't exist or an I/O error occurs the error is
+// returned.
+func (b *Bitcask) delete(key []byte) (int64, error) {
+	_, n, err := b.put(key, []byte{}, Feature{})
 	if err != nil {
-		return err
+		return 0, err
+	}
+	item, found, err := b.keydir.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	b.keydirMu.Lock()
+	err = b.keydir.Delete(key)
+	b.keydirMu.Unlock()
+	if err != nil {
+		return 0, err
 	}
-	if item, found := b.trie.Search(key); found {
-		b.metadata.ReclaimableSpace += item.(internal.Item).Size + codec.MetaInfoSize + int64(len(key))
+	if found {
+		b.metadata.ReclaimableSpace += item.Size + codec.MetaInfoSize + int64(len(key))
 	}
-	b.trie.Delete(key)
+	b.cache.remove(key)
 
-	return nil
+	return n, nil
 }
 
 // DeleteAll deletes all the keys. If an I/O error occurs the error is returned.
 func (b *Bitcask) DeleteAll() (err error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
 
-	b.trie.ForEach(func(node art.Node) bool {
-		_, _, err = b.put(node.Key(), []byte{}, Feature{})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ferr := b.keydir.ForEach(func(key []byte, item internal.Item) bool {
+		_, _, err = b.put(key, []byte{}, Feature{})
 		if err != nil {
 			return false
 		}
-		item, _ := b.trie.Search(node.Key())
-		b.metadata.ReclaimableSpace += item.(internal.Item).Size + codec.MetaInfoSize + int64(len(node.Key()))
+		b.metadata.ReclaimableSpace += item.Size + codec.MetaInfoSize + int64(len(key))
 		return true
 	})
-	b.trie = art.New()
+	if err == nil {
+		err = ferr
+	}
+	t, nerr := b.indexer.New()
+	if nerr != nil {
+		return nerr
+	}
+	var f *index.Filter
+	if b.filter != nil {
+		f = index.NewFilter(0)
+	}
+	b.keydirMu.Lock()
+	old := b.keydir
+	b.keydir = t
+	b.filter = f
+	b.keydirMu.Unlock()
+	b.cache.invalidate(true)
+	index.Close(old)
+
+	if err == nil && b.config.SyncPolicy.PerWrite() {
+		err = b.syncDatafile(b.curr)
+	}
 
 	return
 }
 
 // Scan performs a prefix scan of keys matching the given prefix and calling
 // the function `f` with the keys found. If the function returns an error
-// no further keys are processed and the first error returned.
-func (b *Bitcask) Scan(prefix []byte, f func(key []byte) error) (err error) {
-	b.trie.ForEachPrefix(prefix, func(node art.Node) bool {
-		// Skip the root node
-		if len(node.Key()) == 0 {
-			return true
-		}
-
-		if err = f(node.Key()); err != nil {
-			return false
+// no further keys are processed and the first error returned. The keys are
+// those found when the scan starts, so `f` is free to read and write the
+// database.
+func (b *Bitcask) Scan(prefix []byte, f func(key []byte) error) error {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	keys, err := b.snapshotKeys(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := f(key); err != nil {
+			return err
 		}
-		return true
-	})
-	return
+	}
+	return nil
 }
 
 // Len returns the total number of keys in the database
 func (b *Bitcask) Len() int {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	return b.trie.Size()
+	mu := b.keydirMu.RLock(nil)
+	defer mu.RUnlock()
+	return b.keydir.Len()
 }
 
-// Keys returns all keys in the database as a channel of keys
+// Keys returns all keys in the database as a channel of keys. The keys are
+// those found when Keys is called, up to an error listing them which Fold
+// returns.
 func (b *Bitcask) Keys() chan []byte {
+	keys, _ := b.snapshotKeys(nil)
 	ch := make(chan []byte)
 	go func() {
-		b.mu.RLock()
-		defer b.mu.RUnlock()
-
-		for it := b.trie.Iterator(); it.HasNext(); {
-			node, _ := it.Next()
-			ch <- node.Key()
+		for _, key := range keys {
+			ch <- key
 		}
 		close(ch)
 	}()
@@ -296,119 +469,247 @@ func (b *Bitcask) Keys() chan []byte {
 
 // Fold iterates over all keys in the database calling the function `f` for
 // each key. If the function returns an error, no further keys are processed
-// and the error returned.
-func (b *Bitcask) Fold(f func(key []byte) error) (err error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
-	b.trie.ForEach(func(node art.Node) bool {
-		if err = f(node.Key()); err != nil {
-			return false
+// and the error returned. The keys are those found when the fold starts, so
+// `f` is free to read and write the database.
+func (b *Bitcask) Fold(f func(key []byte) error) error {
+	keys, err := b.snapshotKeys(nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := f(key); err != nil {
+			return err
 		}
-		return true
-	})
+	}
+	return nil
+}
 
-	return
+// snapshotKeys returns copies of the keys with the given prefix, or all of
+// them with a nil prefix. Callbacks are run on the keys without holding
+// keydirMu, as they may look up or write keys themselves: Get takes the
+// write lock to delete an expired key.
+func (b *Bitcask) snapshotKeys(prefix []byte) ([][]byte, error) {
+	mu := b.keydirMu.RLock(nil)
+	defer mu.RUnlock()
+
+	var keys [][]byte
+	collect := func(key []byte, item internal.Item) bool {
+		keys = append(keys, append([]byte(nil), key...))
+		return true
+	}
+	if prefix == nil {
+		return keys, b.keydir.ForEach(collect)
+	}
+	return keys, b.keydir.ForEachPrefix(prefix, collect)
 }
 
 // get retrieves the value of the given key. If the key is not found or an/I/O
 // error occurs a null byte slice is returned along with the error.
 func (b *Bitcask) get(key []byte) (internal.Entry, error) {
-	var df data.Datafile
-
-	value, found := b.trie.Search(key)
-	if !found {
-		return internal.Entry{}, ErrKeyNotFound
-	}
-
-	item := value.(internal.Item)
-
-	if item.FileID == b.curr.FileID() {
-		df = b.curr
-	} else {
-		df = b.datafiles[item.FileID]
-	}
+	var (
+		e     internal.Entry
+		item  internal.Item
+		stale data.Datafile
+		epoch uint64
+		hit   bool
+	)
+	for {
+		epoch = b.cache.currentEpoch()
+		mu := b.keydirMu.RLock(key)
+		found := b.mayHave(key)
+		var err error
+		if found {
+			item, found, err = b.keydir.Get(key)
+		}
+		var df data.Datafile
+		if found {
+			df = b.datafile(item.FileID)
+		}
+		mu.RUnlock()
+		if err != nil {
+			return internal.Entry{}, err
+		}
+		if !found {
+			return internal.Entry{}, ErrKeyNotFound
+		}
+		if e, hit = b.cache.get(key, item); hit {
+			break
+		}
 
-	e, err := df.ReadAt(item.Offset, item.Size)
-	if err != nil {
-		return internal.Entry{}, err
+		e, err = df.ReadAt(item.Offset, item.Size)
+		if err == data.ErrClosed && df != stale {
+			// The datafile was replaced by a rotation or merge since the
+			// lookup, so look the key up again
+			stale = df
+			continue
+		}
+		if err != nil {
+			return internal.Entry{}, err
+		}
+		break
 	}
 
 	if e.Expiry != nil && e.Expiry.Before(time.Now().UTC()) {
-		_ = b.delete(key) // we don't care if it doesnt succeed
+		if !b.config.ReadOnly {
+			b.expire(key, item)
+		}
 		return internal.Entry{}, ErrKeyExpired
 	}
 
-	checksum := crc32.ChecksumIEEE(e.Value)
-	if checksum != e.Checksum {
-		return internal.Entry{}, ErrChecksumFailed
+	// Cached entries were checksummed before they were added
+	if !hit {
+		checksum := crc32.ChecksumIEEE(e.Value)
+		if checksum != e.Checksum {
+			return internal.Entry{}, ErrChecksumFailed
+		}
+		b.cache.add(key, item, e, epoch)
 	}
 
 	return e, nil
 }
 
+// datafile returns the datafile with the given id. It must be called with
+// keydirMu or the write lock held.
+func (b *Bitcask) datafile(id int) data.Datafile {
+	if id == b.curr.FileID() {
+		return b.curr
+	}
+	return b.datafiles[id]
+}
+
+// expire deletes the expired key unless it was updated in the meantime
+func (b *Bitcask) expire(key []byte, item internal.Item) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if value, found, err := b.keydir.Get(key); err == nil && found && value == item {
+		_, _ = b.delete(key) // we don't care if it doesnt succeed
+	}
+}
+
 // put inserts a new (key, value). Both key and value are valid inputs.
 func (b *Bitcask) put(key, value []byte, feature Feature) (int64, int64, error) {
+	// Seal the active datafile before the entry would make it cross the
+	// limit, an entry larger than the limit gets a datafile of its own
 	size := b.curr.Size()
-	if size >= int64(b.config.MaxDatafileSize) {
-		err := b.curr.Close()
-		if err != nil {
+	if size > 0 && size+codec.MetaInfoSize+int64(len(key)+len(value)) > int64(b.config.MaxDatafileSize) {
+		if err := b.closeCurrentFile(); err != nil {
 			return -1, 0, err
 		}
-
-		id := b.curr.FileID()
-
-		df, err := data.NewDatafile(b.path, id, true, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
-		if err != nil {
+		if err := b.openNewWritableFile(); err != nil {
 			return -1, 0, err
 		}
+		b.checkpointIndex()
+	}
 
-		b.datafiles[id] = df
-
-		id = b.curr.FileID() + 1
-		curr, err := data.NewDatafile(b.path, id, false, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
-		if err != nil {
-			return -1, 0, err
-		}
-		b.curr = curr
-		err = b.saveIndex()
-		if err != nil {
+	// The saved index must not be trusted without replaying the active
+	// datafile once it has entries the index misses, even after a crash
+	if b.metadata.IndexUpToDate {
+		b.metadata.IndexUpToDate = false
+		if err := b.saveMetadata(); err != nil {
 			return -1, 0, err
 		}
 	}
 
 	e := internal.NewEntry(key, value, feature.Expiry)
-	return b.curr.Write(e)
+	offset, n, err := b.curr.Write(e)
+	if err != nil {
+		// Part of the entry may be left behind if it couldn't be cut off
+		b.currClean = false
+	}
+	return offset, n, err
 }
 
 // closeCurrentFile closes current datafile and makes it read only.
 func (b *Bitcask) closeCurrentFile() error {
-	err := b.curr.Close()
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	// Readers are switched over to a read only datafile before the active
+	// datafile is closed, reads in progress are retried. It stays current
+	// until openNewWritableFile replaces it.
+	curr := b.curr
+	id := curr.FileID()
+	df, err := b.openDatafile(id, true)
 	if err != nil {
 		return err
 	}
-	id := b.curr.FileID()
-	df, err := data.NewDatafile(b.path, id, true, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
+
+	b.keydirMu.Lock()
+	old, ok := b.datafiles[id]
+	b.datafiles[id] = df
+	b.curr = df
+	b.closes++
+	b.keydirMu.Unlock()
+	if ok {
+		old.Close()
+	}
+
+	err = curr.Close()
+	if b.commit != nil {
+		b.commit.closed(err)
+	}
+	if err == nil && b.currClean {
+		b.metadata.MarkClean(id, true)
+	}
+	return err
+}
+
+// openDatafile opens the datafile of the database with the given id
+func (b *Bitcask) openDatafile(id int, readonly bool) (data.Datafile, error) {
+	return data.NewDatafile(b.fs, b.path, id, readonly, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
+}
+
+// openActiveDatafile opens the datafile with the given id for writing and
+// preallocates it if configured
+func (b *Bitcask) openActiveDatafile(id int) (data.Datafile, error) {
+	df, err := b.openDatafile(id, false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	b.datafiles[id] = df
-	return nil
+	if b.config.Preallocate {
+		if err := df.Preallocate(int64(b.config.MaxDatafileSize)); err != nil {
+			df.Close()
+			return nil, err
+		}
+	}
+	return df, nil
 }
 
-// openNewWritableFile opens new datafile for writing data
+// openNewWritableFile opens new datafile for writing data and records it
+// as the active datafile in the manifest
 func (b *Bitcask) openNewWritableFile() error {
 	id := b.curr.FileID() + 1
-	curr, err := data.NewDatafile(b.path, id, false, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
+
+	// A datafile with this id cannot be listed in the manifest, so it is a
+	// leftover that must not be appended to
+	if err := b.fs.Remove(filepath.Join(b.path, data.Filename(id))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	curr, err := b.openActiveDatafile(id)
 	if err != nil {
 		return err
 	}
+	b.keydirMu.Lock()
 	b.curr = curr
-	return nil
+	b.keydirMu.Unlock()
+	b.currClean = true
+
+	b.manifest.Add(id)
+	b.manifest.Active = id
+	return b.saveManifest()
 }
 
+// Reopen reopens the datafiles and reloads the index of the database. It
+// fails with ErrReadOnly for databases opened with WithReadOnly, Refresh
+// reloads their view instead.
 func (b *Bitcask) Reopen() error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
@@ -418,151 +719,54 @@ func (b *Bitcask) Reopen() error {
 // reopen reloads a bitcask object with index and datafiles
 // caller of this method should take care of locking
 func (b *Bitcask) reopen() error {
-	datafiles, lastID, err := loadDatafiles(b.path, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
-	if err != nil {
-		return err
-	}
-	t, err := loadIndex(b.path, b.indexer, b.config.MaxKeySize, datafiles, lastID, b.metadata.IndexUpToDate)
-	if err != nil {
-		return err
-	}
-
-	curr, err := data.NewDatafile(b.path, lastID, false, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
-	if err != nil {
-		return err
-	}
-
-	b.trie = t
-	b.curr = curr
-	b.datafiles = datafiles
-
-	return nil
-}
-
-// Merge merges all datafiles in the database. Old keys are squashed
-// and deleted keys removes. Duplicate key/value pairs are also removed.
-// Call this function periodically to reclaim disk space.
-func (b *Bitcask) Merge() error {
-	b.mu.Lock()
-	if b.isMerging {
-		b.mu.Unlock()
-		return ErrMergeInProgress
-	}
-	b.isMerging = true
-	b.mu.Unlock()
-	defer func() {
-		b.isMerging = false
-	}()
-	b.mu.RLock()
-	err := b.closeCurrentFile()
-	if err != nil {
-		b.mu.RUnlock()
-		return err
-	}
-	filesToMerge := make([]int, 0, len(b.datafiles))
-	for k := range b.datafiles {
-		filesToMerge = append(filesToMerge, k)
-	}
-	err = b.openNewWritableFile()
-	if err != nil {
-		b.mu.RUnlock()
-		return err
-	}
-	b.mu.RUnlock()
-	sort.Ints(filesToMerge)
-
-	// Temporary merged database path
-	temp, err := ioutil.TempDir(b.path, "merge")
+	datafiles, err := b.loadDatafiles(b.manifest.Datafiles)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(temp)
 
-	// Create a merged database
-	mdb, err := Open(temp, withConfig(b.config))
+	lastID := b.manifest.Active
+	curr, err := b.openActiveDatafile(lastID)
 	if err != nil {
 		return err
 	}
+	b.manifest.Add(lastID)
 
-	// Rewrite all key/value pairs into merged database
-	// Doing this automatically strips deleted keys and
-	// old key/value pairs
-	err = b.Fold(func(key []byte) error {
-		item, _ := b.trie.Search(key)
-		// if key was updated after start of merge operation, nothing to do
-		if item.(internal.Item).FileID > filesToMerge[len(filesToMerge)-1] {
-			return nil
-		}
-		e, err := b.get(key)
-		if err != nil {
-			return err
-		}
-		// prepare entry options
-		var opts []PutOptions
-		if e.Expiry != nil {
-			opts = append(opts, WithExpiry(*(e.Expiry)))
-		}
-
-		if err := mdb.Put(key, e.Value, opts...); err != nil {
-			return err
+	if b.manifest.IndexGeneration == 0 {
+		// There is no valid index for the live datafiles, it is rebuilt
+		for _, name := range []string{"index", filterFile} {
+			if err := b.fs.Remove(filepath.Join(b.path, name)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 		}
-
-		return nil
-	})
-	if err != nil {
-		return err
-	}
-	if err = mdb.Close(); err != nil {
-		return err
 	}
-	// no reads and writes till we reopen
-	b.mu.Lock()
-	defer b.mu.Unlock()
-	if err = b.close(); err != nil {
+	t, err := loadIndex(b.fs, b.path, b.indexer, b.config.MaxKeySize, datafiles, lastID, b.manifest.IndexDatafile, b.metadata.IndexUpToDate)
+	if err != nil {
 		return err
 	}
-
-	// Remove data files
-	files, err := ioutil.ReadDir(b.path)
+	replayed := b.manifest.IndexGeneration == 0 ||
+		!b.metadata.IndexUpToDate || b.manifest.IndexDatafile != lastID
+	f, err := b.loadFilter(t, replayed)
 	if err != nil {
+		index.Close(t)
 		return err
 	}
-	for _, file := range files {
-		if file.IsDir() || file.Name() == lockfile {
-			continue
-		}
-		ids, err := internal.ParseIds([]string{file.Name()})
-		if err != nil {
-			return err
-		}
-		// if datafile was created after start of merge, skip
-		if len(ids) > 0 && ids[0] > filesToMerge[len(filesToMerge)-1] {
-			continue
-		}
-		err = os.RemoveAll(path.Join(b.path, file.Name()))
-		if err != nil {
-			return err
-		}
-	}
 
-	// Rename all merged data files
-	files, err = ioutil.ReadDir(mdb.path)
-	if err != nil {
-		return err
+	b.keydirMu.Lock()
+	old := b.keydir
+	b.keydir = t
+	b.filter = f
+	b.curr = curr
+	b.datafiles = datafiles
+	b.keydirMu.Unlock()
+	if curr.Size() == 0 {
+		b.currClean = true
 	}
-	for _, file := range files {
-		err := os.Rename(
-			path.Join([]string{mdb.path, file.Name()}...),
-			path.Join([]string{b.path, file.Name()}...),
-		)
-		if err != nil {
-			return err
-		}
+	b.cache.invalidate(true)
+	if old != nil {
+		index.Close(old)
 	}
-	b.metadata.ReclaimableSpace = 0
 
-	// And finally reopen the database
-	return b.reopen()
+	return nil
 }
 
 // Open opens the database at the given path with optional options.
@@ -575,31 +779,49 @@ func Open(path string, options ...Option) (*Bitcask, error) {
 		meta *metadata.MetaData
 	)
 
+	fsys, err := fileSystem(options)
+	if err != nil {
+		return nil, err
+	}
+
 	configPath := filepath.Join(path, "config.json")
-	if internal.Exists(configPath) {
-		cfg, err = config.Load(configPath)
+	if internal.Exists(fsys, configPath) {
+		cfg, err = config.Load(fsys, configPath)
 		if err != nil {
 			return nil, err
 		}
+		cfg.FileSystem = fsys
+		cfg.Indexer = NewIndexer(NewTreeKeydir)
+		// Settings not saved with the configuration take their defaults
+		cfg.IndexCheckpoint = DefaultIndexCheckpoint
 	} else {
 		cfg = newDefaultConfig()
 	}
 
-	if err := checkAndUpgrade(cfg, configPath); err != nil {
-		return nil, err
-	}
-
 	for _, opt := range options {
 		if err := opt(cfg); err != nil {
 			return nil, err
 		}
 	}
 
-	if err := os.MkdirAll(path, cfg.DirFileModeBeforeUmask); err != nil {
+	// Validate the sync policy also when it was loaded from config.json
+	if err := WithSyncPolicy(cfg.SyncPolicy)(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.ReadOnly {
+		return openReadOnly(path, cfg, options)
+	}
+
+	if err := checkAndUpgrade(cfg, configPath); err != nil {
+		return nil, err
+	}
+
+	if err := fsys.MkdirAll(path, cfg.DirFileModeBeforeUmask); err != nil {
 		return nil, err
 	}
 
-	meta, err = loadMetadata(path)
+	meta, err = loadMetadata(fsys, path)
 	if err != nil {
 		return nil, err
 	}
@@ -609,32 +831,156 @@ func Open(path string, options ...Option) (*Bitcask, error) {
 		config:   cfg,
 		options:  options,
 		path:     path,
-		indexer:  index.NewIndexer(),
+		fs:       fsys,
+		indexer:  cfg.Indexer,
 		metadata: meta,
+		cache:    newValueCache(cfg.ValueCache),
+		keydirMu: newKeydirLock(),
+		backupFS: fsys,
 	}
 
-	locked, err := bitcask.Flock.TryLock()
+	// Other processes can only be locked out of the file system of the
+	// operating system
+	if fsys == fs.OS {
+		bitcask.Flock.SetVersion(internal.FullVersion())
+		if err := bitcask.lock(); err != nil {
+			return nil, err
+		}
+	}
+
+	bitcask.manifest, err = loadManifest(fsys, path)
 	if err != nil {
 		return nil, err
 	}
 
-	if !locked {
-		return nil, ErrDatabaseLocked
+	if err := recoverMerge(fsys, path, bitcask.manifest, cfg.FileFileModeBeforeUmask); err != nil {
+		return nil, fmt.Errorf("recovering merge: %w", err)
 	}
 
-	if err := cfg.Save(configPath); err != nil {
+	if err := cfg.Save(fsys, configPath); err != nil {
 		return nil, err
 	}
 
 	if cfg.AutoRecovery {
-		if err := data.CheckAndRecover(path, cfg); err != nil {
-			return nil, fmt.Errorf("recovering database: %s", err)
+		report, err := repair(fsys, path, cfg, RepairOptions{Mode: RepairApply}, meta)
+		if err != nil {
+			return nil, fmt.Errorf("recovering database: %w", err)
+		}
+		// The live datafiles are all intact now, the sealed ones are
+		// marked clean and no longer checked
+		meta.CleanDatafiles = nil
+		for _, id := range bitcask.manifest.Datafiles {
+			if id != bitcask.manifest.Active {
+				meta.MarkClean(id, true)
+			}
+		}
+		bitcask.currClean = true
+		if err := bitcask.saveMetadata(); err != nil {
+			return nil, err
+		}
+		for _, f := range report.Datafiles {
+			if len(f.Regions) == 0 {
+				continue
+			}
+			log.WithField("datafile", f.Path).
+				WithField("lost_entries", f.LostEntries).
+				WithField("lost_bytes", f.LostBytes).
+				Warn("recovered damaged datafile, damaged regions were quarantined")
+		}
+		if report.IndexCorrupted {
+			log.Warn("removed corrupted index, it will be rebuilt")
 		}
 	}
 	if err := bitcask.Reopen(); err != nil {
 		return nil, err
 	}
 
+	if err := bitcask.saveManifest(); err != nil {
+		return nil, err
+	}
+
+	bitcask.startSync()
+
+	return bitcask, nil
+}
+
+// OpenInMemory opens a new database held entirely in memory, which is lost
+// when it is closed. It is not locked and nothing is written to disk, but it
+// otherwise behaves like a database opened with Open including expiry of
+// keys, Merge and Stats, as it is stored on a file system held in memory.
+// Options are the same as for Open except that WithReadOnly is not supported
+// and WithFileSystem sets the file system Backup writes the database to.
+// Checkpoints of the index are disabled unless set with WithIndexCheckpoint.
+func OpenInMemory(options ...Option) (*Bitcask, error) {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ReadOnly {
+		return nil, ErrReadOnly
+	}
+
+	opts := make([]Option, 0, len(options)+2)
+	opts = append(opts, WithIndexCheckpoint(0))
+	opts = append(opts, options...)
+	opts = append(opts, WithFileSystem(fs.NewMemory()))
+	bitcask, err := Open(inMemoryPath, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bitcask.backupFS = cfg.FileSystem
+
+	return bitcask, nil
+}
+
+// LockOwner returns the owner of the lock on the database at the given path,
+// which is the process that has the database open for writing unless the
+// owner is stale. An error satisfying os.IsNotExist is returned if the
+// database is not locked.
+func LockOwner(path string) (flock.Owner, error) {
+	return flock.ReadOwner(filepath.Join(path, lockfile))
+}
+
+// openReadOnly opens the database at the given path without locking it or
+// writing anything to it, so that it can be read while another process
+// writes to it.
+func openReadOnly(path string, cfg *config.Config, options []Option) (*Bitcask, error) {
+	if cfg.DBVersion != CurrentDBVersion {
+		return nil, ErrInvalidVersion
+	}
+
+	fsys := cfg.FileSystem
+	if _, err := fsys.Stat(path); err != nil {
+		return nil, err
+	}
+
+	meta, err := loadMetadata(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+
+	bitcask := &Bitcask{
+		Flock:    flock.New(filepath.Join(path, lockfile)),
+		config:   cfg,
+		options:  options,
+		path:     path,
+		fs:       fsys,
+		indexer:  cfg.Indexer,
+		metadata: meta,
+		cache:    newValueCache(cfg.ValueCache),
+		keydirMu: newKeydirLock(),
+		backupFS: fsys,
+	}
+
+	if err := bitcask.Refresh(); err != nil {
+		return nil, err
+	}
+
+	bitcask.startSync()
+
 	return bitcask, nil
 }
 
@@ -651,7 +997,7 @@ func checkAndUpgrade(cfg *config.Config, configPath string) error {
 	if cfg.DBVersion == uint32(0) && CurrentDBVersion == uint32(1) {
 		log.Warn("upgrading db version, might take some time....")
 		cfg.DBVersion = CurrentDBVersion
-		return migrations.ApplyV0ToV1(filepath.Dir(configPath), cfg.MaxDatafileSize)
+		return migrations.ApplyV0ToV1(cfg.FileSystem, filepath.Dir(configPath), cfg.MaxDatafileSize)
 	}
 	return nil
 }
@@ -659,55 +1005,62 @@ func checkAndUpgrade(cfg *config.Config, configPath string) error {
 // Backup copies db directory to given path
 // it creates path if it does not exist
 func (b *Bitcask) Backup(path string) error {
-	if !internal.Exists(path) {
-		if err := os.MkdirAll(path, b.config.DirFileModeBeforeUmask); err != nil {
+	if !internal.Exists(b.backupFS, path) {
+		if err := b.backupFS.MkdirAll(path, b.config.DirFileModeBeforeUmask); err != nil {
 			return err
 		}
 	}
-	return internal.Copy(b.path, path, []string{lockfile})
+
+	// Writes are held off so that the copy is consistent
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return internal.Copy(b.fs, b.path, b.backupFS, path, []string{lockfile})
 }
 
 // saveIndex saves index currently in RAM to disk
 func (b *Bitcask) saveIndex() error {
 	tempIdx := "temp_index"
-	if err := b.indexer.Save(b.trie, filepath.Join(b.path, tempIdx)); err != nil {
+	if err := b.indexer.Save(b.fs, b.keydir, filepath.Join(b.path, tempIdx)); err != nil {
+		return err
+	}
+	if err := b.saveFilter(b.manifest.IndexGeneration + 1); err != nil {
+		return err
+	}
+	if err := b.fs.Rename(filepath.Join(b.path, tempIdx), filepath.Join(b.path, "index")); err != nil {
 		return err
 	}
-	return os.Rename(filepath.Join(b.path, tempIdx), filepath.Join(b.path, "index"))
+
+	b.manifest.IndexGeneration++
+	b.manifest.IndexDatafile = b.manifest.Active
+	return b.saveManifest()
+}
+
+// saveManifest atomically saves the manifest to disk
+func (b *Bitcask) saveManifest() error {
+	return b.manifest.Save(b.fs, filepath.Join(b.path, manifestFile), b.config.FileFileModeBeforeUmask)
 }
 
 // saveMetadata saves metadata into disk
 func (b *Bitcask) saveMetadata() error {
-	return b.metadata.Save(filepath.Join(b.path, "meta.json"), b.config.DirFileModeBeforeUmask)
+	return b.metadata.Save(b.fs, filepath.Join(b.path, "meta.json"), b.config.DirFileModeBeforeUmask)
 }
 
 // Reclaimable returns space that can be reclaimed
 func (b *Bitcask) Reclaimable() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
 	return b.metadata.ReclaimableSpace
 }
 
-func loadDatafiles(path string, maxKeySize uint32, maxValueSize uint64, fileModeBeforeUmask os.FileMode) (datafiles map[int]data.Datafile, lastID int, err error) {
-	fns, err := internal.GetDatafiles(path)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	ids, err := internal.ParseIds(fns)
-	if err != nil {
-		return nil, 0, err
-	}
-
+func (b *Bitcask) loadDatafiles(ids []int) (datafiles map[int]data.Datafile, err error) {
 	datafiles = make(map[int]data.Datafile, len(ids))
 	for _, id := range ids {
-		datafiles[id], err = data.NewDatafile(path, id, true, maxKeySize, maxValueSize, fileModeBeforeUmask)
+		datafiles[id], err = b.openDatafile(id, true)
 		if err != nil {
 			return
 		}
 
 	}
-	if len(ids) > 0 {
-		lastID = ids[len(ids)-1]
-	}
 	return
 }
 
@@ -724,30 +1077,53 @@ func getSortedDatafiles(datafiles map[int]data.Datafile) []data.Datafile {
 	return out
 }
 
-func loadIndex(path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile, lastID int, indexUpToDate bool) (art.Tree, error) {
-	t, found, err := indexer.Load(filepath.Join(path, "index"), maxKeySize)
+// loadIndex loads the index, replaying the datafiles from the one it was
+// saved at unless it's up to date. An index that doesn't match its header or
+// checksum is never trusted, it's rebuilt from the datafiles.
+func loadIndex(fsys fs.FileSystem, path string, indexer index.Indexer, maxKeySize uint32, datafiles map[int]data.Datafile, lastID, indexDatafile int, indexUpToDate bool) (index.Keydir, error) {
+	t, found, err := indexer.Load(fsys, filepath.Join(path, "index"), maxKeySize)
 	if err != nil {
-		return nil, err
+		if !index.IsIndexCorruption(err) {
+			return nil, err
+		}
+		log.WithError(err).Warn("corrupted index, rebuilding it from the datafiles")
+		return rebuildIndex(indexer, datafiles)
 	}
-	if found && indexUpToDate {
+	if found && indexUpToDate && indexDatafile == lastID {
 		return t, nil
 	}
 	if found {
-		if err := loadIndexFromDatafile(t, datafiles[lastID]); err != nil {
-			return nil, err
+		for _, df := range getSortedDatafiles(datafiles) {
+			if df.FileID() < indexDatafile {
+				continue
+			}
+			if err := loadIndexFromDatafile(t, df); err != nil {
+				index.Close(t)
+				return nil, err
+			}
 		}
 		return t, nil
 	}
-	sortedDatafiles := getSortedDatafiles(datafiles)
-	for _, df := range sortedDatafiles {
+	index.Close(t)
+	return rebuildIndex(indexer, datafiles)
+}
+
+// rebuildIndex builds the index from scratch from all the datafiles
+func rebuildIndex(indexer index.Indexer, datafiles map[int]data.Datafile) (index.Keydir, error) {
+	t, err := indexer.New()
+	if err != nil {
+		return nil, err
+	}
+	for _, df := range getSortedDatafiles(datafiles) {
 		if err := loadIndexFromDatafile(t, df); err != nil {
+			index.Close(t)
 			return nil, err
 		}
 	}
 	return t, nil
 }
 
-func loadIndexFromDatafile(t art.Tree, df data.Datafile) error {
+func loadIndexFromDatafile(t index.Keydir, df data.Datafile) error {
 	var offset int64
 	for {
 		e, n, err := df.Read()
@@ -759,21 +1135,78 @@ func loadIndexFromDatafile(t art.Tree, df data.Datafile) error {
 		}
 		// Tombstone value  (deleted key)
 		if len(e.Value) == 0 {
-			t.Delete(e.Key)
+			if err := t.Delete(e.Key); err != nil {
+				return err
+			}
 			offset += n
 			continue
 		}
 		item := internal.Item{FileID: df.FileID(), Offset: offset, Size: n}
-		t.Insert(e.Key, item)
+		if err := t.Put(e.Key, item); err != nil {
+			return err
+		}
 		offset += n
 	}
 	return nil
 }
 
-func loadMetadata(path string) (*metadata.MetaData, error) {
-	if !internal.Exists(filepath.Join(path, "meta.json")) {
+// loadManifest loads the manifest of the database. Databases created before
+// the manifest was introduced get one listing all their datafiles.
+func loadManifest(fsys fs.FileSystem, path string) (*manifest.Manifest, error) {
+	if internal.Exists(fsys, filepath.Join(path, manifestFile)) {
+		return manifest.Load(fsys, filepath.Join(path, manifestFile))
+	}
+
+	fns, err := internal.GetDatafiles(fsys, path)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := internal.ParseIds(fns)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest.Manifest{Datafiles: ids}
+	if len(ids) > 0 {
+		m.Active = ids[len(ids)-1]
+	}
+	if internal.Exists(fsys, filepath.Join(path, "index")) {
+		m.IndexGeneration = 1
+		m.IndexDatafile = m.Active
+	}
+	return m, nil
+}
+
+func loadMetadata(fsys fs.FileSystem, path string) (*metadata.MetaData, error) {
+	if !internal.Exists(fsys, filepath.Join(path, "meta.json")) {
 		meta := new(metadata.MetaData)
 		return meta, nil
 	}
-	return metadata.Load(filepath.Join(path, "meta.json"))
+	return metadata.Load(fsys, filepath.Join(path, "meta.json"))
+}
+
+// lock takes the database lock, waiting up to the configured lock timeout
+// for another process to release it
+func (b *Bitcask) lock() error {
+	if b.config.LockTimeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), b.config.LockTimeout)
+		defer cancel()
+
+		err := b.Flock.LockContext(ctx)
+		if err == context.DeadlineExceeded {
+			return ErrDatabaseLocked
+		}
+		return err
+	}
+
+	locked, err := b.Flock.TryLock()
+	if err != nil && err != flock.ErrLockFailed {
+		return err
+	}
+
+	if !locked {
+		return ErrDatabaseLocked
+	}
+
+	return nil
 }
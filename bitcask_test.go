@@ -2,16 +2,20 @@ package bitcask
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -20,6 +24,12 @@ import (
 
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/faultfs"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/internal/manifest"
 	"github.com/prologic/bitcask/internal/mocks"
 )
 
@@ -484,6 +494,361 @@ func TestAutoRecovery(t *testing.T) {
 	}
 }
 
+func TestAutoRecoveryClean(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// Each entry is 32 bytes, datafiles 0 and 1 are sealed whole and marked
+	// clean, foo8 and foo9 are in the active datafile 2
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("bar%d", i))))
+	}
+	require.NoError(db.Close())
+	meta, err := loadMetadata(fs.OS, testdir)
+	require.NoError(err)
+	assert.Equal([]int{0, 1}, meta.CleanDatafiles)
+
+	// Damage to the datafiles marked clean isn't checked for on open, only
+	// the active datafile is
+	first := filepath.Join(testdir, "000000000.data")
+	b, err := ioutil.ReadFile(first)
+	require.NoError(err)
+	b[32+16] ^= 0xff
+	require.NoError(ioutil.WriteFile(first, b, 0600))
+	active := filepath.Join(testdir, "000000002.data")
+	require.NoError(os.Truncate(active, 63))
+
+	db, err = Open(testdir, WithMaxDatafileSize(128), WithAutoRecovery(true))
+	require.NoError(err)
+	_, err = db.Get([]byte("foo9"))
+	assert.Equal(ErrKeyNotFound, err)
+	_, err = db.Get([]byte("foo1"))
+	assert.Equal(ErrChecksumFailed, err)
+	saved, err := ioutil.ReadFile(first)
+	require.NoError(err)
+	assert.Equal(b, saved)
+
+	// The active datafile checked is marked clean once sealed
+	require.NoError(db.Put([]byte("foo10"), []byte("bar10")))
+	require.NoError(db.Put([]byte("foo11"), []byte("bar11")))
+	require.NoError(db.Put([]byte("foo12"), []byte("bar12")))
+	require.NoError(db.Close())
+	meta, err = loadMetadata(fs.OS, testdir)
+	require.NoError(err)
+	assert.Equal([]int{0, 1, 2}, meta.CleanDatafiles)
+
+	// An active datafile that wasn't checked isn't
+	db, err = Open(testdir, WithMaxDatafileSize(128), WithAutoRecovery(false))
+	require.NoError(err)
+	for i := 13; i < 16; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("bar%d", i))))
+	}
+	require.NoError(db.Close())
+	meta, err = loadMetadata(fs.OS, testdir)
+	require.NoError(err)
+	assert.Equal([]int{0, 1, 2}, meta.CleanDatafiles)
+
+	// Repair checks all the datafiles
+	report, err := Repair(testdir, RepairOptions{})
+	require.NoError(err)
+	require.Len(report.Datafiles, 5)
+	assert.Len(report.Datafiles[0].Regions, 1)
+}
+
+func TestRepairLargeDatafile(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// Datafiles are scanned through a buffer, damage is found across its
+	// boundaries. Each entry is 24+5+100 bytes.
+	db, err := Open(testdir)
+	require.NoError(err)
+	value := bytes.Repeat([]byte("x"), 100)
+	for i := 0; i < 2000; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("k%04d", i)), value))
+	}
+	require.NoError(db.Close())
+
+	name := filepath.Join(testdir, "000000000.data")
+	b, err := ioutil.ReadFile(name)
+	require.NoError(err)
+	require.Len(b, 2000*129)
+	damaged := []int{0, 508, 1000, 1999}
+	for _, i := range damaged {
+		b[i*129+20] ^= 0xff
+	}
+	require.NoError(ioutil.WriteFile(name, b, 0600))
+
+	report, err := Repair(testdir, RepairOptions{Mode: RepairApply})
+	require.NoError(err)
+	require.Len(report.Datafiles, 1)
+	assert.Equal(2000-len(damaged), report.Datafiles[0].Entries)
+	require.Len(report.Datafiles[0].Regions, len(damaged))
+	for i, r := range report.Datafiles[0].Regions {
+		assert.Equal(int64(damaged[i]*129), r.Offset)
+		assert.Equal(int64(129), r.Size)
+		quarantined, err := ioutil.ReadFile(r.Quarantine)
+		require.NoError(err)
+		assert.Equal(b[r.Offset:r.Offset+r.Size], quarantined)
+	}
+
+	db, err = Open(testdir)
+	require.NoError(err)
+	defer db.Close()
+	assert.Equal(2000-len(damaged), db.Len())
+	val, err := db.Get([]byte("k0509"))
+	require.NoError(err)
+	assert.Equal(value, val)
+}
+
+func TestRepair(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	require.NoError(err)
+	for i := 0; i < 10; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("bar%d", i))))
+	}
+	require.NoError(db.Close())
+
+	// Each entry is 32 bytes, so foo0 to foo3 are in the first datafile.
+	// Corrupt the value of foo1 and cut foo5 short in its header in the
+	// second datafile.
+	first := filepath.Join(testdir, "000000000.data")
+	b, err := ioutil.ReadFile(first)
+	require.NoError(err)
+	require.Len(b, 128)
+	b[32+16] ^= 0xff
+	require.NoError(ioutil.WriteFile(first, b, 0600))
+
+	second := filepath.Join(testdir, "000000001.data")
+	b, err = ioutil.ReadFile(second)
+	require.NoError(err)
+	b = append(b[:32+10], b[64:]...)
+	require.NoError(ioutil.WriteFile(second, b, 0600))
+
+	// Datafiles left behind that aren't in the manifest aren't checked
+	stray := filepath.Join(testdir, "000000099.data")
+	require.NoError(ioutil.WriteFile(stray, []byte("garbage"), 0600))
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := Repair(testdir, RepairOptions{})
+		require.NoError(err)
+		assert.True(report.Damaged())
+		assert.False(report.Repaired)
+		assert.False(report.IndexCorrupted)
+		require.Len(report.Datafiles, 3)
+
+		damaged := report.Datafiles[0]
+		assert.Equal(first, damaged.Path)
+		assert.Equal(3, damaged.Entries)
+		assert.Equal(1, damaged.LostEntries)
+		assert.Equal(int64(32), damaged.LostBytes)
+		require.Len(damaged.Regions, 1)
+		assert.Equal(int64(32), damaged.Regions[0].Offset)
+		assert.Empty(damaged.Regions[0].Quarantine)
+
+		damaged = report.Datafiles[1]
+		assert.Equal(second, damaged.Path)
+		assert.Equal(3, damaged.Entries)
+		assert.Equal(int64(10), damaged.LostBytes)
+
+		assert.Empty(report.Datafiles[2].Regions)
+
+		// Nothing was changed
+		size, err := os.Stat(second)
+		require.NoError(err)
+		assert.Equal(int64(len(b)), size.Size())
+		assert.True(internal.Exists(fs.OS, filepath.Join(testdir, "index")))
+	})
+
+	t.Run("Locked", func(t *testing.T) {
+		db, err := Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+
+		_, err = Repair(testdir, RepairOptions{Mode: RepairApply})
+		assert.Equal(ErrDatabaseLocked, err)
+	})
+
+	t.Run("Backup", func(t *testing.T) {
+		backup, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(backup)
+
+		report, err := Repair(testdir, RepairOptions{Mode: RepairBackup, BackupDir: backup})
+		require.NoError(err)
+		assert.True(report.Repaired)
+		assert.Equal(backup, report.Backup)
+
+		saved, err := ioutil.ReadFile(filepath.Join(backup, "000000001.data"))
+		require.NoError(err)
+		assert.Equal(b, saved)
+		assert.True(internal.Exists(fs.OS, filepath.Join(backup, "index")))
+		assert.False(internal.Exists(fs.OS, filepath.Join(backup, "000000002.data")))
+
+		quarantined, err := ioutil.ReadFile(report.Datafiles[1].Regions[0].Quarantine)
+		require.NoError(err)
+		assert.Equal(b[32:42], quarantined)
+
+		assert.False(internal.Exists(fs.OS, filepath.Join(testdir, "index")))
+	})
+
+	t.Run("Repaired", func(t *testing.T) {
+		report, err := Repair(testdir, RepairOptions{Mode: RepairApply})
+		require.NoError(err)
+		assert.False(report.Damaged())
+		assert.False(report.Repaired)
+	})
+
+	t.Run("CorruptedIndex", func(t *testing.T) {
+		require.NoError(ioutil.WriteFile(filepath.Join(testdir, "index"), []byte{0, 0, 0, 8, 'f'}, 0600))
+
+		report, err := Repair(testdir, RepairOptions{Mode: RepairApply})
+		require.NoError(err)
+		assert.True(report.IndexCorrupted)
+		assert.True(report.Repaired)
+		assert.False(internal.Exists(fs.OS, filepath.Join(testdir, "index")))
+	})
+
+	t.Run("Open", func(t *testing.T) {
+		db, err := Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+
+		assert.Equal(8, db.Len())
+		for i := 0; i < 10; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+			if i == 1 || i == 5 {
+				assert.Equal(ErrKeyNotFound, err)
+				continue
+			}
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("bar%d", i)), val)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(128))
+	require.NoError(err)
+	defer db.Close()
+
+	for gen := 0; gen < 2; gen++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte(fmt.Sprintf("bar%d", gen))))
+		}
+	}
+	require.NoError(db.Delete([]byte("foo0")))
+
+	t.Run("OK", func(t *testing.T) {
+		report, err := db.Verify(context.Background(), VerifyOptions{})
+		require.NoError(err)
+		assert.True(report.OK(), "%+v", report.Problems)
+		assert.Equal(9, report.Keys)
+		assert.Equal(int64(9*32), report.LiveBytes)
+		assert.Equal(21, report.Entries)
+		assert.Equal(int64(20*32+28), report.Bytes)
+		assert.Equal(report.Bytes-report.LiveBytes, report.DeadBytes)
+		assert.Equal(db.Reclaimable(), report.ReclaimableSpace)
+	})
+
+	t.Run("ConcurrentWrites", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				assert.NoError(db.Put([]byte(fmt.Sprintf("baz%d", i)), []byte("qux")))
+			}
+		}()
+		for i := 0; i < 5; i++ {
+			report, err := db.Verify(context.Background(), VerifyOptions{})
+			require.NoError(err)
+			assert.True(report.OK(), "%+v", report.Problems)
+		}
+		<-done
+	})
+
+	t.Run("Cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := db.Verify(ctx, VerifyOptions{})
+		assert.Equal(context.Canceled, err)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		db.mu.Lock()
+		db.verifying++
+		db.mu.Unlock()
+		assert.Equal(ErrVerifyInProgress, db.Merge())
+		db.mu.Lock()
+		db.verifying--
+		db.isMerging = true
+		db.mu.Unlock()
+		_, err := db.Verify(context.Background(), VerifyOptions{})
+		assert.Equal(ErrMergeInProgress, err)
+		db.mu.Lock()
+		db.isMerging = false
+		db.mu.Unlock()
+	})
+
+	t.Run("Problems", func(t *testing.T) {
+		// Tamper with the keydir
+		db.mu.Lock()
+		db.keydirMu.Lock()
+		item1, _, _ := db.keydir.Get([]byte("foo1"))
+		item2, _, _ := db.keydir.Get([]byte("foo2"))
+		require.NoError(db.keydir.Put([]byte("foo1"), item2))
+		require.NoError(db.keydir.Delete([]byte("foo2")))
+		require.NoError(db.keydir.Put([]byte("foo0"), item1))
+		require.NoError(db.keydir.Put([]byte("ghost"), internal.Item{FileID: 1000, Size: 32}))
+		db.keydirMu.Unlock()
+		db.mu.Unlock()
+
+		report, err := db.Verify(context.Background(), VerifyOptions{})
+		require.NoError(err)
+
+		kinds := make(map[string]ProblemKind)
+		for _, p := range report.Problems {
+			kinds[fmt.Sprintf("%s/%s", p.Key, p.Kind)] = p.Kind
+		}
+		assert.Contains(kinds, "foo1/key-mismatch")
+		assert.Contains(kinds, "foo1/stale-index")
+		assert.Contains(kinds, "foo0/key-mismatch")
+		assert.Contains(kinds, "foo0/orphaned")
+		assert.Contains(kinds, "foo2/unreachable")
+		assert.Contains(kinds, "ghost/missing-datafile")
+		assert.Contains(kinds, "ghost/orphaned")
+
+		report, err = db.Verify(context.Background(), VerifyOptions{SkipScan: true, MaxProblems: 2})
+		require.NoError(err)
+		assert.Len(report.Problems, 2)
+		assert.True(report.Truncated)
+	})
+}
+
 func TestReIndex(t *testing.T) {
 	assert := assert.New(t)
 
@@ -628,1016 +993,3434 @@ func TestReIndexDeletedKeys(t *testing.T) {
 	})
 }
 
-func TestSync(t *testing.T) {
+func TestCorruptedIndex(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	var db *Bitcask
+	db, err := Open(testdir)
+	require.NoError(err)
+	for i := 0; i < 4; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	require.NoError(db.Close())
+
+	index, err := ioutil.ReadFile(filepath.Join(testdir, "index"))
+	require.NoError(err)
+
+	// Header of magic, version and count, then records of key size, key,
+	// file id, offset and size, then the checksum
+	const header, record = 16, 4 + 4 + 4 + 8 + 8
+	require.Len(index, header+4*record+4)
+
+	for _, tc := range []struct {
+		name  string
+		index []byte
+	}{
+		{"RecordBoundary", index[:header+2*record]},
+		{"Checksum", append(append([]byte{}, index[:len(index)-1]...), index[len(index)-1]^0xff)},
+		{"Legacy", index[header : header+4*record]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(ioutil.WriteFile(filepath.Join(testdir, "index"), tc.index, 0600))
+
+			for _, options := range [][]Option{{WithReadOnly()}, nil} {
+				db, err := Open(testdir, options...)
+				require.NoError(err)
+				assert.Equal(4, db.Len())
+				for i := 0; i < 4; i++ {
+					val, err := db.Get([]byte(fmt.Sprintf("foo%d", i)))
+					assert.NoError(err)
+					assert.Equal([]byte("bar"), val)
+				}
+				require.NoError(db.Close())
+			}
+		})
+	}
+}
 
-	t.Run("Open", func(t *testing.T) {
-		db, err = Open(testdir, WithSync(true))
-		assert.NoError(err)
-	})
+func TestIndexCheckpoint(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	// Entries of 8 byte keys and values are 40 bytes, 3 per datafile
+	const path = "/db"
+	options := func(fsys *faultfs.FS, checkpoint int) []Option {
+		return []Option{
+			WithFileSystem(fsys),
+			WithMaxDatafileSize(128),
+			WithSyncPolicy(SyncAlways),
+			WithIndexCheckpoint(checkpoint),
+		}
+	}
+	put := func(db *Bitcask, n, gen int) {
+		for i := 0; i < n; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("val%05d", gen))))
+		}
+	}
+	check := func(db *Bitcask, n, gen int, deleted string) {
+		assert.Equal(n-1, db.Len())
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("key%05d", i)
+			val, err := db.Get([]byte(key))
+			if key == deleted {
+				assert.Equal(ErrKeyNotFound, err)
+				continue
+			}
+			assert.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("val%05d", gen)), val)
+		}
+	}
 
-	t.Run("Put", func(t *testing.T) {
-		key := []byte(strings.Repeat(" ", 17))
-		value := []byte("foobar")
-		err = db.Put(key, value)
-	})
+	t.Run("Disabled", func(t *testing.T) {
+		fsys := faultfs.New(1)
+		db, err := Open(path, options(fsys, 0)...)
+		require.NoError(err)
+		put(db, 30, 0)
 
-	t.Run("Put", func(t *testing.T) {
-		err = db.Put([]byte("hello"), []byte("world"))
-		assert.NoError(err)
+		// Sealing datafiles doesn't save the index
+		assert.Equal(uint64(0), db.manifest.IndexGeneration)
+		assert.False(internal.Exists(fsys, filepath.Join(path, "index")))
+		require.NoError(db.Close())
 	})
-}
-
-func TestMaxKeySize(t *testing.T) {
-	assert := assert.New(t)
 
-	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+	t.Run("Crash", func(t *testing.T) {
+		fsys := faultfs.New(1)
+		db, err := Open(path, options(fsys, 2)...)
+		require.NoError(err)
+
+		put(db, 30, 0)
+		db.waitCheckpoint()
+		generation := db.manifest.IndexGeneration
+		datafile := db.manifest.IndexDatafile
+		assert.True(generation > 0)
+		assert.True(datafile > 0)
+
+		put(db, 30, 1)
+		require.NoError(db.Delete([]byte("key00003")))
+		db.waitCheckpoint()
+		assert.True(db.manifest.IndexGeneration > generation)
+		assert.True(db.manifest.IndexDatafile > datafile)
+		put(db, 2, 1)
+
+		// The checkpointed index is loaded and the datafiles it's behind by
+		// are replayed
+		db, err = Open(path, options(fsys.Restart(), 0)...)
+		require.NoError(err)
+		check(db, 30, 1, "key00003")
+		require.NoError(db.Close())
+	})
 
-	var db *Bitcask
+	t.Run("Merge", func(t *testing.T) {
+		fsys := faultfs.New(1)
+		db, err := Open(path, options(fsys, 1)...)
+		require.NoError(err)
 
-	t.Run("Open", func(t *testing.T) {
-		db, err = Open(testdir, WithMaxKeySize(16))
-		assert.NoError(err)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 3; i++ {
+				assert.NoError(db.Merge())
+			}
+		}()
+		put(db, 30, 0)
+		put(db, 30, 1)
+		require.NoError(db.Delete([]byte("key00003")))
+		<-done
+		check(db, 30, 1, "key00003")
+		require.NoError(db.Close())
+
+		db, err = Open(path, options(fsys, 1)...)
+		require.NoError(err)
+		check(db, 30, 1, "key00003")
+		require.NoError(db.Close())
 	})
 
-	t.Run("Put", func(t *testing.T) {
-		key := []byte(strings.Repeat(" ", 17))
-		value := []byte("foobar")
-		err = db.Put(key, value)
-		assert.Error(err)
-		assert.Equal(ErrKeyTooLarge, err)
+	t.Run("Reopen", func(t *testing.T) {
+		// The setting isn't saved with the configuration, databases opened
+		// again without it take the default
+		fsys := faultfs.New(1)
+		options := []Option{WithFileSystem(fsys), WithMaxDatafileSize(128), WithSyncPolicy(SyncAlways)}
+		db, err := Open(path, options...)
+		require.NoError(err)
+		put(db, 3, 0)
+		require.NoError(db.Close())
+
+		db, err = Open(path, options...)
+		require.NoError(err)
+		assert.Equal(DefaultIndexCheckpoint, db.config.IndexCheckpoint)
+		generation := db.manifest.IndexGeneration
+		put(db, 3*(DefaultIndexCheckpoint+1), 1)
+		db.waitCheckpoint()
+		assert.True(db.manifest.IndexGeneration > generation)
+		require.NoError(db.Close())
 	})
 }
 
-func TestMaxValueSize(t *testing.T) {
+func TestIndexer(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
+
+	scratch, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(scratch)
+
+	indexers := []struct {
+		name     string
+		indexer  Indexer
+		inMemory int
+	}{
+		{"HashMap", NewIndexer(NewHashMapKeydir), 20},
+		// Without the Update of the default indexers, checkpoints load the
+		// saved index
+		{"Custom", struct{ Indexer }{NewIndexer(NewTreeKeydir)}, 20},
+		{"Spill", NewSpillIndexer(scratch, 4), 4},
+	}
 
-	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
-
-	var db *Bitcask
+	for _, tc := range indexers {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			const path = "/db"
+			fsys := faultfs.New(1)
+			options := func() []Option {
+				return []Option{
+					WithFileSystem(fsys),
+					WithMaxDatafileSize(128),
+					WithSyncPolicy(SyncAlways),
+					WithIndexCheckpoint(2),
+					WithIndexer(tc.indexer),
+				}
+			}
 
-	t.Run("Open", func(t *testing.T) {
-		db, err = Open(testdir, WithMaxValueSize(16))
-		assert.NoError(err)
-	})
+			db, err := Open(path, options()...)
+			require.NoError(err)
+			for i := 0; i < 20; i++ {
+				require.NoError(db.Put([]byte(fmt.Sprintf("foo%02d", i)), []byte("bar")))
+			}
+			require.NoError(db.Put([]byte("baz"), []byte("qux")))
+			require.NoError(db.Delete([]byte("foo03")))
+			db.waitCheckpoint()
+			assert.True(db.manifest.IndexGeneration > 0)
+
+			check := func(db *Bitcask) {
+				assert.Equal(20, db.Len())
+				val, err := db.Get([]byte("baz"))
+				assert.NoError(err)
+				assert.Equal([]byte("qux"), val)
+				_, err = db.Get([]byte("foo03"))
+				assert.Equal(ErrKeyNotFound, err)
 
-	t.Run("Put", func(t *testing.T) {
-		key := []byte("foo")
-		value := []byte(strings.Repeat(" ", 17))
-		err = db.Put(key, value)
-		assert.Error(err)
-		assert.Equal(ErrValueTooLarge, err)
-	})
-}
+				var keys []string
+				require.NoError(db.Scan([]byte("foo1"), func(key []byte) error {
+					keys = append(keys, string(key))
+					return nil
+				}))
+				sort.Strings(keys)
+				assert.Len(keys, 10)
+				assert.Equal("foo10", keys[0])
 
-func TestStats(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+				stats, err := db.Stats()
+				require.NoError(err)
+				assert.Equal(20, stats.Keys)
+				assert.True(stats.KeydirInMemory <= tc.inMemory)
+			}
+			check(db)
 
-	assert := assert.New(t)
+			// The checkpoint and the datafiles after it are loaded
+			fsys = fsys.Restart()
+			db, err = Open(path, options()...)
+			require.NoError(err)
+			check(db)
 
-	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+			require.NoError(db.Merge())
+			check(db)
+			require.NoError(db.Close())
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+			db, err = Open(path, options()...)
+			require.NoError(err)
+			check(db)
+			require.NoError(db.Close())
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
+			// The scratch files of the keydirs are removed once closed
+			files, err := ioutil.ReadDir(scratch)
+			require.NoError(err)
+			assert.Empty(files)
 		})
+	}
 
-		t.Run("Get", func(t *testing.T) {
-			val, err := db.Get([]byte("foo"))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
-		})
+	t.Run("SpillError", func(t *testing.T) {
+		scratch, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(scratch)
 
-		t.Run("Stats", func(t *testing.T) {
-			stats, err := db.Stats()
-			assert.NoError(err)
-			assert.Equal(stats.Datafiles, 0)
-			assert.Equal(stats.Keys, 1)
-		})
+		db, err := Open("/db", WithFileSystem(faultfs.New(1)), WithIndexer(NewSpillIndexer(scratch, 0)))
+		require.NoError(err)
+		defer db.Close()
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
 
-		t.Run("Sync", func(t *testing.T) {
-			err = db.Sync()
-			assert.NoError(err)
-		})
+		// The keydir can't grow without its scratch directory, which fails
+		// the put instead of crashing the process
+		require.NoError(os.RemoveAll(scratch))
+		for i := 0; err == nil; i++ {
+			err = db.Put([]byte(fmt.Sprintf("key%05d", i)), []byte("bar"))
+		}
+		assert.True(os.IsNotExist(errors.Unwrap(err)), err)
 
-		t.Run("Close", func(t *testing.T) {
-			err = db.Close()
-			assert.NoError(err)
-		})
+		val, err := db.Get([]byte("foo"))
+		require.NoError(err)
+		assert.Equal([]byte("bar"), val)
 	})
 }
 
-func TestStatsError(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+// checkedKeydir is a keydir checking that it's used as Keydir documents:
+// Put and Delete never run concurrently with any other method
+type checkedKeydir struct {
+	Keydir
+	mu         sync.Mutex
+	readers    int
+	writers    int
+	violations int
+}
 
-	assert := assert.New(t)
+func (k *checkedKeydir) enter(write bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.writers > 0 || write && k.readers > 0 {
+		k.violations++
+	}
+	if write {
+		k.writers++
+	} else {
+		k.readers++
+	}
+}
 
-	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+func (k *checkedKeydir) exit(write bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if write {
+		k.writers--
+	} else {
+		k.readers--
+	}
+}
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+func (k *checkedKeydir) Get(key []byte) (Item, bool, error) {
+	k.enter(false)
+	defer k.exit(false)
+	return k.Keydir.Get(key)
+}
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
+func (k *checkedKeydir) Put(key []byte, item Item) error {
+	k.enter(true)
+	defer k.exit(true)
+	return k.Keydir.Put(key, item)
+}
 
-		t.Run("Get", func(t *testing.T) {
-			val, err := db.Get([]byte("foo"))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
-		})
+func (k *checkedKeydir) Delete(key []byte) error {
+	k.enter(true)
+	defer k.exit(true)
+	return k.Keydir.Delete(key)
+}
 
-		t.Run("Stats", func(t *testing.T) {
-			stats, err := db.Stats()
-			assert.NoError(err)
-			assert.Equal(stats.Datafiles, 0)
-			assert.Equal(stats.Keys, 1)
-		})
-	})
+func (k *checkedKeydir) Len() int {
+	k.enter(false)
+	defer k.exit(false)
+	return k.Keydir.Len()
+}
 
-	t.Run("Test", func(t *testing.T) {
-		t.Run("FabricatedDestruction", func(t *testing.T) {
-			// This would never happen in reality :D
-			// Or would it? :)
-			err = os.RemoveAll(testdir)
-			assert.NoError(err)
-		})
+func (k *checkedKeydir) ForEach(f func(key []byte, item Item) bool) error {
+	k.enter(false)
+	defer k.exit(false)
+	return k.Keydir.ForEach(f)
+}
 
-		t.Run("Stats", func(t *testing.T) {
-			_, err := db.Stats()
-			assert.Error(err)
-		})
-	})
+func (k *checkedKeydir) ForEachPrefix(prefix []byte, f func(key []byte, item Item) bool) error {
+	k.enter(false)
+	defer k.exit(false)
+	return k.Keydir.ForEachPrefix(prefix, f)
 }
 
-func TestDirFileModeBeforeUmask(t *testing.T) {
+func TestKeydirConcurrency(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Default DirFileModeBeforeUmask is 0700", func(t *testing.T) {
-			testdir, err := ioutil.TempDir("", "bitcask")
-			embeddedDir := filepath.Join(testdir, "cache")
-			assert.NoError(err)
-			defer os.RemoveAll(testdir)
-
-			defaultTestMode := os.FileMode(0700)
+	var (
+		mu      sync.Mutex
+		keydirs []*checkedKeydir
+	)
+	indexer := NewIndexer(func() Keydir {
+		mu.Lock()
+		defer mu.Unlock()
+		k := &checkedKeydir{Keydir: NewTreeKeydir()}
+		keydirs = append(keydirs, k)
+		return k
+	})
 
-			db, err := Open(embeddedDir)
-			assert.NoError(err)
-			defer db.Close()
-			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
-				// skip the root directory
-				if path == testdir {
-					return nil
-				}
-				if info.IsDir() {
-					// perms for directory on disk are filtered through defaultTestMode, AND umask of user running test.
-					// this means the mkdir calls can only FURTHER restrict permissions, not grant more (preventing escalatation).
-					// to make this test OS agnostic, we'll skip using golang.org/x/sys/unix, inferring umask via XOR and AND NOT.
+	db, err := Open("/db", WithFileSystem(fs.NewMemory()), WithIndexer(indexer), WithMaxDatafileSize(1024))
+	require.NoError(err)
+	defer db.Close()
 
-					// create anotherDir with allPerms - to infer umask
-					anotherDir := filepath.Join(testdir, "temp")
-					err := os.Mkdir(anotherDir, os.ModePerm)
-					assert.NoError(err)
-					defer os.RemoveAll(anotherDir)
+	const n = 500
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("key%d", i%50))
+			assert.NoError(db.Put(key, key))
+			if i%7 == 0 {
+				assert.NoError(db.Delete(key))
+			}
+			if i%100 == 0 {
+				assert.NoError(db.Merge())
+			}
+		}
+	}()
+	for r := 0; r < 2; r++ {
+		go func() {
+			defer wg.Done()
+			for i := 0; i < n; i++ {
+				db.Has([]byte(fmt.Sprintf("key%d", i%50)))
+				db.Get([]byte(fmt.Sprintf("key%d", i%50)))
+				db.Len()
+				assert.NoError(db.Scan([]byte("key1"), func(key []byte) error { return nil }))
+			}
+		}()
+	}
+	wg.Wait()
 
-					anotherStat, err := os.Stat(anotherDir)
-					assert.NoError(err)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, k := range keydirs {
+		assert.Equal(0, k.violations)
+	}
+}
 
-					// infer umask from anotherDir
-					umask := os.ModePerm ^ (anotherStat.Mode() & os.ModePerm)
+func TestBloomFilter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	const path = "/db"
+	fsys := faultfs.New(1)
+	options := func(enabled bool) []Option {
+		return []Option{
+			WithFileSystem(fsys),
+			WithMaxDatafileSize(1024),
+			WithSyncPolicy(SyncAlways),
+			WithIndexCheckpoint(0),
+			WithBloomFilter(enabled),
+		}
+	}
+	check := func(db *Bitcask, n int) {
+		for i := 0; i < n; i++ {
+			key := []byte(fmt.Sprintf("foo%d", i))
+			if i%10 == 3 {
+				assert.False(db.Has(key), "%s", key)
+				continue
+			}
+			val, err := db.Get(key)
+			if assert.NoError(err, "%s", key) {
+				assert.Equal([]byte("bar"), val)
+			}
+		}
+		_, err := db.Get([]byte("missing"))
+		assert.Equal(ErrKeyNotFound, err)
+	}
 
-					assert.Equal(info.Mode()&os.ModePerm, defaultTestMode&^umask)
-				}
-				return nil
-			})
-			assert.NoError(err)
-		})
+	// The filter grows as it fills up
+	db, err := Open(path, options(true)...)
+	require.NoError(err)
+	require.NotNil(db.filter)
+	for i := 0; i < 3000; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+	}
+	for i := 3; i < 3000; i += 10 {
+		require.NoError(db.Delete([]byte(fmt.Sprintf("foo%d", i))))
+	}
+	assert.True(db.filter.Layers() > 1)
+	check(db, 3000)
+	require.NoError(db.Close())
+
+	t.Run("Saved", func(t *testing.T) {
+		db, err := Open(path, options(true)...)
+		require.NoError(err)
+		saved, _, _, err := index.LoadFilter(fsys, filepath.Join(path, filterFile))
+		require.NoError(err)
+		assert.Equal(saved, db.filter)
+		check(db, 3000)
+		require.NoError(db.Put([]byte("foo3000"), []byte("bar")))
+		require.NoError(db.Merge())
+		assert.Equal(1, db.filter.Layers())
+		check(db, 3001)
+	})
 
-		t.Run("Dir FileModeBeforeUmask is set via options for all subdirectories", func(t *testing.T) {
-			testdir, err := ioutil.TempDir("", "bitcask")
-			embeddedDir := filepath.Join(testdir, "cache")
-			assert.NoError(err)
-			defer os.RemoveAll(testdir)
+	t.Run("Replayed", func(t *testing.T) {
+		// The saved filter misses the keys of the datafiles replayed
+		fsys = fsys.Restart()
+		db, err := Open(path, options(true)...)
+		require.NoError(err)
+		require.NoError(db.Put([]byte("foo3001"), []byte("bar")))
+		fsys = fsys.Restart()
+		db, err = Open(path, options(true)...)
+		require.NoError(err)
+		check(db, 3002)
+		require.NoError(db.Close())
+	})
 
-			testMode := os.FileMode(0713)
+	t.Run("Disabled", func(t *testing.T) {
+		db, err := Open(path, options(false)...)
+		require.NoError(err)
+		assert.Nil(db.filter)
+		check(db, 3002)
+		require.NoError(db.Close())
+		assert.False(internal.Exists(fsys, filepath.Join(path, filterFile)))
+	})
+}
 
-			db, err := Open(embeddedDir, WithDirFileModeBeforeUmask(testMode))
-			assert.NoError(err)
-			defer db.Close()
-			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
-				// skip the root directory
-				if path == testdir {
-					return nil
-				}
-				if info.IsDir() {
-					// create anotherDir with allPerms - to infer umask
-					anotherDir := filepath.Join(testdir, "temp")
-					err := os.Mkdir(anotherDir, os.ModePerm)
-					assert.NoError(err)
-					defer os.RemoveAll(anotherDir)
+func TestValueCache(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
 
-					anotherStat, _ := os.Stat(anotherDir)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
 
-					// infer umask from anotherDir
-					umask := os.ModePerm ^ (anotherStat.Mode() & os.ModePerm)
+	db, err := Open(testdir, WithValueCache(1<<20), WithMaxDatafileSize(256))
+	require.NoError(err)
+	defer db.Close()
 
-					assert.Equal(info.Mode()&os.ModePerm, testMode&^umask)
-				}
-				return nil
-			})
-			assert.NoError(err)
-		})
+	stats := func() (uint64, uint64) {
+		s, err := db.Stats()
+		require.NoError(err)
+		return s.ValueCacheHits, s.ValueCacheMisses
+	}
 
+	t.Run("Get", func(t *testing.T) {
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		for i := 0; i < 3; i++ {
+			val, err := db.Get([]byte("foo"))
+			require.NoError(err)
+			assert.Equal([]byte("bar"), val)
+			// The cached value isn't shared with the callers
+			val[0] = 'x'
+		}
+		hits, misses := stats()
+		assert.Equal(uint64(2), hits)
+		assert.Equal(uint64(1), misses)
 	})
-}
 
-func TestFileFileModeBeforeUmask(t *testing.T) {
-	assert := assert.New(t)
-
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Default File FileModeBeforeUmask is 0600", func(t *testing.T) {
-			testdir, err := ioutil.TempDir("", "bitcask")
-			assert.NoError(err)
-			defer os.RemoveAll(testdir)
+	t.Run("Invalidate", func(t *testing.T) {
+		require.NoError(db.Put([]byte("foo"), []byte("baz")))
+		val, err := db.Get([]byte("foo"))
+		require.NoError(err)
+		assert.Equal([]byte("baz"), val)
 
-			defaultTestMode := os.FileMode(0600)
+		require.NoError(db.Delete([]byte("foo")))
+		_, err = db.Get([]byte("foo"))
+		assert.Equal(ErrKeyNotFound, err)
+	})
 
-			db, err := Open(testdir)
-			assert.NoError(err)
-			defer db.Close()
-			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
-				if !info.IsDir() {
-					// the lock file is set within Flock, so ignore it
-					if filepath.Base(path) == "lock" {
-						return nil
-					}
-					// create aFile with allPerms - to infer umask
-					aFilePath := filepath.Join(testdir, "temp")
-					_, err := os.OpenFile(aFilePath, os.O_CREATE, os.ModePerm)
-					assert.NoError(err)
-					defer os.RemoveAll(aFilePath)
+	t.Run("Merge", func(t *testing.T) {
+		for i := 0; i < 50; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("old%d", i))))
+		}
+		for i := 0; i < 50; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))))
+			_, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(err)
+		}
+		before, _ := stats()
+		require.NoError(db.Merge())
 
-					fileStat, _ := os.Stat(aFilePath)
+		// The cached values follow their keys to the merged datafiles
+		for i := 0; i < 50; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			require.NoError(err)
+			assert.Equal([]byte(fmt.Sprintf("value%d", i)), val)
+		}
+		after, _ := stats()
+		assert.Equal(before+50, after)
+	})
 
-					// infer umask from anotherDir
-					umask := os.ModePerm ^ (fileStat.Mode() & os.ModePerm)
+	t.Run("Corrupt", func(t *testing.T) {
+		dir := filepath.Join(testdir, "corrupt")
+		db, err := Open(dir, WithValueCache(1<<20))
+		require.NoError(err)
+		defer db.Close()
 
-					assert.Equal(info.Mode()&os.ModePerm, defaultTestMode&^umask)
-				}
-				return nil
-			})
-			assert.NoError(err)
-		})
+		require.NoError(db.Put([]byte("foo"), []byte("corrupted")))
+		name := filepath.Join(dir, "000000000.data")
+		b, err := ioutil.ReadFile(name)
+		require.NoError(err)
+		i := bytes.Index(b, []byte("corrupted"))
+		require.True(i >= 0)
+		b[i] = 'C'
+		require.NoError(ioutil.WriteFile(name, b, 0600))
+
+		// Entries failing their checksum aren't cached
+		for i := 0; i < 2; i++ {
+			_, err = db.Get([]byte("foo"))
+			assert.Equal(ErrChecksumFailed, err)
+		}
+		s, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(uint64(0), s.ValueCacheHits)
+		assert.Equal(uint64(2), s.ValueCacheMisses)
+	})
 
-		t.Run("File FileModeBeforeUmask is set via options for all files", func(t *testing.T) {
-			testdir, err := ioutil.TempDir("", "bitcask")
-			assert.NoError(err)
-			defer os.RemoveAll(testdir)
+	t.Run("Evict", func(t *testing.T) {
+		db, err := Open(filepath.Join(testdir, "evict"), WithValueCache(2*(valueCacheOverhead+16)))
+		require.NoError(err)
+		defer db.Close()
 
-			testMode := os.FileMode(0673)
+		for _, key := range []string{"a", "b", "c"} {
+			require.NoError(db.Put([]byte(key), []byte("value")))
+		}
+		for _, key := range []string{"a", "b", "c", "c", "a"} {
+			_, err := db.Get([]byte(key))
+			require.NoError(err)
+		}
+		s, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(uint64(1), s.ValueCacheHits)
+		assert.Equal(uint64(4), s.ValueCacheMisses)
+	})
 
-			db, err := Open(testdir, WithFileFileModeBeforeUmask(testMode))
-			assert.NoError(err)
-			defer db.Close()
-			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
-				if !info.IsDir() {
-					// the lock file is set within Flock, so ignore it
-					if filepath.Base(path) == "lock" {
-						return nil
+	t.Run("Concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		done := make(chan struct{})
+		for r := 0; r < 4; r++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
 					}
-					// create aFile with allPerms - to infer umask
-					aFilePath := filepath.Join(testdir, "temp")
-					_, err := os.OpenFile(aFilePath, os.O_CREATE, os.ModePerm)
+					db.Get([]byte("hot"))
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if err := db.Merge(); err != nil && err != ErrMergeInProgress {
 					assert.NoError(err)
-					defer os.RemoveAll(aFilePath)
-
-					fileStat, _ := os.Stat(aFilePath)
-
-					// infer umask from anotherDir
-					umask := os.ModePerm ^ (fileStat.Mode() & os.ModePerm)
-
-					assert.Equal(info.Mode()&os.ModePerm, testMode&^umask)
+					return
 				}
-				return nil
-			})
-			assert.NoError(err)
-		})
+			}
+		}()
+
+		// A write is always seen by the reads after it
+		for i := 0; i < 500; i++ {
+			value := []byte(fmt.Sprintf("value%d", i))
+			require.NoError(db.Put([]byte("hot"), value))
+			val, err := db.Get([]byte("hot"))
+			require.NoError(err)
+			require.Equal(value, val)
+		}
+		close(done)
+		wg.Wait()
 	})
 }
 
-func TestMaxDatafileSize(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
-
+func TestSync(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
-	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
-			assert.NoError(err)
-		})
+	var db *Bitcask
 
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
-			assert.NoError(err)
-		})
+	t.Run("Open", func(t *testing.T) {
+		db, err = Open(testdir, WithSync(true))
+		assert.NoError(err)
 	})
 
 	t.Run("Put", func(t *testing.T) {
-		for i := 0; i < 10; i++ {
-			err := db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar"))
-			assert.NoError(err)
-		}
+		key := []byte(strings.Repeat(" ", 17))
+		value := []byte("foobar")
+		err = db.Put(key, value)
 	})
 
-	t.Run("Sync", func(t *testing.T) {
-		err = db.Sync()
+	t.Run("Put", func(t *testing.T) {
+		err = db.Put([]byte("hello"), []byte("world"))
 		assert.NoError(err)
 	})
+}
 
-	t.Run("Get", func(t *testing.T) {
-		val, err := db.Get([]byte("foo"))
-		assert.NoError(err)
-		assert.Equal([]byte("bar"), val)
+// syncCountingDatafile counts the syncs of the wrapped datafile and
+// optionally fails them
+type syncCountingDatafile struct {
+	data.Datafile
+	mu        sync.Mutex
+	syncs     int
+	datasyncs int
+	err       error
+}
 
-		for i := 0; i < 10; i++ {
-			val, err = db.Get([]byte(fmt.Sprintf("key_%d", i)))
-			assert.NoError(err)
-			assert.Equal([]byte("bar"), val)
+func (df *syncCountingDatafile) counts() (int, int) {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	return df.syncs, df.datasyncs
+}
+
+func (df *syncCountingDatafile) Datasync() error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.datasyncs++
+	if df.err != nil {
+		return df.err
+	}
+	return df.Datafile.Datasync()
+}
+
+func (df *syncCountingDatafile) Sync() error {
+	df.mu.Lock()
+	defer df.mu.Unlock()
+	df.syncs++
+	if df.err != nil {
+		return df.err
+	}
+	return df.Datafile.Sync()
+}
+
+func TestGroupCommit(t *testing.T) {
+	const writers, puts = 16, 50
+
+	t.Run("Batching", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSync(true), WithGroupCommit(time.Millisecond, 1<<20))
+		require.NoError(err)
+
+		df := &syncCountingDatafile{Datafile: db.curr}
+		db.mu.Lock()
+		db.curr = df
+		db.mu.Unlock()
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < puts; j++ {
+					key := []byte(fmt.Sprintf("%d-%d", i, j))
+					assert.NoError(db.Put(key, key))
+				}
+			}(i)
 		}
-	})
+		wg.Wait()
 
-	t.Run("Close", func(t *testing.T) {
-		err = db.Close()
-		assert.NoError(err)
+		syncs, _ := df.counts()
+		assert.True(syncs > 0)
+		assert.True(syncs < writers*puts, "expected fewer syncs than puts, got %d", syncs)
+
+		require.NoError(db.Close())
+
+		db, err = Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+		assert.Equal(writers*puts, db.Len())
 	})
-}
 
-func TestMerge(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+	t.Run("Rotation", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSync(true), WithGroupCommit(time.Millisecond, 256), WithMaxDatafileSize(256))
+		require.NoError(err)
+
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < puts; j++ {
+					key := []byte(fmt.Sprintf("%d-%d", i, j))
+					assert.NoError(db.Put(key, key))
+				}
+			}(i)
+		}
+		wg.Wait()
+		require.NoError(db.Close())
+
+		db, err = Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+		assert.Equal(writers*puts, db.Len())
+	})
+
+	t.Run("SyncError", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSync(true), WithGroupCommit(time.Millisecond, 0))
+		require.NoError(err)
+		defer db.Close()
+
+		df := &syncCountingDatafile{Datafile: db.curr, err: ErrMockError}
+		db.mu.Lock()
+		db.curr = df
+		db.mu.Unlock()
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.Equal(ErrMockError, err)
+
+		df.mu.Lock()
+		df.err = nil
+		df.mu.Unlock()
+
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+	})
+
+	t.Run("SyncRecovered", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		// The sync goroutine is kept from syncing so that the test syncs
+		// the group commits itself
+		fsys := faultfs.New(1)
+		db, err := Open("/db", WithFileSystem(fsys), WithSync(true), WithGroupCommit(time.Hour, 0))
+		require.NoError(err)
+		defer db.Close()
+
+		// write appends a put as Put does, without waiting for it
+		write := func(key string) int64 {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			offset, n, err := db.put([]byte(key), []byte(key), Feature{})
+			require.NoError(err)
+			db.update([]byte(key), offset, n)
+			return db.appended(n)
+		}
+
+		// A writer not yet waiting when a sync of its put fails and a later
+		// one succeeds still gets the error
+		failed := write("foo")
+		fsys.Inject(faultfs.SyncError, 1)
+		db.commit.commit(db.syncActive())
+		fsys.Clear()
+		synced := write("bar")
+		db.commit.commit(db.syncActive())
+
+		err = db.waitDurable(failed)
+		if assert.Error(err) {
+			assert.Equal(syscall.EIO, err.(*os.PathError).Err)
+		}
+		assert.NoError(db.waitDurable(synced))
+
+		// The write whose sync failed isn't undone
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("foo"), val)
+
+		// Once no writer is covered by the failure it is forgotten
+		assert.Empty(db.commit.failures)
+		seq := write("baz")
+		db.commit.commit(db.syncActive())
+		assert.NoError(db.waitDurable(seq))
+	})
+}
+
+func TestSyncPolicy(t *testing.T) {
+	// wrapCurrent replaces the active datafile of db with a counting one
+	wrapCurrent := func(db *Bitcask) *syncCountingDatafile {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		df := &syncCountingDatafile{Datafile: db.curr}
+		db.curr = df
+		return df
+	}
+
+	t.Run("Always", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncPolicy(SyncAlways))
+		require.NoError(err)
+		defer db.Close()
+
+		df := wrapCurrent(db)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		require.NoError(db.Delete([]byte("foo")))
+
+		syncs, datasyncs := df.counts()
+		assert.Equal(2, syncs)
+		assert.Equal(0, datasyncs)
+	})
+
+	t.Run("AlwaysDatasync", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncPolicy(SyncAlwaysDatasync))
+		require.NoError(err)
+		defer db.Close()
+
+		df := wrapCurrent(db)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		require.NoError(db.Delete([]byte("foo")))
+
+		syncs, datasyncs := df.counts()
+		assert.Equal(0, syncs)
+		assert.Equal(2, datasyncs)
+	})
+
+	t.Run("Never", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncPolicy(SyncNever))
+		require.NoError(err)
+		defer db.Close()
+
+		df := wrapCurrent(db)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+		syncs, datasyncs := df.counts()
+		assert.Equal(0, syncs+datasyncs)
+
+		require.NoError(db.Sync())
+		syncs, _ = df.counts()
+		assert.Equal(1, syncs)
+	})
+
+	t.Run("Interval", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncInterval(10*time.Millisecond))
+		require.NoError(err)
+
+		df := wrapCurrent(db)
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+
+		syncs, _ := df.counts()
+		assert.Equal(0, syncs)
+
+		time.Sleep(100 * time.Millisecond)
+		syncs, _ = df.counts()
+		assert.True(syncs > 0)
+
+		require.NoError(db.Close())
+	})
+
+	t.Run("Config", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithSyncInterval(time.Second))
+		require.NoError(err)
+		require.NoError(db.Close())
+
+		cfg, err := config.Load(fs.OS, filepath.Join(testdir, "config.json"))
+		require.NoError(err)
+		assert.Equal(SyncInterval, cfg.SyncPolicy)
+		assert.Equal(time.Second, cfg.SyncInterval)
+
+		db, err = Open(testdir)
+		require.NoError(err)
+		assert.Equal(SyncInterval, db.config.SyncPolicy)
+		require.NoError(db.Close())
+	})
+
+	t.Run("LegacyConfig", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		require.NoError(err)
+		require.NoError(db.Close())
+
+		// Rewrite config.json the way it was saved before sync policies
+		configPath := filepath.Join(testdir, "config.json")
+		var raw map[string]interface{}
+		require.NoError(internal.LoadFromJsonFile(fs.OS, configPath, &raw))
+		delete(raw, "sync_policy")
+		delete(raw, "sync_interval")
+		raw["sync"] = true
+		require.NoError(internal.SaveJsonToFile(fs.OS, raw, configPath, 0600))
+
+		db, err = Open(testdir)
+		require.NoError(err)
+		defer db.Close()
+		assert.Equal(SyncAlways, db.config.SyncPolicy)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		assert := assert.New(t)
+
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		_, err = Open(testdir, WithSyncPolicy("sometimes"))
+		assert.Equal(ErrInvalidSyncPolicy, err)
+
+		_, err = Open(testdir, WithSyncPolicy(SyncInterval))
+		assert.Equal(ErrInvalidSyncPolicy, err)
+
+		_, err = Open(testdir, WithSyncInterval(0))
+		assert.Equal(ErrInvalidSyncPolicy, err)
+	})
+}
+
+func TestMaxKeySize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	var db *Bitcask
+
+	t.Run("Open", func(t *testing.T) {
+		db, err = Open(testdir, WithMaxKeySize(16))
+		assert.NoError(err)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		key := []byte(strings.Repeat(" ", 17))
+		value := []byte("foobar")
+		err = db.Put(key, value)
+		assert.Error(err)
+		assert.Equal(ErrKeyTooLarge, err)
+	})
+}
+
+func TestMaxValueSize(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	var db *Bitcask
+
+	t.Run("Open", func(t *testing.T) {
+		db, err = Open(testdir, WithMaxValueSize(16))
+		assert.NoError(err)
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		key := []byte("foo")
+		value := []byte(strings.Repeat(" ", 17))
+		err = db.Put(key, value)
+		assert.Error(err)
+		assert.Equal(ErrValueTooLarge, err)
+	})
+}
+
+func TestStats(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+
+		t.Run("Get", func(t *testing.T) {
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		})
+
+		t.Run("Stats", func(t *testing.T) {
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(stats.Datafiles, 0)
+			assert.Equal(stats.Keys, 1)
+		})
+
+		t.Run("Sync", func(t *testing.T) {
+			err = db.Sync()
+			assert.NoError(err)
+		})
+
+		t.Run("Close", func(t *testing.T) {
+			err = db.Close()
+			assert.NoError(err)
+		})
+	})
+}
+
+func TestStatsError(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+
+		t.Run("Get", func(t *testing.T) {
+			val, err := db.Get([]byte("foo"))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		})
+
+		t.Run("Stats", func(t *testing.T) {
+			stats, err := db.Stats()
+			assert.NoError(err)
+			assert.Equal(stats.Datafiles, 0)
+			assert.Equal(stats.Keys, 1)
+		})
+	})
+
+	t.Run("Test", func(t *testing.T) {
+		t.Run("FabricatedDestruction", func(t *testing.T) {
+			// This would never happen in reality :D
+			// Or would it? :)
+			err = os.RemoveAll(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Stats", func(t *testing.T) {
+			_, err := db.Stats()
+			assert.Error(err)
+		})
+	})
+}
+
+func TestDirFileModeBeforeUmask(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Default DirFileModeBeforeUmask is 0700", func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			embeddedDir := filepath.Join(testdir, "cache")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			defaultTestMode := os.FileMode(0700)
+
+			db, err := Open(embeddedDir)
+			assert.NoError(err)
+			defer db.Close()
+			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
+				// skip the root directory
+				if path == testdir {
+					return nil
+				}
+				if info.IsDir() {
+					// perms for directory on disk are filtered through defaultTestMode, AND umask of user running test.
+					// this means the mkdir calls can only FURTHER restrict permissions, not grant more (preventing escalatation).
+					// to make this test OS agnostic, we'll skip using golang.org/x/sys/unix, inferring umask via XOR and AND NOT.
+
+					// create anotherDir with allPerms - to infer umask
+					anotherDir := filepath.Join(testdir, "temp")
+					err := os.Mkdir(anotherDir, os.ModePerm)
+					assert.NoError(err)
+					defer os.RemoveAll(anotherDir)
+
+					anotherStat, err := os.Stat(anotherDir)
+					assert.NoError(err)
+
+					// infer umask from anotherDir
+					umask := os.ModePerm ^ (anotherStat.Mode() & os.ModePerm)
+
+					assert.Equal(info.Mode()&os.ModePerm, defaultTestMode&^umask)
+				}
+				return nil
+			})
+			assert.NoError(err)
+		})
+
+		t.Run("Dir FileModeBeforeUmask is set via options for all subdirectories", func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			embeddedDir := filepath.Join(testdir, "cache")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			testMode := os.FileMode(0713)
+
+			db, err := Open(embeddedDir, WithDirFileModeBeforeUmask(testMode))
+			assert.NoError(err)
+			defer db.Close()
+			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
+				// skip the root directory
+				if path == testdir {
+					return nil
+				}
+				if info.IsDir() {
+					// create anotherDir with allPerms - to infer umask
+					anotherDir := filepath.Join(testdir, "temp")
+					err := os.Mkdir(anotherDir, os.ModePerm)
+					assert.NoError(err)
+					defer os.RemoveAll(anotherDir)
+
+					anotherStat, _ := os.Stat(anotherDir)
+
+					// infer umask from anotherDir
+					umask := os.ModePerm ^ (anotherStat.Mode() & os.ModePerm)
+
+					assert.Equal(info.Mode()&os.ModePerm, testMode&^umask)
+				}
+				return nil
+			})
+			assert.NoError(err)
+		})
+
+	})
+}
+
+func TestFileFileModeBeforeUmask(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Default File FileModeBeforeUmask is 0600", func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			defaultTestMode := os.FileMode(0600)
+
+			db, err := Open(testdir)
+			assert.NoError(err)
+			defer db.Close()
+			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
+				if !info.IsDir() {
+					// the lock file is set within Flock, so ignore it
+					if filepath.Base(path) == "lock" {
+						return nil
+					}
+					// create aFile with allPerms - to infer umask
+					aFilePath := filepath.Join(testdir, "temp")
+					_, err := os.OpenFile(aFilePath, os.O_CREATE, os.ModePerm)
+					assert.NoError(err)
+					defer os.RemoveAll(aFilePath)
+
+					fileStat, _ := os.Stat(aFilePath)
+
+					// infer umask from anotherDir
+					umask := os.ModePerm ^ (fileStat.Mode() & os.ModePerm)
+
+					assert.Equal(info.Mode()&os.ModePerm, defaultTestMode&^umask)
+				}
+				return nil
+			})
+			assert.NoError(err)
+		})
+
+		t.Run("File FileModeBeforeUmask is set via options for all files", func(t *testing.T) {
+			testdir, err := ioutil.TempDir("", "bitcask")
+			assert.NoError(err)
+			defer os.RemoveAll(testdir)
+
+			testMode := os.FileMode(0673)
+
+			db, err := Open(testdir, WithFileFileModeBeforeUmask(testMode))
+			assert.NoError(err)
+			defer db.Close()
+			err = filepath.Walk(testdir, func(path string, info os.FileInfo, err error) error {
+				if !info.IsDir() {
+					// the lock file is set within Flock, so ignore it
+					if filepath.Base(path) == "lock" {
+						return nil
+					}
+					// create aFile with allPerms - to infer umask
+					aFilePath := filepath.Join(testdir, "temp")
+					_, err := os.OpenFile(aFilePath, os.O_CREATE, os.ModePerm)
+					assert.NoError(err)
+					defer os.RemoveAll(aFilePath)
+
+					fileStat, _ := os.Stat(aFilePath)
+
+					// infer umask from anotherDir
+					umask := os.ModePerm ^ (fileStat.Mode() & os.ModePerm)
+
+					assert.Equal(info.Mode()&os.ModePerm, testMode&^umask)
+				}
+				return nil
+			})
+			assert.NoError(err)
+		})
+	})
+}
+
+func TestMaxDatafileSize(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir, WithMaxDatafileSize(32))
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+	})
+
+	t.Run("Put", func(t *testing.T) {
+		for i := 0; i < 10; i++ {
+			err := db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar"))
+			assert.NoError(err)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		err = db.Sync()
+		assert.NoError(err)
+	})
+
+	t.Run("Sealed", func(t *testing.T) {
+		for _, df := range db.datafiles {
+			assert.True(df.Size() <= 32, "datafile %d is %d bytes", df.FileID(), df.Size())
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+
+		for i := 0; i < 10; i++ {
+			val, err = db.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		err = db.Close()
+		assert.NoError(err)
+	})
+}
+
+func TestPreallocate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	// Datafiles span many blocks so that the space allocated to them tells
+	// whether they're preallocated
+	const maxDatafileSize = 1 << 16
+	value := bytes.Repeat([]byte("bar"), 1000)
+
+	db, err := Open(testdir, WithPreallocate(true), WithMaxDatafileSize(maxDatafileSize))
+	require.NoError(err)
+
+	// The space of the active datafile is allocated up front
+	if size, _, ok := allocated(t, db.curr.Name()); ok {
+		assert.True(size >= maxDatafileSize, "%d bytes allocated", size)
+	}
+
+	for i := 0; i < 100; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key_%03d", i)), value))
+	}
+
+	// Preallocation does not change the apparent size of the active datafile
+	stat, err := os.Stat(db.curr.Name())
+	require.NoError(err)
+	assert.Equal(db.curr.Size(), stat.Size())
+	if size, _, ok := allocated(t, db.curr.Name()); ok {
+		assert.True(size >= maxDatafileSize, "%d bytes allocated", size)
+	}
+	require.NoError(db.Close())
+
+	// The space not used is released once datafiles are sealed, and when
+	// the active one is closed
+	files, err := filepath.Glob(filepath.Join(testdir, "*.data"))
+	require.NoError(err)
+	assert.True(len(files) > 1)
+	for _, fn := range files {
+		stat, err := os.Stat(fn)
+		require.NoError(err)
+		assert.True(stat.Size() <= maxDatafileSize, "%s is %d bytes", fn, stat.Size())
+		if size, block, ok := allocated(t, fn); ok {
+			used := (stat.Size() + block - 1) / block * block
+			assert.True(size <= used, "%s has %d bytes allocated for %d bytes", fn, size, stat.Size())
+		}
+	}
+
+	db, err = Open(testdir, WithPreallocate(true), WithMaxDatafileSize(maxDatafileSize))
+	require.NoError(err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key_%03d", i)))
+		assert.NoError(err)
+		assert.Equal(value, val)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir, WithMaxDatafileSize(32))
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err := db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+
+		s1, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(0, s1.Datafiles)
+		assert.Equal(1, s1.Keys)
+
+		t.Run("Put", func(t *testing.T) {
+			for i := 0; i < 10; i++ {
+				err := db.Put([]byte("foo"), []byte("bar"))
+				assert.NoError(err)
+			}
+		})
+
+		s2, err := db.Stats()
+		assert.NoError(err)
+		// Each 30 byte entry seals the datafile before the next one
+		assert.Equal(10, s2.Datafiles)
+		assert.Equal(1, s2.Keys)
+		assert.True(s2.Size > s1.Size)
+
+		t.Run("Merge", func(t *testing.T) {
+			err := db.Merge()
+			assert.NoError(err)
+		})
+
+		s3, err := db.Stats()
+		assert.NoError(err)
+		assert.Equal(1, s3.Datafiles)
+		assert.Equal(1, s3.Keys)
+		assert.True(s3.Size > s1.Size)
+		assert.True(s3.Size < s2.Size)
+
+		t.Run("Sync", func(t *testing.T) {
+			err = db.Sync()
+			assert.NoError(err)
+		})
+
+		t.Run("Close", func(t *testing.T) {
+			err = db.Close()
+			assert.NoError(err)
+		})
+	})
+}
+
+func TestMergeIncremental(t *testing.T) {
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(64), WithMergeChunkSize(128))
+	require.NoError(err)
+
+	expected := make(map[string][]byte)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("k%02d", i)
+			value := []byte(fmt.Sprintf("v%02d.%d", i, round))
+			require.NoError(db.Put([]byte(key), value))
+			expected[key] = value
+		}
+	}
+	for i := 0; i < 30; i += 3 {
+		key := fmt.Sprintf("k%02d", i)
+		require.NoError(db.Delete([]byte(key)))
+		delete(expected, key)
+	}
+
+	before, err := db.Stats()
+	require.NoError(err)
+
+	// Keep writing while the merge is running
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 30; i += 3 {
+			key := fmt.Sprintf("k%02d", i)
+			require.NoError(db.Put([]byte(key), []byte("updated")))
+		}
+	}()
+	require.NoError(db.Merge())
+	<-done
+	for i := 1; i < 30; i += 3 {
+		expected[fmt.Sprintf("k%02d", i)] = []byte("updated")
+	}
+
+	after, err := db.Stats()
+	require.NoError(err)
+	require.True(after.Datafiles < before.Datafiles)
+	require.True(after.Size < before.Size)
+
+	check := func() {
+		require.Equal(len(expected), db.Len())
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			require.NoError(err)
+			require.Equal(value, val)
+		}
+	}
+	check()
+
+	// Rebuilding the index from the merged datafiles must not resurrect
+	// deleted or overwritten values
+	require.NoError(db.Close())
+	require.NoError(os.Remove(filepath.Join(testdir, "index")))
+	db, err = Open(testdir)
+	require.NoError(err)
+	check()
+	require.NoError(db.Close())
+}
+
+func TestMergeWithOptions(t *testing.T) {
+	setup := func(t *testing.T) (*Bitcask, string) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(t, err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(64), WithMergeChunkSize(128))
+		require.NoError(t, err)
+		for round := 0; round < 2; round++ {
+			for i := 0; i < 20; i++ {
+				key := []byte(fmt.Sprintf("k%02d", i))
+				require.NoError(t, db.Put(key, []byte(fmt.Sprintf("v%d", round))))
+			}
+		}
+		return db, testdir
+	}
+
+	t.Run("Progress", func(t *testing.T) {
+		assert := assert.New(t)
+		db, testdir := setup(t)
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		var reports []MergeProgress
+		err := db.MergeWithOptions(MergeOptions{
+			Progress: func(p MergeProgress) {
+				reports = append(reports, p)
+			},
+		})
+		assert.NoError(err)
+		if assert.True(len(reports) > 1) {
+			last := reports[len(reports)-1]
+			assert.Equal(last.TotalFiles, last.Files)
+			assert.Equal(20, last.Keys)
+			assert.Equal(int64(20*29), last.Bytes)
+			for i := 1; i < len(reports); i++ {
+				assert.True(reports[i].Files > reports[i-1].Files)
+			}
+		}
+	})
+
+	t.Run("RateLimit", func(t *testing.T) {
+		assert := assert.New(t)
+		db, testdir := setup(t)
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		// 40 entries of 29 bytes at 2KB/s take at least 500ms
+		start := time.Now()
+		assert.NoError(db.MergeWithOptions(MergeOptions{RateLimit: 2048}))
+		assert.True(time.Since(start) >= 500*time.Millisecond)
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		assert := assert.New(t)
+		db, testdir := setup(t)
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		err := db.MergeWithOptions(MergeOptions{Context: ctx})
+		assert.Equal(context.Canceled, err)
+
+		for i := 0; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("k%02d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("v1"), val)
+		}
+		files, err := ioutil.ReadDir(testdir)
+		assert.NoError(err)
+		for _, file := range files {
+			assert.False(file.IsDir())
+		}
+	})
+
+	t.Run("CancelPartway", func(t *testing.T) {
+		assert := assert.New(t)
+		require := require.New(t)
+		db, testdir := setup(t)
+		defer os.RemoveAll(testdir)
+		defer db.Close()
+		assert.Equal(int64(20*29), db.Reclaimable())
+
+		// The chunks swapped in before the merge is cancelled leave the
+		// index saved and the reclaimable space accounted for
+		ctx, cancel := context.WithCancel(context.Background())
+		err := db.MergeWithOptions(MergeOptions{
+			Context: ctx,
+			Progress: func(p MergeProgress) {
+				cancel()
+			},
+		})
+		assert.Equal(context.Canceled, err)
+		assert.FileExists(filepath.Join(testdir, "index"))
+		assert.True(db.metadata.IndexUpToDate)
+		reclaimable := db.Reclaimable()
+		assert.True(reclaimable > 0 && reclaimable < 20*29, "%d reclaimable", reclaimable)
+
+		report, err := db.Verify(context.Background(), VerifyOptions{})
+		require.NoError(err)
+		assert.True(report.OK(), "%+v", report.Problems)
+		assert.Equal(report.DeadBytes, report.ReclaimableSpace)
+
+		require.NoError(db.Close())
+		db, err = Open(testdir, WithMaxDatafileSize(64), WithMergeChunkSize(128))
+		require.NoError(err)
+		assert.Equal(reclaimable, db.Reclaimable())
+		require.NoError(db.Merge())
+		assert.Equal(int64(0), db.Reclaimable())
+		for i := 0; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("k%02d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("v1"), val)
+		}
+	})
+}
+
+func TestGetErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("ReadError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("ReadAt", int64(0), int64(30)).Return(
+			internal.Entry{},
+			ErrMockError,
+		)
+		db.curr = mockDatafile
+
+		_, err = db.Get([]byte("foo"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("ChecksumError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(40))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("ReadAt", int64(0), int64(30)).Return(
+			internal.Entry{
+				Checksum: 0x0,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte("bar"),
+			},
+			nil,
+		)
+		db.curr = mockDatafile
+
+		_, err = db.Get([]byte("foo"))
+		assert.Error(err)
+		assert.Equal(ErrChecksumFailed, err)
+	})
+
+}
+
+func TestPutBorderCases(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("EmptyValue", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		err = db.Put([]byte("alice"), nil)
+		assert.NoError(err)
+		z, err := db.Get([]byte("alice"))
+		assert.NoError(err)
+		assert.Empty(z)
+	})
+}
+
+func TestPutErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("WriteError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x76ff8caa,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte("bar"),
+			},
+		).Return(int64(0), int64(0), ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("SyncError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		db, err := Open(testdir, WithSync(true))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x78240498,
+				Key:      []byte("bar"),
+				Offset:   0,
+				Value:    []byte("baz"),
+			},
+		).Return(int64(0), int64(0), nil)
+		mockDatafile.On("Sync").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Put([]byte("bar"), []byte("baz"))
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("EmptyKey", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+		err = db.Put(nil, []byte("hello"))
+		assert.Equal(ErrEmptyKey, err)
+
+	})
+
+}
+
+func TestOpenErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("BadPath", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		assert.NoError(ioutil.WriteFile(filepath.Join(testdir, "foo"), []byte("foo"), 0600))
+
+		_, err = Open(filepath.Join(testdir, "foo", "tmp.db"))
+		assert.Error(err)
+	})
+
+	t.Run("BadOption", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		withBogusOption := func() Option {
+			return func(cfg *config.Config) error {
+				return errors.New("mocked error")
+			}
+		}
+
+		_, err = Open(testdir, withBogusOption())
+		assert.Error(err)
+	})
+
+	t.Run("LoadDatafilesError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		err = db.Close()
+		assert.NoError(err)
+
+		// Simulate some horrible that happened to the datafiles!
+		err = os.Rename(filepath.Join(testdir, "000000000.data"), filepath.Join(testdir, "000000000xxx.data"))
+		assert.NoError(err)
+
+		// The datafile is still listed in the manifest
+		_, err = Open(testdir)
+		assert.Error(err)
+		assert.True(os.IsNotExist(err))
+	})
+}
+
+func TestManifest(t *testing.T) {
+	t.Run("Rotation", func(t *testing.T) {
+		assert := assert.New(t)
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		generation := db.manifest.IndexGeneration
+		for i := 0; i < 4; i++ {
+			assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		}
+		assert.NoError(db.Close())
+
+		m, err := manifest.Load(fs.OS, filepath.Join(testdir, manifestFile))
+		assert.NoError(err)
+		assert.Equal([]int{0, 1, 2, 3}, m.Datafiles)
+		assert.Equal(3, m.Active)
+		assert.True(m.IndexGeneration > generation)
+	})
+
+	t.Run("StrayDatafile", func(t *testing.T) {
+		assert := assert.New(t)
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Close())
+
+		// A half-written datafile that was never recorded in the manifest
+		stray, err := ioutil.ReadFile(filepath.Join(testdir, "000000000.data"))
+		assert.NoError(err)
+		stray = append(stray, stray[:10]...)
+		assert.NoError(ioutil.WriteFile(filepath.Join(testdir, "000000005.data"), stray, 0600))
+		assert.NoError(os.Remove(filepath.Join(testdir, "index")))
+
+		db, err = Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		assert.Equal(1, db.Len())
+		val, err := db.Get([]byte("foo"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+		assert.NoError(db.Close())
+	})
+
+	t.Run("Upgrade", func(t *testing.T) {
+		assert := assert.New(t)
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+		for i := 0; i < 4; i++ {
+			assert.NoError(db.Put([]byte(fmt.Sprintf("foo%d", i)), []byte("bar")))
+		}
+		assert.NoError(db.Close())
+
+		// Databases created before the manifest have none
+		assert.NoError(os.Remove(filepath.Join(testdir, manifestFile)))
+
+		db, err = Open(testdir)
+		assert.NoError(err)
+		assert.Equal(4, db.Len())
+		assert.NoError(db.Close())
+		assert.True(internal.Exists(fs.OS, filepath.Join(testdir, manifestFile)))
+	})
+}
+
+func TestCloseErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	t.Run("CloseIndexError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockIndexer := new(mocks.Indexer)
+		mockIndexer.On("Save", db.fs, db.keydir, filepath.Join(db.path, "temp_index")).Return(ErrMockError)
+		db.indexer = mockIndexer
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("CloseDatafilesError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.datafiles[0] = mockDatafile
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("CloseActiveDatafileError", func(t *testing.T) {
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Close()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+}
+
+func TestDeleteErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("WriteError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		err = db.Put([]byte("foo"), []byte("bar"))
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("Size").Return(int64(0))
+		mockDatafile.On(
+			"Write",
+			internal.Entry{
+				Checksum: 0x0,
+				Key:      []byte("foo"),
+				Offset:   0,
+				Value:    []byte{},
+			},
+		).Return(int64(0), int64(0), ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Delete([]byte("foo"))
+		assert.Error(err)
+	})
+}
+
+func TestMergeErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("RemoveDatabaseDirectory", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(32))
+		assert.NoError(err)
+
+		assert.NoError(os.RemoveAll(testdir))
+
+		err = db.Merge()
+		assert.Error(err)
+	})
+
+	t.Run("EmptyCloseError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir)
+		assert.NoError(err)
+
+		mockDatafile := new(mocks.Datafile)
+		mockDatafile.On("FileID").Return(0)
+		mockDatafile.On("Close").Return(ErrMockError)
+		db.curr = mockDatafile
+
+		err = db.Merge()
+		assert.Error(err)
+		assert.Equal(ErrMockError, err)
+	})
+
+	t.Run("ReadError", func(t *testing.T) {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		assert.NoError(err)
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, WithMaxDatafileSize(22))
+		assert.NoError(err)
+
+		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
+		assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+
+		// Merging reads the datafiles sequentially, so truncate the first
+		// one to make reading its only entry fail
+		assert.NoError(os.Truncate(filepath.Join(testdir, "000000000.data"), 20))
+
+		err = db.Merge()
+		assert.Error(err)
+		assert.True(codec.IsCorruptedData(err))
+	})
+
+	t.Run("MissingMergedDatafile", func(t *testing.T) {
+		require := require.New(t)
+
+		// A committed merge whose merged datafile was lost must not remove
+		// the datafiles it replaces
+		fsys := faultfs.New(1)
+		require.NoError(fsys.MkdirAll("/db/merge1", 0700))
+		for _, name := range []string{"000000000.data", "000000001.data"} {
+			require.NoError(fs.WriteFile(fsys, filepath.Join("/db", name), []byte("data"), 0600))
+		}
+		mc := &mergeCommit{
+			Dir:     "merge1",
+			Install: []string{"000000002.data"},
+			Remove:  []string{"000000000.data", "000000001.data"},
+		}
+
+		assert.Error(applyMerge(fsys, "/db", mc))
+		for _, name := range mc.Remove {
+			assert.True(internal.Exists(fsys, filepath.Join("/db", name)), name)
+		}
+	})
+}
+
+const mergeCrashExitCode = 42
+
+// TestMergeCrash kills a process while it is merging the database, once at
+// every step of the merge, and checks that the database is consistent when
+// it is reopened afterwards.
+func TestMergeCrash(t *testing.T) {
+	if testdir := os.Getenv("BITCASK_MERGE_CRASH_DIR"); testdir != "" {
+		if step := os.Getenv("BITCASK_MERGE_RECOVERY_STEP"); step != "" {
+			recoverAndCrash(t, testdir, step)
+			return
+		}
+		mergeAndCrash(t, testdir, os.Getenv("BITCASK_MERGE_CRASH_STEP"))
+		return
+	}
+
+	require := require.New(t)
+
+	// crash runs the test in another process with the given environment and
+	// returns true if it crashed
+	crash := func(env ...string) bool {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestMergeCrash$")
+		cmd.Env = append(os.Environ(), env...)
+		err := cmd.Run()
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == mergeCrashExitCode {
+			return true
+		}
+		require.NoError(err)
+		return false
+	}
+
+	check := func(testdir string, expected map[string][]byte, step string) {
+		db, err := Open(testdir)
+		require.NoError(err, step)
+		require.Equal(len(expected), db.Len(), step)
+		for key, value := range expected {
+			val, err := db.Get([]byte(key))
+			require.NoError(err, step)
+			require.Equal(value, val, step)
+		}
+		require.NoError(db.Close())
+
+		files, err := ioutil.ReadDir(testdir)
+		require.NoError(err)
+		for _, file := range files {
+			require.False(file.IsDir(), "%s: leftover merge directory %s", step, file.Name())
+			require.NotEqual(mergeMarker, file.Name(), "%s: leftover merge marker", step)
+		}
+	}
+
+	for step := 1; ; step++ {
+		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(err)
+
+		db, err := Open(testdir, WithMaxDatafileSize(64), WithMergeChunkSize(128))
+		require.NoError(err)
+		expected := make(map[string][]byte)
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("k%d", i)
+			require.NoError(db.Put([]byte(key), []byte(fmt.Sprintf("v%d", i))))
+			expected[key] = []byte(fmt.Sprintf("v%d", i))
+		}
+		for i := 0; i < 20; i += 2 {
+			key := fmt.Sprintf("k%d", i)
+			require.NoError(db.Put([]byte(key), []byte(fmt.Sprintf("v%d'", i))))
+			expected[key] = []byte(fmt.Sprintf("v%d'", i))
+		}
+		for i := 0; i < 20; i += 5 {
+			key := fmt.Sprintf("k%d", i)
+			require.NoError(db.Delete([]byte(key)))
+			delete(expected, key)
+		}
+		require.NoError(db.Close())
+
+		crashed := crash(
+			"BITCASK_MERGE_CRASH_DIR="+testdir,
+			fmt.Sprintf("BITCASK_MERGE_CRASH_STEP=%d", step),
+		)
+
+		// The recovery of the crashed merge by Open may crash too, at any of
+		// its steps
+		for rstep := 1; crashed; rstep++ {
+			recoverydir, err := ioutil.TempDir("", "bitcask")
+			require.NoError(err)
+			require.NoError(copyDir(testdir, recoverydir))
+
+			recoveryCrashed := crash(
+				"BITCASK_MERGE_CRASH_DIR="+recoverydir,
+				fmt.Sprintf("BITCASK_MERGE_RECOVERY_STEP=%d", rstep),
+			)
+			check(recoverydir, expected, fmt.Sprintf("step %d, recovery step %d", step, rstep))
+			os.RemoveAll(recoverydir)
+
+			if !recoveryCrashed {
+				break
+			}
+		}
+
+		check(testdir, expected, fmt.Sprintf("step %d", step))
+		os.RemoveAll(testdir)
+
+		if !crashed {
+			break
+		}
+	}
+}
+
+// mergeAndCrash merges the database in testdir and exits the process without
+// any cleanup when the merge reaches the given step.
+func mergeAndCrash(t *testing.T, testdir, step string) {
+	n, err := strconv.Atoi(step)
+	require.NoError(t, err)
+
+	db, err := Open(testdir)
+	require.NoError(t, err)
+
+	mergeCheckpoint = func(string) {
+		n--
+		if n == 0 {
+			os.Exit(mergeCrashExitCode)
+		}
+	}
+	require.NoError(t, db.Merge())
+	require.NoError(t, db.Close())
+}
+
+// recoverAndCrash opens the database in testdir, rolling forward the merge
+// that crashed, and exits the process without any cleanup when the recovery
+// reaches the given step.
+func recoverAndCrash(t *testing.T, testdir, step string) {
+	n, err := strconv.Atoi(step)
+	require.NoError(t, err)
+
+	mergeCheckpoint = func(string) {
+		n--
+		if n == 0 {
+			os.Exit(mergeCrashExitCode)
+		}
+	}
+	db, err := Open(testdir)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+// copyDir copies the files and directories in src to dst
+func copyDir(src, dst string) error {
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		from, to := filepath.Join(src, file.Name()), filepath.Join(dst, file.Name())
+		if file.IsDir() {
+			if err := os.Mkdir(to, file.Mode()); err != nil {
+				return err
+			}
+			if err := copyDir(from, to); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(from)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(to, data, file.Mode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestConcurrent(t *testing.T) {
+	var (
+		db  *Bitcask
+		err error
+	)
+
+	assert := assert.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+
+	t.Run("Setup", func(t *testing.T) {
+		t.Run("Open", func(t *testing.T) {
+			db, err = Open(testdir)
+			assert.NoError(err)
+		})
+
+		t.Run("Put", func(t *testing.T) {
+			err = db.Put([]byte("foo"), []byte("bar"))
+			assert.NoError(err)
+		})
+	})
+
+	t.Run("Concurrent", func(t *testing.T) {
+		t.Run("Put", func(t *testing.T) {
+			f := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						key := []byte(fmt.Sprintf("k%d", i))
+						value := []byte(fmt.Sprintf("v%d", i))
+						err := db.Put(key, value)
+						assert.NoError(err)
+					}
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(3)
+
+			go f(wg, 2)
+			go f(wg, 3)
+			go f(wg, 5)
+
+			wg.Wait()
+		})
+
+		t.Run("Get", func(t *testing.T) {
+			f := func(wg *sync.WaitGroup, N int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= N; i++ {
+					value, err := db.Get([]byte("foo"))
+					assert.NoError(err)
+					assert.Equal([]byte("bar"), value)
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(3)
+			go f(wg, 100)
+			go f(wg, 100)
+			go f(wg, 100)
+
+			wg.Wait()
+		})
+
+		// Test concurrent Put() with concurrent Scan()
+		t.Run("PutScan", func(t *testing.T) {
+			doPut := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						key := []byte(fmt.Sprintf("k%d", i))
+						value := []byte(fmt.Sprintf("v%d", i))
+						err := db.Put(key, value)
+						assert.NoError(err)
+					}
+				}
+			}
+
+			doScan := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						err := db.Scan([]byte("k"), func(key []byte) error {
+							return nil
+						})
+						assert.NoError(err)
+					}
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(6)
+
+			go doPut(wg, 2)
+			go doPut(wg, 3)
+			go doPut(wg, 5)
+			go doScan(wg, 1)
+			go doScan(wg, 2)
+			go doScan(wg, 4)
+
+			wg.Wait()
+		})
+
+		// XXX: This has data races
+		/* Test concurrent Scan() with concurrent Merge()
+		t.Run("ScanMerge", func(t *testing.T) {
+			doScan := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						err := db.Scan([]byte("k"), func(key []byte) error {
+							return nil
+						})
+						assert.NoError(err)
+					}
+				}
+			}
+
+			doMerge := func(wg *sync.WaitGroup, x int) {
+				defer func() {
+					wg.Done()
+				}()
+				for i := 0; i <= 100; i++ {
+					if i%x == 0 {
+						err := db.Merge()
+						assert.NoError(err)
+					}
+				}
+			}
+
+			wg := &sync.WaitGroup{}
+			wg.Add(6)
+
+			go doScan(wg, 2)
+			go doScan(wg, 3)
+			go doScan(wg, 5)
+			go doMerge(wg, 1)
+			go doMerge(wg, 2)
+			go doMerge(wg, 4)
+
+			wg.Wait()
+		})
+		*/
+
+		t.Run("Close", func(t *testing.T) {
+			err = db.Close()
+			assert.NoError(err)
+		})
+	})
+}
+
+func TestConcurrentStress(t *testing.T) {
+	const (
+		writers = 8
+		readers = 8
+		keys    = 50
+		ops     = 200
+	)
+
+	assert := assert.New(t)
+	require := require.New(t)
+
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir, WithMaxDatafileSize(4096), WithMergeChunkSize(16384))
+	require.NoError(err)
+
+	// Each writer owns its keys, so the model of what each key must hold at
+	// the end is built without synchronization. A nil value is a deleted
+	// key, an empty one an expired key.
+	models := make([]map[string][]byte, writers)
+	key := func(w, k int) []byte {
+		return []byte(fmt.Sprintf("w%d-k%d", w, k))
+	}
+
+	var (
+		wg      sync.WaitGroup
+		readWg  sync.WaitGroup
+		done    = make(chan struct{})
+		expired = time.Now().Add(-time.Hour)
+	)
+	for w := 0; w < writers; w++ {
+		models[w] = make(map[string][]byte)
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			model := models[w]
+			for i := 0; i < ops; i++ {
+				k := key(w, i%keys)
+				switch {
+				case i%7 == 0:
+					assert.NoError(db.Delete(k))
+					model[string(k)] = nil
+				case i%11 == 0:
+					assert.NoError(db.Put(k, []byte("expired"), WithExpiry(expired)))
+					model[string(k)] = []byte{}
+				default:
+					value := []byte(fmt.Sprintf("%s/%d", k, i))
+					assert.NoError(db.Put(k, value))
+					model[string(k)] = value
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < readers; r++ {
+		readWg.Add(1)
+		go func(r int) {
+			defer readWg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				k := key((r+i)%writers, i%keys)
+				value, err := db.Get(k)
+				switch err {
+				case nil:
+					assert.True(bytes.HasPrefix(value, append(k, '/')), "unexpected value %q for %q", value, k)
+				case ErrKeyNotFound, ErrKeyExpired:
+				default:
+					assert.NoError(err)
+				}
+				db.Has(k)
+
+				if i%500 == 0 {
+					db.Len()
+					assert.NoError(db.Scan(key(r%writers, 0)[:3], func(key []byte) error {
+						return nil
+					}))
+					_, err := db.Stats()
+					assert.NoError(err)
+				}
+			}
+		}(r)
+	}
+
+	readWg.Add(1)
+	go func() {
+		defer readWg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := db.Merge(); err != nil {
+				assert.Equal(ErrMergeInProgress, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	readWg.Wait()
+
+	check := func(db *Bitcask) {
+		for _, model := range models {
+			for k, expected := range model {
+				value, err := db.Get([]byte(k))
+				switch {
+				case expected == nil:
+					assert.Equal(ErrKeyNotFound, err, k)
+				case len(expected) == 0:
+					assert.True(err == ErrKeyExpired || err == ErrKeyNotFound, "%s: %v", k, err)
+				default:
+					assert.NoError(err, k)
+					assert.Equal(expected, value)
+				}
+			}
+		}
+	}
+
+	check(db)
+	require.NoError(db.Merge())
+	check(db)
+	require.NoError(db.Close())
+
+	db, err = Open(testdir)
+	require.NoError(err)
+	defer db.Close()
+	check(db)
+}
 
+func TestScan(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
 
+	var db *Bitcask
+
 	t.Run("Setup", func(t *testing.T) {
 		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir, WithMaxDatafileSize(32))
-			assert.NoError(err)
-		})
-
-		t.Run("Put", func(t *testing.T) {
-			err := db.Put([]byte("foo"), []byte("bar"))
+			db, err = Open(testdir)
 			assert.NoError(err)
 		})
 
-		s1, err := db.Stats()
-		assert.NoError(err)
-		assert.Equal(0, s1.Datafiles)
-		assert.Equal(1, s1.Keys)
-
 		t.Run("Put", func(t *testing.T) {
-			for i := 0; i < 10; i++ {
-				err := db.Put([]byte("foo"), []byte("bar"))
+			var items = map[string][]byte{
+				"1":     []byte("1"),
+				"2":     []byte("2"),
+				"3":     []byte("3"),
+				"food":  []byte("pizza"),
+				"foo":   []byte([]byte("foo")),
+				"fooz":  []byte("fooz ball"),
+				"hello": []byte("world"),
+			}
+			for k, v := range items {
+				err = db.Put([]byte(k), v)
 				assert.NoError(err)
 			}
 		})
+	})
 
-		s2, err := db.Stats()
-		assert.NoError(err)
-		assert.Equal(5, s2.Datafiles)
-		assert.Equal(1, s2.Keys)
-		assert.True(s2.Size > s1.Size)
-
-		t.Run("Merge", func(t *testing.T) {
-			err := db.Merge()
-			assert.NoError(err)
-		})
-
-		s3, err := db.Stats()
-		assert.NoError(err)
-		assert.Equal(2, s3.Datafiles)
-		assert.Equal(1, s3.Keys)
-		assert.True(s3.Size > s1.Size)
-		assert.True(s3.Size < s2.Size)
-
-		t.Run("Sync", func(t *testing.T) {
-			err = db.Sync()
-			assert.NoError(err)
-		})
+	t.Run("Scan", func(t *testing.T) {
+		var (
+			vals     [][]byte
+			expected = [][]byte{
+				[]byte("foo"),
+				[]byte("fooz ball"),
+				[]byte("pizza"),
+			}
+		)
 
-		t.Run("Close", func(t *testing.T) {
-			err = db.Close()
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			val, err := db.Get(key)
 			assert.NoError(err)
+			vals = append(vals, val)
+			return nil
 		})
+		vals = SortByteArrays(vals)
+		assert.Equal(expected, vals)
 	})
-}
-
-func TestGetErrors(t *testing.T) {
-	assert := assert.New(t)
-
-	t.Run("ReadError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
-
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
-
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.NoError(err)
-
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("FileID").Return(0)
-		mockDatafile.On("ReadAt", int64(0), int64(30)).Return(
-			internal.Entry{},
-			ErrMockError,
-		)
-		db.curr = mockDatafile
 
-		_, err = db.Get([]byte("foo"))
+	t.Run("ScanErrors", func(t *testing.T) {
+		err = db.Scan([]byte("fo"), func(key []byte) error {
+			return ErrMockError
+		})
 		assert.Error(err)
 		assert.Equal(ErrMockError, err)
 	})
-
-	t.Run("ChecksumError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
-
-		db, err := Open(testdir, WithMaxDatafileSize(40))
-		assert.NoError(err)
-
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.NoError(err)
-
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("FileID").Return(0)
-		mockDatafile.On("ReadAt", int64(0), int64(30)).Return(
-			internal.Entry{
-				Checksum: 0x0,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte("bar"),
-			},
-			nil,
-		)
-		db.curr = mockDatafile
-
-		_, err = db.Get([]byte("foo"))
-		assert.Error(err)
-		assert.Equal(ErrChecksumFailed, err)
-	})
-
 }
 
-func TestPutBorderCases(t *testing.T) {
-	assert := assert.New(t)
+func TestIterateAndWrite(t *testing.T) {
+	require := require.New(t)
 
-	t.Run("EmptyValue", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir)
-		assert.NoError(err)
+	db, err := Open(testdir)
+	require.NoError(err)
+	defer db.Close()
 
-		err = db.Put([]byte("alice"), nil)
-		assert.NoError(err)
-		z, err := db.Get([]byte("alice"))
-		assert.NoError(err)
-		assert.Empty(z)
-	})
+	require.NoError(db.Put([]byte("foo"), []byte("bar")))
+	require.NoError(db.Put([]byte("fooexpired"), []byte("bar"), WithExpiry(time.Now())))
+
+	// Callbacks reading expired keys, which deletes them, and writing keys
+	// must not deadlock on the keydir
+	iterations := map[string]func(f func(key []byte) error) error{
+		"Scan": func(f func(key []byte) error) error { return db.Scan([]byte("foo"), f) },
+		"Fold": db.Fold,
+		"Keys": func(f func(key []byte) error) error {
+			for key := range db.Keys() {
+				if err := f(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	for name, iterate := range iterations {
+		iterate := iterate
+		t.Run(name, func(t *testing.T) {
+			done := make(chan error, 1)
+			go func() {
+				done <- iterate(func(key []byte) error {
+					if _, err := db.Get(key); err != nil && err != ErrKeyExpired && err != ErrKeyNotFound {
+						return err
+					}
+					return db.Put([]byte("written"), key)
+				})
+			}()
+			select {
+			case err := <-done:
+				require.NoError(err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("deadlock iterating over the keys")
+			}
+		})
+	}
+	require.False(db.Has([]byte("fooexpired")))
 }
 
-func TestPutErrors(t *testing.T) {
+func TestReadOnly(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
-	t.Run("WriteError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-
-		db, err := Open(testdir)
-		assert.NoError(err)
-
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x76ff8caa,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte("bar"),
-			},
-		).Return(int64(0), int64(0), ErrMockError)
-		db.curr = mockDatafile
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
 
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+	writer, err := Open(testdir, WithMaxDatafileSize(256))
+	require.NoError(err)
+	defer writer.Close()
 
-	t.Run("SyncError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		db, err := Open(testdir, WithSync(true))
-		assert.NoError(err)
+	for i := 0; i < 20; i++ {
+		require.NoError(writer.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("foo")))
+	}
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x78240498,
-				Key:      []byte("bar"),
-				Offset:   0,
-				Value:    []byte("baz"),
-			},
-		).Return(int64(0), int64(0), nil)
-		mockDatafile.On("Sync").Return(ErrMockError)
-		db.curr = mockDatafile
+	reader, err := Open(testdir, WithReadOnly())
+	require.NoError(err)
+	defer reader.Close()
 
-		err = db.Put([]byte("bar"), []byte("baz"))
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+	t.Run("Get", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			val, err := reader.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("foo"), val)
+		}
+		assert.Equal(20, reader.Len())
 	})
 
-	t.Run("EmptyKey", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
+	t.Run("Writes", func(t *testing.T) {
+		assert.Equal(ErrReadOnly, reader.Put([]byte("foo"), []byte("bar")))
+		assert.Equal(ErrReadOnly, reader.Delete([]byte("key_0")))
+		assert.Equal(ErrReadOnly, reader.DeleteAll())
+		assert.Equal(ErrReadOnly, reader.Merge())
+	})
 
-		db, err := Open(testdir)
+	t.Run("MultipleReaders", func(t *testing.T) {
+		other, err := Open(testdir, WithReadOnly())
+		require.NoError(err)
+		val, err := other.Get([]byte("key_1"))
 		assert.NoError(err)
-		err = db.Put(nil, []byte("hello"))
-		assert.Equal(ErrEmptyKey, err)
-
+		assert.Equal([]byte("foo"), val)
+		assert.NoError(other.Close())
 	})
 
-}
+	t.Run("Refresh", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			require.NoError(writer.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar")))
+		}
+		require.NoError(writer.Put([]byte("new"), []byte("baz")))
+		require.NoError(writer.Delete([]byte("key_0")))
 
-func TestOpenErrors(t *testing.T) {
-	assert := assert.New(t)
+		_, err := reader.Get([]byte("new"))
+		assert.Equal(ErrKeyNotFound, err)
 
-	t.Run("BadPath", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
+		require.NoError(reader.Refresh())
+		val, err := reader.Get([]byte("new"))
 		assert.NoError(err)
-		defer os.RemoveAll(testdir)
-
-		assert.NoError(ioutil.WriteFile(filepath.Join(testdir, "foo"), []byte("foo"), 0600))
+		assert.Equal([]byte("baz"), val)
+		_, err = reader.Get([]byte("key_0"))
+		assert.Equal(ErrKeyNotFound, err)
+		val, err = reader.Get([]byte("key_19"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
 
-		_, err = Open(filepath.Join(testdir, "foo", "tmp.db"))
-		assert.Error(err)
+	t.Run("Reopen", func(t *testing.T) {
+		assert.Equal(ErrReadOnly, reader.Reopen())
+		assert.NoError(writer.Refresh())
 	})
 
-	t.Run("BadOption", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	t.Run("RefreshAfterMerge", func(t *testing.T) {
+		require.NoError(writer.Merge())
+		require.NoError(reader.Refresh())
 
-		withBogusOption := func() Option {
-			return func(cfg *config.Config) error {
-				return errors.New("mocked error")
-			}
+		assert.Equal(writer.Len(), reader.Len())
+		for i := 1; i < 20; i++ {
+			val, err := reader.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
 		}
-
-		_, err = Open(testdir, withBogusOption())
-		assert.Error(err)
 	})
 
-	t.Run("LoadDatafilesError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+	t.Run("NoFilesWritten", func(t *testing.T) {
+		require.NoError(writer.Close())
 
-		db, err := Open(testdir)
-		assert.NoError(err)
+		readdir := func() []string {
+			files, err := ioutil.ReadDir(testdir)
+			require.NoError(err)
+			var names []string
+			for _, fi := range files {
+				names = append(names, fi.Name())
+			}
+			return names
+		}
 
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.NoError(err)
+		require.NoError(os.Remove(filepath.Join(testdir, "config.json")))
+		before := readdir()
 
-		err = db.Close()
+		db, err := Open(testdir, WithReadOnly())
+		require.NoError(err)
+		val, err := db.Get([]byte("new"))
 		assert.NoError(err)
+		assert.Equal([]byte("baz"), val)
+		assert.NoError(db.Sync())
+		assert.NoError(db.Close())
 
-		// Simulate some horrible that happened to the datafiles!
-		err = os.Rename(filepath.Join(testdir, "000000000.data"), filepath.Join(testdir, "000000000xxx.data"))
-		assert.NoError(err)
+		assert.Equal(before, readdir())
+	})
 
-		_, err = Open(testdir)
-		assert.Error(err)
-		assert.Equal("strconv.ParseInt: parsing \"000000000xxx\": invalid syntax", err.Error())
+	t.Run("MissingDatabase", func(t *testing.T) {
+		_, err := Open(filepath.Join(testdir, "missing"), WithReadOnly())
+		assert.True(os.IsNotExist(err))
 	})
 }
 
-func TestCloseErrors(t *testing.T) {
+func TestInMemory(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
-	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
-	defer os.RemoveAll(testdir)
+	wd, err := os.Getwd()
+	require.NoError(err)
+	cwd, err := ioutil.ReadDir(wd)
+	require.NoError(err)
 
-	t.Run("CloseIndexError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	db, err := OpenInMemory(WithMaxDatafileSize(256), WithSyncPolicy(SyncAlways))
+	require.NoError(err)
+	defer db.Close()
 
-		mockIndexer := new(mocks.Indexer)
-		mockIndexer.On("Save", db.trie, filepath.Join(db.path, "temp_index")).Return(ErrMockError)
-		db.indexer = mockIndexer
+	for i := 0; i < 20; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("foo")))
+	}
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+	t.Run("Get", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("foo"), val)
+		}
+		assert.Equal(20, db.Len())
 	})
 
-	t.Run("CloseDatafilesError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
-
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.datafiles[0] = mockDatafile
+	t.Run("Delete", func(t *testing.T) {
+		require.NoError(db.Put([]byte("deleted"), []byte("bar")))
+		require.NoError(db.Delete([]byte("deleted")))
+		_, err := db.Get([]byte("deleted"))
+		assert.Equal(ErrKeyNotFound, err)
+	})
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+	t.Run("Expiry", func(t *testing.T) {
+		require.NoError(db.Put([]byte("expired"), []byte("bar"), WithExpiry(time.Now())))
+		time.Sleep(time.Millisecond)
+		_, err := db.Get([]byte("expired"))
+		assert.Equal(ErrKeyExpired, err)
+		assert.False(db.Has([]byte("expired")))
 	})
 
-	t.Run("CloseActiveDatafileError", func(t *testing.T) {
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	t.Run("Merge", func(t *testing.T) {
+		for i := 0; i < 20; i++ {
+			require.NoError(db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("bar")))
+		}
+		require.NoError(db.Put([]byte("expiring"), []byte("bar"), WithExpiry(time.Now())))
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.curr = mockDatafile
+		before, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(21, before.Keys)
+		assert.True(before.Datafiles > 1)
 
-		err = db.Close()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+		time.Sleep(time.Millisecond)
+		require.NoError(db.Merge())
+
+		after, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(20, after.Keys)
+		assert.True(after.Size < before.Size)
+		assert.Equal(int64(0), db.Reclaimable())
+
+		for i := 0; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key_%d", i)))
+			assert.NoError(err)
+			assert.Equal([]byte("bar"), val)
+		}
 	})
-}
 
-func TestDeleteErrors(t *testing.T) {
-	assert := assert.New(t)
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Reopen())
+		assert.Equal(20, db.Len())
+		val, err := db.Get([]byte("key_1"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
+	})
 
-	t.Run("WriteError", func(t *testing.T) {
+	t.Run("Backup", func(t *testing.T) {
 		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
+		require.NoError(err)
 		defer os.RemoveAll(testdir)
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
-
-		err = db.Put([]byte("foo"), []byte("bar"))
-		assert.NoError(err)
+		require.NoError(db.Backup(testdir))
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Size").Return(int64(0))
-		mockDatafile.On(
-			"Write",
-			internal.Entry{
-				Checksum: 0x0,
-				Key:      []byte("foo"),
-				Offset:   0,
-				Value:    []byte{},
-			},
-		).Return(int64(0), int64(0), ErrMockError)
-		db.curr = mockDatafile
+		backup, err := Open(testdir)
+		require.NoError(err)
+		defer backup.Close()
 
-		err = db.Delete([]byte("foo"))
-		assert.Error(err)
+		assert.Equal(20, backup.Len())
+		val, err := backup.Get([]byte("key_19"))
+		assert.NoError(err)
+		assert.Equal([]byte("bar"), val)
 	})
-}
 
-func TestMergeErrors(t *testing.T) {
-	assert := assert.New(t)
+	t.Run("BackupFileSystem", func(t *testing.T) {
+		// Backups are written to the file system set with WithFileSystem
+		fsys := faultfs.New(1)
+		db, err := OpenInMemory(WithFileSystem(fsys))
+		require.NoError(err)
+		defer db.Close()
+		require.NoError(db.Put([]byte("foo"), []byte("bar")))
+		require.NoError(db.Backup("/backup"))
 
-	t.Run("RemoveDatabaseDirectory", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
+		backup, err := Open("/backup", WithFileSystem(fsys))
+		require.NoError(err)
+		defer backup.Close()
+		val, err := backup.Get([]byte("foo"))
 		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+		assert.Equal([]byte("bar"), val)
+	})
 
-		db, err := Open(testdir, WithMaxDatafileSize(32))
-		assert.NoError(err)
+	t.Run("DeleteAll", func(t *testing.T) {
+		require.NoError(db.DeleteAll())
+		assert.Equal(0, db.Len())
+	})
 
-		assert.NoError(os.RemoveAll(testdir))
+	t.Run("ReadOnly", func(t *testing.T) {
+		_, err := OpenInMemory(WithReadOnly())
+		assert.Equal(ErrReadOnly, err)
+	})
 
-		err = db.Merge()
-		assert.Error(err)
+	t.Run("NoFilesWritten", func(t *testing.T) {
+		after, err := ioutil.ReadDir(wd)
+		require.NoError(err)
+		assert.Equal(len(cwd), len(after))
 	})
+}
 
-	t.Run("EmptyCloseError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+// recordingFileSystem records the paths accessed through the file system
+type recordingFileSystem struct {
+	FileSystem
 
-		db, err := Open(testdir)
-		assert.NoError(err)
+	mu    sync.Mutex
+	paths map[string]bool
+}
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(ErrMockError)
-		db.curr = mockDatafile
+func (fsys *recordingFileSystem) record(name string) {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	if fsys.paths == nil {
+		fsys.paths = make(map[string]bool)
+	}
+	fsys.paths[name] = true
+}
 
-		err = db.Merge()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+func (fsys *recordingFileSystem) recorded() map[string]bool {
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+	paths := make(map[string]bool, len(fsys.paths))
+	for name := range fsys.paths {
+		paths[name] = true
+	}
+	return paths
+}
 
-	t.Run("ReadError", func(t *testing.T) {
-		testdir, err := ioutil.TempDir("", "bitcask")
-		assert.NoError(err)
-		defer os.RemoveAll(testdir)
+func (fsys *recordingFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fsys.record(name)
+	return fsys.FileSystem.OpenFile(name, flag, perm)
+}
 
-		db, err := Open(testdir, WithMaxDatafileSize(22))
-		assert.NoError(err)
+func (fsys *recordingFileSystem) Stat(name string) (os.FileInfo, error) {
+	fsys.record(name)
+	return fsys.FileSystem.Stat(name)
+}
 
-		assert.NoError(db.Put([]byte("foo"), []byte("bar")))
-		assert.NoError(db.Put([]byte("bar"), []byte("baz")))
+func (fsys *recordingFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	fsys.record(name)
+	return fsys.FileSystem.ReadDir(name)
+}
 
-		mockDatafile := new(mocks.Datafile)
-		mockDatafile.On("Close").Return(nil)
-		mockDatafile.On("ReadAt", int64(0), int64(30)).Return(
-			internal.Entry{},
-			ErrMockError,
-		)
-		db.datafiles[0] = mockDatafile
+func (fsys *recordingFileSystem) Mkdir(name string, perm os.FileMode) error {
+	fsys.record(name)
+	return fsys.FileSystem.Mkdir(name, perm)
+}
 
-		err = db.Merge()
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
-	})
+func (fsys *recordingFileSystem) MkdirAll(name string, perm os.FileMode) error {
+	fsys.record(name)
+	return fsys.FileSystem.MkdirAll(name, perm)
+}
 
+func (fsys *recordingFileSystem) Remove(name string) error {
+	fsys.record(name)
+	return fsys.FileSystem.Remove(name)
 }
 
-func TestConcurrent(t *testing.T) {
-	var (
-		db  *Bitcask
-		err error
-	)
+func (fsys *recordingFileSystem) RemoveAll(name string) error {
+	fsys.record(name)
+	return fsys.FileSystem.RemoveAll(name)
+}
+
+func (fsys *recordingFileSystem) Rename(oldname, newname string) error {
+	fsys.record(oldname)
+	fsys.record(newname)
+	return fsys.FileSystem.Rename(oldname, newname)
+}
 
+func TestFileSystem(t *testing.T) {
 	assert := assert.New(t)
+	require := require.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+	require.NoError(err)
+	defer os.RemoveAll(testdir)
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+	fsys := &recordingFileSystem{FileSystem: DefaultFileSystem}
+	opts := []Option{WithFileSystem(fsys), WithMaxDatafileSize(256)}
 
-		t.Run("Put", func(t *testing.T) {
-			err = db.Put([]byte("foo"), []byte("bar"))
+	db, err := Open(testdir, opts...)
+	require.NoError(err)
+
+	for i := 0; i < 20; i++ {
+		require.NoError(db.Put([]byte(fmt.Sprintf("key_%d", i)), []byte("foo")))
+	}
+
+	t.Run("NotLocked", func(t *testing.T) {
+		_, err := os.Stat(filepath.Join(testdir, lockfile))
+		assert.True(os.IsNotExist(err))
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		require.NoError(db.Delete([]byte("key_0")))
+		require.NoError(db.Merge())
+
+		stats, err := db.Stats()
+		require.NoError(err)
+		assert.Equal(19, stats.Keys)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		require.NoError(db.Close())
+
+		db, err = Open(testdir, opts...)
+		require.NoError(err)
+		defer db.Close()
+
+		for i := 1; i < 20; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key_%d", i)))
 			assert.NoError(err)
-		})
+			assert.Equal([]byte("foo"), val)
+		}
 	})
 
-	t.Run("Concurrent", func(t *testing.T) {
-		t.Run("Put", func(t *testing.T) {
-			f := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						key := []byte(fmt.Sprintf("k%d", i))
-						value := []byte(fmt.Sprintf("v%d", i))
-						err := db.Put(key, value)
-						assert.NoError(err)
-					}
-				}
-			}
+	t.Run("Paths", func(t *testing.T) {
+		paths := fsys.recorded()
+		for _, name := range []string{"config.json", "manifest.json", "meta.json", "index", "000000000.data"} {
+			assert.True(paths[filepath.Join(testdir, name)], name)
+		}
+		for name := range paths {
+			assert.True(strings.HasPrefix(name, testdir), name)
+		}
+	})
+}
 
-			wg := &sync.WaitGroup{}
-			wg.Add(3)
+// crashWorkload is a workload run against a database until it fails,
+// recording its operations in the model
+type crashWorkload struct {
+	name    string
+	options []Option
+	setup   func(db *Bitcask, w *crashWriter) error
+	run     func(db *Bitcask, w *crashWriter) error
+}
 
-			go f(wg, 2)
-			go f(wg, 3)
-			go f(wg, 5)
+// crashWriter puts and deletes keys recording them in the model, an
+// operation is acknowledged once it's durable
+type crashWriter struct {
+	fsys  *faultfs.FS
+	model *faultfs.Model
+}
 
-			wg.Wait()
-		})
+func (w *crashWriter) put(db *Bitcask, key, value string) error {
+	op := w.model.Put([]byte(key), []byte(value))
+	if err := db.Put([]byte(key), []byte(value)); err != nil {
+		return err
+	}
+	if w.fsys.Durable() {
+		op.Ack()
+	}
+	return nil
+}
 
-		t.Run("Get", func(t *testing.T) {
-			f := func(wg *sync.WaitGroup, N int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= N; i++ {
-					value, err := db.Get([]byte("foo"))
-					assert.NoError(err)
-					assert.Equal([]byte("bar"), value)
+func (w *crashWriter) delete(db *Bitcask, key string) error {
+	op := w.model.Delete([]byte(key))
+	if err := db.Delete([]byte(key)); err != nil {
+		return err
+	}
+	if w.fsys.Durable() {
+		op.Ack()
+	}
+	return nil
+}
+
+// putKeys puts the keys key0 to keyN-1 with values of the given generation
+func (w *crashWriter) putKeys(db *Bitcask, n, gen int) error {
+	for i := 0; i < n; i++ {
+		if err := w.put(db, fmt.Sprintf("key%d", i), fmt.Sprintf("value%d-%d", i, gen)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkModel checks the keys and values of the database against the model
+func checkModel(db *Bitcask, model *faultfs.Model) error {
+	var keys [][]byte
+	err := db.Fold(func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return model.Check(keys, func(key []byte) ([]byte, bool, error) {
+		value, err := db.Get(key)
+		if err == ErrKeyNotFound {
+			return nil, false, nil
+		}
+		return value, err == nil, err
+	})
+}
+
+func TestCrashConsistency(t *testing.T) {
+	const path = "/db"
+
+	workloads := []crashWorkload{
+		{
+			name: "Put",
+			run: func(db *Bitcask, w *crashWriter) error {
+				return w.putKeys(db, 3, 0)
+			},
+		},
+		{
+			name: "Rotation",
+			setup: func(db *Bitcask, w *crashWriter) error {
+				return w.putKeys(db, 2, 0)
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 8, 1); err != nil {
+					return err
+				}
+				if err := w.delete(db, "key1"); err != nil {
+					return err
+				}
+				return w.delete(db, "key5")
+			},
+		},
+		{
+			name:    "Checkpoint",
+			options: []Option{WithIndexCheckpoint(2)},
+			setup: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 8, 0); err != nil {
+					return err
+				}
+				db.waitCheckpoint()
+				return nil
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 8, 1); err != nil {
+					return err
+				}
+				if err := w.delete(db, "key3"); err != nil {
+					return err
+				}
+				db.waitCheckpoint()
+				return w.put(db, "key4", "value4-2")
+			},
+		},
+		{
+			name: "SaveMetadata",
+			setup: func(db *Bitcask, w *crashWriter) error {
+				return w.putKeys(db, 2, 0)
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 2, 1); err != nil {
+					return err
+				}
+				if err := db.Sync(); err != nil {
+					return err
 				}
-			}
-
-			wg := &sync.WaitGroup{}
-			wg.Add(3)
-			go f(wg, 100)
-			go f(wg, 100)
-			go f(wg, 100)
-
-			wg.Wait()
-		})
-
-		// Test concurrent Put() with concurrent Scan()
-		t.Run("PutScan", func(t *testing.T) {
-			doPut := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						key := []byte(fmt.Sprintf("k%d", i))
-						value := []byte(fmt.Sprintf("v%d", i))
-						err := db.Put(key, value)
-						assert.NoError(err)
+				if err := w.put(db, "key0", "value0-2"); err != nil {
+					return err
+				}
+				return db.Sync()
+			},
+		},
+		{
+			name: "Merge",
+			setup: func(db *Bitcask, w *crashWriter) error {
+				for gen := 0; gen < 3; gen++ {
+					if err := w.putKeys(db, 4, gen); err != nil {
+						return err
 					}
 				}
-			}
-
-			doScan := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						err := db.Scan([]byte("k"), func(key []byte) error {
-							return nil
-						})
-						assert.NoError(err)
+				if err := w.delete(db, "key2"); err != nil {
+					return err
+				}
+				return w.put(db, "key4", "value4-0")
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := db.Merge(); err != nil {
+					return err
+				}
+				return w.putKeys(db, 2, 3)
+			},
+		},
+		{
+			// Chunks span several datafiles merged into fewer ones
+			name:    "MergeChunks",
+			options: []Option{WithMergeChunkSize(1024)},
+			setup: func(db *Bitcask, w *crashWriter) error {
+				for gen := 0; gen < 4; gen++ {
+					if err := w.putKeys(db, 10, gen); err != nil {
+						return err
 					}
 				}
-			}
+				return w.delete(db, "key7")
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := db.Merge(); err != nil {
+					return err
+				}
+				return w.put(db, "key0", "value0-4")
+			},
+		},
+		{
+			name:    "BloomFilter",
+			options: []Option{WithBloomFilter(true)},
+			setup: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 4, 0); err != nil {
+					return err
+				}
+				return w.delete(db, "key1")
+			},
+			run: func(db *Bitcask, w *crashWriter) error {
+				if err := w.putKeys(db, 6, 1); err != nil {
+					return err
+				}
+				if err := db.Merge(); err != nil {
+					return err
+				}
+				if err := w.delete(db, "key2"); err != nil {
+					return err
+				}
+				return w.put(db, "key1", "value1-2")
+			},
+		},
+	}
 
-			wg := &sync.WaitGroup{}
-			wg.Add(6)
+	faults := []faultfs.Fault{faultfs.Crash, faultfs.TornWrite, faultfs.LostSync, faultfs.NoSpace}
 
-			go doPut(wg, 2)
-			go doPut(wg, 3)
-			go doPut(wg, 5)
-			go doScan(wg, 1)
-			go doScan(wg, 2)
-			go doScan(wg, 4)
+	// recoveryOps bounds the op a crash is injected into while recovering
+	const recoveryOps = 8
 
-			wg.Wait()
-		})
+	options := func(wl crashWorkload, fsys *faultfs.FS, recovery bool) []Option {
+		return append([]Option{
+			WithFileSystem(fsys),
+			WithMaxDatafileSize(128),
+			WithMergeChunkSize(2),
+			WithSyncPolicy(SyncAlways),
+			WithAutoRecovery(recovery),
+			WithIndexCheckpoint(0),
+		}, wl.options...)
+	}
 
-		// XXX: This has data races
-		/* Test concurrent Scan() with concurrent Merge()
-		t.Run("ScanMerge", func(t *testing.T) {
-			doScan := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						err := db.Scan([]byte("k"), func(key []byte) error {
-							return nil
-						})
-						assert.NoError(err)
-					}
-				}
+	// prepare opens a database on a new file system and runs the setup of
+	// the workload against it
+	prepare := func(t *testing.T, wl crashWorkload, seed int64) *crashWriter {
+		w := &crashWriter{fsys: faultfs.New(seed), model: faultfs.NewModel()}
+		db, err := Open(path, options(wl, w.fsys, false)...)
+		require.NoError(t, err)
+		if wl.setup != nil {
+			require.NoError(t, wl.setup(db, w))
+		}
+		require.NoError(t, db.Close())
+		return w
+	}
+
+	// execute opens the database and runs the workload, then closes it
+	execute := func(wl crashWorkload, w *crashWriter) (*Bitcask, error) {
+		db, err := Open(path, options(wl, w.fsys, false)...)
+		if err != nil {
+			return nil, err
+		}
+		if err := wl.run(db, w); err != nil {
+			return db, err
+		}
+		return db, db.Close()
+	}
+
+	for _, wl := range workloads {
+		wl := wl
+		t.Run(wl.name, func(t *testing.T) {
+			// A clean run counts the operations to inject faults into
+			w := prepare(t, wl, 0)
+			start := w.fsys.Ops()
+			_, err := execute(wl, w)
+			require.NoError(t, err)
+			total := w.fsys.Ops() - start
+
+			step := 1
+			if testing.Short() {
+				step = total/10 + 1
 			}
 
-			doMerge := func(wg *sync.WaitGroup, x int) {
-				defer func() {
-					wg.Done()
-				}()
-				for i := 0; i <= 100; i++ {
-					if i%x == 0 {
-						err := db.Merge()
-						assert.NoError(err)
+			for _, fault := range faults {
+				for n := 1; n <= total; n += step {
+					w := prepare(t, wl, int64(n))
+					w.fsys.Inject(fault, n)
+
+					db, err := execute(wl, w)
+					if err != nil && db != nil && fault == faultfs.NoSpace {
+						// The database must stay consistent when running out
+						// of space and work again once there is space
+						require.NoError(t, checkModel(db, w.model), "%s at op %d", fault, n)
+						w.fsys.Clear()
+						require.NoError(t, w.put(db, "after", "space"), "%s at op %d", fault, n)
+						require.NoError(t, db.Close(), "%s at op %d", fault, n)
+					} else if err != nil && db != nil {
+						db.Close()
 					}
-				}
-			}
 
-			wg := &sync.WaitGroup{}
-			wg.Add(6)
+					// The recovery may crash too and must be resumed by the next
+					// one, the op it crashes at is varied with the workload's
+					w.fsys = w.fsys.Restart()
+					w.fsys.Inject(faultfs.Crash, n%recoveryOps+1)
+					if db, err := Open(path, options(wl, w.fsys, true)...); err == nil {
+						db.Close()
+					}
+					if w.fsys.Crashed() {
+						w.fsys = w.fsys.Restart()
+					}
+					w.fsys.Clear()
 
-			go doScan(wg, 2)
-			go doScan(wg, 3)
-			go doScan(wg, 5)
-			go doMerge(wg, 1)
-			go doMerge(wg, 2)
-			go doMerge(wg, 4)
+					db, err = Open(path, options(wl, w.fsys, true)...)
+					require.NoError(t, err, "%s at op %d", fault, n)
+					require.NoError(t, checkModel(db, w.model), "%s at op %d", fault, n)
 
-			wg.Wait()
-		})
-		*/
+					// The recovered database must be fully usable
+					require.NoError(t, w.put(db, "new", "value"), "%s at op %d", fault, n)
+					require.NoError(t, db.Merge(), "%s at op %d", fault, n)
+					require.NoError(t, db.Close(), "%s at op %d", fault, n)
 
-		t.Run("Close", func(t *testing.T) {
-			err = db.Close()
-			assert.NoError(err)
+					db, err = Open(path, options(wl, w.fsys, false)...)
+					require.NoError(t, err, "%s at op %d", fault, n)
+					require.NoError(t, checkModel(db, w.model), "%s at op %d", fault, n)
+					require.NoError(t, db.Close(), "%s at op %d", fault, n)
+				}
+			}
 		})
-	})
+	}
 }
 
-func TestScan(t *testing.T) {
+func TestLocking(t *testing.T) {
 	assert := assert.New(t)
 
 	testdir, err := ioutil.TempDir("", "bitcask")
 	assert.NoError(err)
 
-	var db *Bitcask
+	db, err := Open(testdir)
+	assert.NoError(err)
+	defer db.Close()
 
-	t.Run("Setup", func(t *testing.T) {
-		t.Run("Open", func(t *testing.T) {
-			db, err = Open(testdir)
-			assert.NoError(err)
-		})
+	_, err = Open(testdir)
+	assert.Error(err)
+}
 
-		t.Run("Put", func(t *testing.T) {
-			var items = map[string][]byte{
-				"1":     []byte("1"),
-				"2":     []byte("2"),
-				"3":     []byte("3"),
-				"food":  []byte("pizza"),
-				"foo":   []byte([]byte("foo")),
-				"fooz":  []byte("fooz ball"),
-				"hello": []byte("world"),
-			}
-			for k, v := range items {
-				err = db.Put([]byte(k), v)
-				assert.NoError(err)
-			}
-		})
-	})
+func TestLockTimeout(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "bitcask")
+	require.NoError(t, err)
+	defer os.RemoveAll(testdir)
 
-	t.Run("Scan", func(t *testing.T) {
-		var (
-			vals     [][]byte
-			expected = [][]byte{
-				[]byte("foo"),
-				[]byte("fooz ball"),
-				[]byte("pizza"),
-			}
-		)
+	db, err := Open(testdir)
+	require.NoError(t, err)
 
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			val, err := db.Get(key)
-			assert.NoError(err)
-			vals = append(vals, val)
-			return nil
-		})
-		vals = SortByteArrays(vals)
-		assert.Equal(expected, vals)
+	t.Run("NoTimeout", func(t *testing.T) {
+		_, err := Open(testdir)
+		assert.Equal(t, ErrDatabaseLocked, err)
 	})
 
-	t.Run("ScanErrors", func(t *testing.T) {
-		err = db.Scan([]byte("fo"), func(key []byte) error {
-			return ErrMockError
-		})
-		assert.Error(err)
-		assert.Equal(ErrMockError, err)
+	t.Run("Expired", func(t *testing.T) {
+		start := time.Now()
+		_, err := Open(testdir, WithLockTimeout(50*time.Millisecond))
+		assert.Equal(t, ErrDatabaseLocked, err)
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
 	})
-}
 
-func TestLocking(t *testing.T) {
-	assert := assert.New(t)
+	t.Run("Released", func(t *testing.T) {
+		go func() {
+			<-time.After(50 * time.Millisecond)
+			db.Close()
+		}()
 
+		db2, err := Open(testdir, WithLockTimeout(5*time.Second))
+		require.NoError(t, err)
+		assert.NoError(t, db2.Close())
+	})
+}
+
+func TestLockOwner(t *testing.T) {
 	testdir, err := ioutil.TempDir("", "bitcask")
-	assert.NoError(err)
+	require.NoError(t, err)
+	defer os.RemoveAll(testdir)
 
 	db, err := Open(testdir)
-	assert.NoError(err)
-	defer db.Close()
+	require.NoError(t, err)
 
-	_, err = Open(testdir)
-	assert.Error(err)
+	owner, err := LockOwner(testdir)
+	require.NoError(t, err)
+	assert.Equal(t, os.Getpid(), owner.PID)
+	assert.Equal(t, internal.FullVersion(), owner.Version)
+	assert.False(t, owner.Stale())
+
+	require.NoError(t, db.Close())
+
+	_, err = LockOwner(testdir)
+	assert.True(t, os.IsNotExist(err))
 }
 
 func TestLockingAfterMerge(t *testing.T) {
@@ -1784,6 +4567,91 @@ func BenchmarkPut(b *testing.B) {
 	}
 }
 
+func BenchmarkPutConcurrent(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	variants := map[string][]Option{
+		"Sync": {
+			WithSync(true),
+		},
+		"GroupCommit": {
+			WithSync(true),
+			WithGroupCommit(500*time.Microsecond, 1<<20),
+		},
+	}
+
+	for name, options := range variants {
+		testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer os.RemoveAll(testdir)
+
+		db, err := Open(testdir, options...)
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(128)
+			b.SetParallelism(32)
+
+			value := []byte(strings.Repeat(" ", 128))
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				key := []byte("foo")
+				for pb.Next() {
+					if err := db.Put(key, value); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGetConcurrent(b *testing.B) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	testdir, err := ioutil.TempDir(currentDir, "bitcask_bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(testdir)
+
+	db, err := Open(testdir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+
+	const keys = 1024
+	value := []byte(strings.Repeat(" ", 128))
+	for i := 0; i < keys; i++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", i)), value); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.SetBytes(128)
+	b.SetParallelism(32)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := db.Get([]byte(fmt.Sprintf("key%d", i%keys))); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
 func BenchmarkScan(b *testing.B) {
 	currentDir, err := os.Getwd()
 	if err != nil {
@@ -0,0 +1,188 @@
+package bitcask
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// valueCacheOverhead is the estimated size of the bookkeeping of an entry of
+// the value cache, counted towards its capacity with its key and value
+const valueCacheOverhead = 160
+
+// valueCache is a least recently used cache of the entries read by Get,
+// bounded by the size of their keys and values. Every entry is tagged with
+// the keydir item it was read from and is only returned while the key still
+// lives there, so entries of keys written since are never returned. A nil
+// cache is disabled.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	ll       *list.List
+	entries  map[string]*list.Element
+	hits     uint64
+	misses   uint64
+
+	// epoch is incremented whenever the locations of the keys may be reused
+	// for other entries, entries read before then aren't added
+	epoch uint64
+}
+
+type cachedEntry struct {
+	key   string
+	item  internal.Item
+	entry internal.Entry
+}
+
+func newValueCache(capacity int) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{
+		capacity: int64(capacity),
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached entry of key read from item, with copies of its key
+// and value
+func (c *valueCache) get(key []byte, item internal.Item) (internal.Entry, bool) {
+	if c == nil {
+		return internal.Entry{}, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[string(key)]
+	if !found || el.Value.(*cachedEntry).item != item {
+		c.misses++
+		return internal.Entry{}, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	ce := el.Value.(*cachedEntry)
+	e := ce.entry
+	e.Key = []byte(ce.key)
+	e.Value = append([]byte(nil), e.Value...)
+	return e, true
+}
+
+// currentEpoch returns the epoch to add the entries read from the items
+// looked up afterwards with
+func (c *valueCache) currentEpoch() uint64 {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.epoch
+}
+
+// add caches a copy of the entry of key read from item, unless the epoch
+// changed since the item was looked up, evicting the least recently used
+// entries to make room for it
+func (c *valueCache) add(key []byte, item internal.Item, e internal.Entry, epoch uint64) {
+	if c == nil {
+		return
+	}
+	size := int64(len(key)+len(e.Value)) + valueCacheOverhead
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if epoch != c.epoch {
+		return
+	}
+	c.removeLocked(key)
+	for c.size+size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+	// The key is kept once, as the key of the entry
+	e.Key = nil
+	e.Value = append([]byte(nil), e.Value...)
+	c.entries[string(key)] = c.ll.PushFront(&cachedEntry{key: string(key), item: item, entry: e})
+	c.size += size
+}
+
+// remove drops the entry of key
+func (c *valueCache) remove(key []byte) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+// move retags the entry of key read from the item from, which was moved to
+// the item to by a merge. Entries of the key read from elsewhere are dropped.
+func (c *valueCache) move(key []byte, from, to internal.Item) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, found := c.entries[string(key)]
+	if !found {
+		return
+	}
+	if ce := el.Value.(*cachedEntry); ce.item == from {
+		ce.item = to
+		return
+	}
+	c.removeElement(el)
+}
+
+// invalidate starts a new epoch, as the locations of the keys may be reused
+// for other entries from now on. With clear the cached entries are dropped
+// too.
+func (c *valueCache) invalidate(clear bool) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.epoch++
+	if clear {
+		c.ll.Init()
+		c.entries = make(map[string]*list.Element)
+		c.size = 0
+	}
+}
+
+// stats returns the number of hits and misses of the cache
+func (c *valueCache) stats() (uint64, uint64) {
+	if c == nil {
+		return 0, 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *valueCache) removeLocked(key []byte) {
+	if el, found := c.entries[string(key)]; found {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	ce := el.Value.(*cachedEntry)
+	c.ll.Remove(el)
+	delete(c.entries, ce.key)
+	c.size -= int64(len(ce.key)+len(ce.entry.Value)) + valueCacheOverhead
+}
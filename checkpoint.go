@@ -0,0 +1,168 @@
+package bitcask
+
+import (
+	"io"
+	"path/filepath"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/index"
+)
+
+// checkpointIndexFile is the temporary file a checkpoint of the index is
+// written to before it replaces the index
+const checkpointIndexFile = "checkpoint_index"
+
+// checkpointIndex starts writing a checkpoint of the index in the background
+// once the saved index is behind by IndexCheckpoint sealed datafiles. The
+// entries of the sealed datafiles are applied to the saved index, so neither
+// the write lock nor the keydir are held while writing it. It must be called
+// with the write lock held.
+func (b *Bitcask) checkpointIndex() {
+	if b.config.IndexCheckpoint <= 0 || b.isMerging || b.checkpoint != nil {
+		return
+	}
+
+	// Without a valid index all the sealed datafiles are applied to an
+	// empty one
+	src := filepath.Join(b.path, "index")
+	from := b.manifest.IndexDatafile
+	if b.manifest.IndexGeneration == 0 || !internal.Exists(b.fs, src) {
+		src, from = "", -1
+	}
+	generation := b.manifest.IndexGeneration
+	to := b.manifest.Active
+
+	var ids []int
+	for _, id := range b.manifest.Datafiles {
+		if id >= from && id < to {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) < b.config.IndexCheckpoint {
+		return
+	}
+
+	done := make(chan struct{})
+	b.checkpoint = done
+	go func() {
+		defer close(done)
+
+		err := b.writeCheckpoint(src, ids)
+
+		b.mu.Lock()
+		if err == nil {
+			err = b.commitCheckpoint(generation, to)
+		}
+		b.checkpoint = nil
+		b.mu.Unlock()
+
+		if err != nil {
+			b.fs.Remove(filepath.Join(b.path, checkpointIndexFile))
+			log.WithError(err).Warn("error writing a checkpoint of the index")
+		}
+	}()
+}
+
+// waitCheckpoint waits for the checkpoint of the index being written, if
+// any. It must be called without the write lock held.
+func (b *Bitcask) waitCheckpoint() {
+	b.mu.Lock()
+	done := b.checkpoint
+	b.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// writeCheckpoint writes the index saved at src with the entries of the
+// sealed datafiles applied to the checkpoint file
+func (b *Bitcask) writeCheckpoint(src string, ids []int) error {
+	delta := art.New()
+	for _, id := range ids {
+		if err := b.replayDatafile(delta, id); err != nil {
+			return err
+		}
+	}
+
+	dst := filepath.Join(b.path, checkpointIndexFile)
+	if u, ok := b.indexer.(index.Updater); ok {
+		return u.Update(b.fs, src, dst, b.config.MaxKeySize, delta)
+	}
+
+	// Other indexers have the saved index loaded to apply the delta
+	var (
+		t   index.Keydir
+		err error
+	)
+	if src != "" {
+		t, _, err = b.indexer.Load(b.fs, src, b.config.MaxKeySize)
+	} else {
+		t, err = b.indexer.New()
+	}
+	if err != nil {
+		return err
+	}
+	defer index.Close(t)
+	delta.ForEach(func(node art.Node) bool {
+		if node.Value() == nil {
+			err = t.Delete(node.Key())
+		} else {
+			err = t.Put(node.Key(), node.Value().(internal.Item))
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.indexer.Save(b.fs, t, dst)
+}
+
+// replayDatafile records the entries of the sealed datafile with the given
+// id in delta, tombstones as nil values. The datafile is opened anew so that
+// reads of the database aren't affected.
+func (b *Bitcask) replayDatafile(delta art.Tree, id int) error {
+	df, err := b.openDatafile(id, true)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	var offset int64
+	for {
+		e, n, err := df.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(e.Value) == 0 {
+			delta.Insert(e.Key, nil)
+		} else {
+			delta.Insert(e.Key, internal.Item{FileID: id, Offset: offset, Size: n})
+		}
+		offset += n
+	}
+}
+
+// commitCheckpoint replaces the index with the checkpoint, unless the index
+// was saved meanwhile. Replaying the datafiles from the one the index was
+// saved at is idempotent, so until the manifest records the datafile the
+// checkpoint was written at, either index is valid.
+func (b *Bitcask) commitCheckpoint(generation uint64, to int) error {
+	checkpoint := filepath.Join(b.path, checkpointIndexFile)
+	if b.manifest.IndexGeneration != generation {
+		return b.fs.Remove(checkpoint)
+	}
+
+	if err := b.fs.Rename(checkpoint, filepath.Join(b.path, "index")); err != nil {
+		return err
+	}
+
+	b.manifest.IndexGeneration++
+	b.manifest.IndexDatafile = to
+	return b.saveManifest()
+}
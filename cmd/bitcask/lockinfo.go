@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var lockInfoCmd = &cobra.Command{
+	Use:     "lock-info",
+	Aliases: []string{"lockinfo"},
+	Short:   "Display the owner of the lock on the Database",
+	Long: `This displays the process holding the lock on the Database, as
+recorded in the lock file by that process: its PID, hostname, start time and
+version. A lock file left behind by a process that was killed is reported as
+stale and does not prevent opening the Database.`,
+	Args: cobra.ExactArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+
+		os.Exit(lockInfo(path))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lockInfoCmd)
+}
+
+func lockInfo(path string) int {
+	owner, err := bitcask.LockOwner(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("database is not locked")
+			return 0
+		}
+		log.WithError(err).Error("error reading lock owner")
+		return 1
+	}
+
+	info := struct {
+		PID      int    `json:"pid"`
+		Hostname string `json:"hostname"`
+		Started  string `json:"started"`
+		Version  string `json:"version"`
+		Stale    bool   `json:"stale"`
+	}{
+		PID:      owner.PID,
+		Hostname: owner.Hostname,
+		Started:  owner.Started.Format(time.RFC3339),
+		Version:  owner.Version,
+		Stale:    owner.Stale(),
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("error marshalling lock owner")
+		return 1
+	}
+
+	fmt.Println(string(data))
+
+	return 0
+}
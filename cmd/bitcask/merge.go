@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"os"
+	"os/signal"
+	"syscall"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -16,27 +19,70 @@ var mergeCmd = &cobra.Command{
 	Short:   "Merges the Datafiles in the Database",
 	Long: `This merges all non-active Datafiles in the Database and
 compacts the data stored on disk. Old values are removed as well as deleted
-keys.`,
+keys.
+
+The merge can be throttled with --rate-limit to limit its impact on live
+traffic, and interrupted at any time in which case the Datafiles merged so
+far are kept.`,
 	Args: cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("rate-limit", cmd.Flags().Lookup("rate-limit"))
+		viper.BindPFlag("progress", cmd.Flags().Lookup("progress"))
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		path := viper.GetString("path")
+		rateLimit := viper.GetInt64("rate-limit")
+		progress := viper.GetBool("progress")
 
-		os.Exit(merge(path))
+		os.Exit(merge(path, rateLimit, progress))
 	},
 }
 
 func init() {
 	RootCmd.AddCommand(mergeCmd)
+	mergeCmd.Flags().Int64P("rate-limit", "r", 0, "Maximum bytes per second read by the merge (0 for no limit)")
+	mergeCmd.Flags().BoolP("progress", "", false, "Display the progress of the merge")
 }
 
-func merge(path string) int {
+func merge(path string, rateLimit int64, progress bool) int {
 	db, err := bitcask.Open(path)
 	if err != nil {
 		log.WithError(err).Error("error opening database")
 		return 1
 	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			log.Info("interrupting merge")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	opts := bitcask.MergeOptions{
+		Context:   ctx,
+		RateLimit: rateLimit,
+	}
+	if progress {
+		opts.Progress = func(p bitcask.MergeProgress) {
+			log.WithFields(log.Fields{
+				"files": p.Files,
+				"total": p.TotalFiles,
+				"bytes": p.Bytes,
+				"keys":  p.Keys,
+			}).Info("merge progress")
+		}
+	}
 
-	if err = db.Merge(); err != nil {
+	if err = db.MergeWithOptions(opts); err != nil {
 		log.WithError(err).Error("error merging database")
 		return 1
 	}
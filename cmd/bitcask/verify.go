@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/prologic/bitcask"
+)
+
+var verifyCmd = &cobra.Command{
+	Use:     "verify",
+	Aliases: []string{"fsck"},
+	Short:   "Verifies the integrity of the Database",
+	Long: `This verifies the integrity of the Database without changing it. Every
+live entry is re-read and checksummed, the index is cross-checked against the
+datafiles and the reclaimable space is checked for plausibility. A report of
+the problems found is printed as JSON.
+
+The exit status is 0 if no problems were found, 2 if any were and 1 on error.`,
+	Args: cobra.ExactArgs(0),
+	PreRun: func(cmd *cobra.Command, args []string) {
+		viper.BindPFlag("skip-scan", cmd.Flags().Lookup("skip-scan"))
+		viper.BindPFlag("max-problems", cmd.Flags().Lookup("max-problems"))
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		path := viper.GetString("path")
+		opts := bitcask.VerifyOptions{
+			SkipScan:    viper.GetBool("skip-scan"),
+			MaxProblems: viper.GetInt("max-problems"),
+		}
+
+		os.Exit(verify(path, opts))
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().Bool("skip-scan", false, "Only checks the live entries without scanning the datafiles")
+	verifyCmd.Flags().Int("max-problems", 0, "Stops after this many problems (0 for no limit)")
+}
+
+func verify(path string, opts bitcask.VerifyOptions) int {
+	db, err := bitcask.Open(path, bitcask.WithReadOnly())
+	if err != nil {
+		log.WithError(err).Error("error opening database")
+		return 1
+	}
+	defer db.Close()
+
+	report, err := db.Verify(context.Background(), opts)
+	if err != nil {
+		log.WithError(err).Error("error verifying database")
+		return 1
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.WithError(err).Error("error marshalling verify report")
+		return 1
+	}
+
+	fmt.Println(string(data))
+
+	if !report.OK() {
+		return 2
+	}
+	return 0
+}
@@ -24,6 +24,9 @@ func newServer(bind, dbpath string) (*server, error) {
 	db, err := bitcask.Open(dbpath)
 	if err != nil {
 		log.WithError(err).WithField("dbpath", dbpath).Error("error opening database")
+		if err == bitcask.ErrDatabaseLocked {
+			logLockOwner(dbpath)
+		}
 		return nil, err
 	}
 
@@ -33,6 +36,25 @@ func newServer(bind, dbpath string) (*server, error) {
 	}, nil
 }
 
+// logLockOwner logs the process holding the lock on the database so that
+// it can be tracked down
+func logLockOwner(dbpath string) {
+	owner, err := bitcask.LockOwner(dbpath)
+	if err != nil {
+		log.WithError(err).WithField("dbpath", dbpath).Warn("error reading lock owner")
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"dbpath":   dbpath,
+		"pid":      owner.PID,
+		"hostname": owner.Hostname,
+		"started":  owner.Started,
+		"version":  owner.Version,
+		"stale":    owner.Stale(),
+	}).Error("database locked by another process")
+}
+
 func (s *server) handleSet(cmd redcon.Command, conn redcon.Conn) {
 	if len(cmd.Args) != 3 && len(cmd.Args) != 4 {
 		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
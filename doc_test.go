@@ -11,3 +11,10 @@ func Example_withOptions() {
 	}
 	_, _ = Open("path/to/db", opts...)
 }
+
+func Example_inMemory() {
+	db, _ := OpenInMemory()
+	defer db.Close()
+
+	_ = db.Put([]byte("hello"), []byte("world"))
+}
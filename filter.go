@@ -0,0 +1,73 @@
+package bitcask
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/bitcask/internal/index"
+)
+
+// filterFile is the file the Bloom filter of the keys is saved to along with
+// the index
+const filterFile = "filter"
+
+// loadFilter returns the Bloom filter of the keys of t, nil unless enabled.
+// The filter saved with the index is only used if no datafiles were replayed
+// into t since, otherwise it's built from t.
+func (b *Bitcask) loadFilter(t index.Keydir, replayed bool) (*index.Filter, error) {
+	if !b.config.BloomFilter {
+		return nil, nil
+	}
+	if !replayed {
+		f, generation, keys, err := index.LoadFilter(b.fs, filepath.Join(b.path, filterFile))
+		switch {
+		case err == nil && generation == b.manifest.IndexGeneration && keys == t.Len():
+			return f, nil
+		case err != nil && !os.IsNotExist(err):
+			log.WithError(err).Warn("error loading the Bloom filter, rebuilding it")
+		}
+	}
+	return index.BuildFilter(t)
+}
+
+// mayHave returns false if the key is definitely not in the keydir. It must
+// be called with keydirMu held.
+func (b *Bitcask) mayHave(key []byte) bool {
+	return b.filter == nil || b.filter.Has(key)
+}
+
+// rebuildFilter rebuilds the filter from the keydir, dropping the deleted
+// keys. It must be called with the write lock held.
+func (b *Bitcask) rebuildFilter() error {
+	if b.filter == nil {
+		return nil
+	}
+	f, err := index.BuildFilter(b.keydir)
+	if err != nil {
+		return err
+	}
+	b.keydirMu.Lock()
+	b.filter = f
+	b.keydirMu.Unlock()
+	return nil
+}
+
+// saveFilter saves the filter for the index of the given generation, or
+// removes the saved one if the filter is disabled
+func (b *Bitcask) saveFilter(generation uint64) error {
+	path := filepath.Join(b.path, filterFile)
+	if b.filter == nil {
+		if err := b.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	temp := filepath.Join(b.path, "temp_filter")
+	if err := index.SaveFilter(b.fs, b.filter, generation, b.keydir.Len(), temp); err != nil {
+		return err
+	}
+	return b.fs.Rename(temp, path)
+}
@@ -1,15 +1,38 @@
 package flock
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"os"
 	"sync"
+	"time"
 )
 
 type Flock struct {
-	path string
-	m    sync.Mutex
-	fh   *os.File
+	path    string
+	m       sync.Mutex
+	fh      *os.File
+	shared  bool
+	version string
+}
+
+// Owner describes the process holding an exclusive lock, as recorded in the lock file by that process when it took the lock.
+type Owner struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+	Version  string    `json:"version,omitempty"`
+}
+
+// Stale returns true if the owner is known to have exited without releasing the lock, which is only possible to tell for processes running on this host. The lock file of a stale owner can be left behind by a killed process and does not prevent taking the lock.
+func (o Owner) Stale() bool {
+	hostname, err := os.Hostname()
+	if err != nil || hostname != o.Hostname {
+		return false
+	}
+	return !processExists(o.PID)
 }
 
 var (
@@ -18,14 +41,32 @@ var (
 	ErrLockNotHeld   = errors.New("Could not unlock, lock is not held")
 
 	ErrInodeChangedAtPath = errors.New("Inode changed at path")
+	ErrOwnerUnknown       = errors.New("Could not determine the owner of the lock")
+)
+
+const (
+	// minRetryDelay and maxRetryDelay bound the delay between attempts to
+	// take the lock in LockContext()
+	minRetryDelay = time.Millisecond
+	maxRetryDelay = 100 * time.Millisecond
 )
 
+// started is the time the current process started, recorded as part of the owner of the locks it takes
+var started = time.Now()
+
 // New returns a new instance of *Flock. The only parameter
 // it takes is the path to the desired lockfile.
 func New(path string) *Flock {
 	return &Flock{path: path}
 }
 
+// SetVersion sets the version of the program taking the lock, recorded as part of its owner, see ReadOwner().
+func (f *Flock) SetVersion(version string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.version = version
+}
+
 // Path returns the file path linked to this lock.
 func (f *Flock) Path() string {
 	return f.path
@@ -33,6 +74,15 @@ func (f *Flock) Path() string {
 
 // Lock will acquire the lock. This function may block indefinitely if some other process holds the lock. For a non-blocking version, see Flock.TryLock().
 func (f *Flock) Lock() error {
+	return f.lock(false)
+}
+
+// RLock will acquire a shared lock, which can be held by several processes at once but not together with an exclusive lock. This function may block indefinitely if some other process holds the exclusive lock. For a non-blocking version, see Flock.TryRLock().
+func (f *Flock) RLock() error {
+	return f.lock(true)
+}
+
+func (f *Flock) lock(shared bool) error {
 	f.m.Lock()
 	defer f.m.Unlock()
 
@@ -42,10 +92,10 @@ func (f *Flock) Lock() error {
 
 	var fh *os.File
 
-	fh, err := lock_sys(f.path, false)
+	fh, err := lock_sys(f.path, shared, false)
 	// treat "ErrInodeChangedAtPath" as "some other process holds the lock, retry locking"
 	for err == ErrInodeChangedAtPath {
-		fh, err = lock_sys(f.path, false)
+		fh, err = lock_sys(f.path, shared, false)
 	}
 
 	if err != nil {
@@ -55,12 +105,20 @@ func (f *Flock) Lock() error {
 		return ErrLockFailed
 	}
 
-	f.fh = fh
-	return nil
+	return f.acquired(fh, shared)
 }
 
-// TryLock will try to acquire the lock, and returns immediately if the lock is already owned by another process.
+// TryLock will try to acquire the lock, and returns immediately if the lock is already owned by another process, in which case ErrLockFailed is returned.
 func (f *Flock) TryLock() (bool, error) {
+	return f.tryLock(false)
+}
+
+// TryRLock will try to acquire a shared lock, and returns immediately if the exclusive lock is owned by another process.
+func (f *Flock) TryRLock() (bool, error) {
+	return f.tryLock(true)
+}
+
+func (f *Flock) tryLock(shared bool) (bool, error) {
 	f.m.Lock()
 	defer f.m.Unlock()
 
@@ -68,15 +126,103 @@ func (f *Flock) TryLock() (bool, error) {
 		return false, ErrAlreadyLocked
 	}
 
-	fh, err := lock_sys(f.path, true)
+	fh, err := lock_sys(f.path, shared, true)
 	if err != nil {
-		return false, ErrLockFailed
+		// Only report the lock as held by another process if it is, other
+		// errors such as the lock file not being accessible are returned
+		if contended(err) {
+			return false, ErrLockFailed
+		}
+		return false, err
 	}
 
-	f.fh = fh
+	if err := f.acquired(fh, shared); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
+// LockContext will acquire the lock, retrying until the lock is released by the process owning it or ctx is done, in which case the error of ctx is returned. Errors other than the lock being held by another process are returned without retrying.
+func (f *Flock) LockContext(ctx context.Context) error {
+	delay := minRetryDelay
+	for {
+		locked, err := f.TryLock()
+		if locked {
+			return nil
+		}
+		if err != ErrLockFailed {
+			return err
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// acquired records the lock held through fh. The owner of an exclusive lock is written to the lock file, see ReadOwner().
+func (f *Flock) acquired(fh *os.File, shared bool) error {
+	if !shared {
+		if err := f.writeOwner(fh); err != nil {
+			fh.Close()
+			return err
+		}
+	}
+
+	f.fh = fh
+	f.shared = shared
+	return nil
+}
+
+func (f *Flock) writeOwner(fh *os.File) error {
+	hostname, _ := os.Hostname()
+	data, err := json.Marshal(Owner{
+		PID:      os.Getpid(),
+		Hostname: hostname,
+		Started:  started,
+		Version:  f.version,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := fh.Truncate(0); err != nil {
+		return err
+	}
+	_, err = fh.WriteAt(append(data, '\n'), 0)
+	return err
+}
+
+// ReadOwner returns the owner of the exclusive lock on the lock file at path. The lock file may have been left behind by a process that exited, see Owner.Stale(). ErrOwnerUnknown is returned if the lock file records no owner.
+func ReadOwner(path string) (Owner, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Owner{}, err
+	}
+
+	var owner Owner
+	if err := json.Unmarshal(data, &owner); err != nil || owner.PID <= 0 {
+		return Owner{}, ErrOwnerUnknown
+	}
+	return owner, nil
+}
+
+// PID returns the PID of the process holding the exclusive lock on the lock file at path, see ReadOwner().
+func PID(path string) (int, error) {
+	owner, err := ReadOwner(path)
+	if err != nil {
+		return 0, err
+	}
+	return owner.PID, nil
+}
+
 // Unlock removes the lock file from disk and releases the lock.
 // Whatever the result of `.Unlock()`, the caller must assume that it does not hold the lock anymore.
 func (f *Flock) Unlock() error {
@@ -86,9 +232,16 @@ func (f *Flock) Unlock() error {
 	if f.fh == nil {
 		return ErrLockNotHeld
 	}
-
-	err1 := rm_if_match(f.fh, f.path)
-	err2 := f.fh.Close()
+	fh := f.fh
+	f.fh = nil
+
+	// Other processes may still hold a shared lock on the lock file, which
+	// must not be removed underneath them
+	var err1 error
+	if !f.shared || try_upgrade(fh) {
+		err1 = rm_if_match(fh, f.path)
+	}
+	err2 := fh.Close()
 
 	if err1 != nil {
 		return err1
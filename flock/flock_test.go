@@ -1,7 +1,10 @@
 package flock
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -119,3 +122,189 @@ func TestErrorConditions(t *testing.T) {
 	// -- teardown
 	lock.Unlock()
 }
+
+func TestRLock(t *testing.T) {
+	assert := assert.New(t)
+
+	// make sure there is no present lock when starting this test
+	os.Remove(testLockPath)
+
+	reader1 := New(testLockPath)
+	reader2 := New(testLockPath)
+	writer := New(testLockPath)
+
+	// 1- several shared locks can be held at once
+	locked, err := reader1.TryRLock()
+	assert.True(locked)
+	assert.NoError(err)
+
+	err = reader2.RLock()
+	assert.NoError(err)
+
+	// 2- but not together with the exclusive lock
+	locked, err = writer.TryLock()
+	assert.False(locked)
+	assert.Error(err)
+
+	// 3- the lock file stays while a shared lock is held
+	err = reader1.Unlock()
+	assert.NoError(err)
+	_, err = os.Stat(testLockPath)
+	assert.NoError(err)
+
+	locked, err = writer.TryLock()
+	assert.False(locked)
+	assert.Error(err)
+
+	// 4- the last shared lock released removes the lock file
+	err = reader2.Unlock()
+	assert.NoError(err)
+	_, err = os.Stat(testLockPath)
+	assert.True(os.IsNotExist(err))
+
+	locked, err = writer.TryLock()
+	assert.True(locked)
+	assert.NoError(err)
+
+	locked, err = reader1.TryRLock()
+	assert.False(locked)
+	assert.Error(err)
+
+	err = writer.Unlock()
+	assert.NoError(err)
+}
+
+func TestLockContext(t *testing.T) {
+	assert := assert.New(t)
+
+	// make sure there is no present lock when starting this test
+	os.Remove(testLockPath)
+
+	lock1 := New(testLockPath)
+	lock2 := New(testLockPath)
+
+	err := lock1.Lock()
+	assert.NoError(err)
+
+	// 1- the lock is not released before the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = lock2.LockContext(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// 2- the lock is released before the deadline
+	go func() {
+		<-time.After(50 * time.Millisecond)
+		lock1.Unlock()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = lock2.LockContext(ctx)
+	assert.NoError(err)
+
+	err = lock2.Unlock()
+	assert.NoError(err)
+
+	// 3- errors other than the lock being held are returned without retrying
+	dir, err := ioutil.TempDir("", "flock")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+
+	lock3 := New(filepath.Join(dir, "missing", "lock"))
+	locked, err := lock3.TryLock()
+	assert.False(locked)
+	assert.True(os.IsNotExist(err))
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	err = lock3.LockContext(ctx)
+	assert.True(os.IsNotExist(err))
+	assert.True(time.Since(start) < time.Second)
+}
+
+func TestPID(t *testing.T) {
+	assert := assert.New(t)
+
+	// make sure there is no present lock when starting this test
+	os.Remove(testLockPath)
+
+	lock := New(testLockPath)
+	err := lock.Lock()
+	assert.NoError(err)
+
+	pid, err := PID(testLockPath)
+	assert.NoError(err)
+	assert.Equal(os.Getpid(), pid)
+
+	err = lock.Unlock()
+	assert.NoError(err)
+
+	// shared locks don't record an owner
+	err = lock.RLock()
+	assert.NoError(err)
+
+	_, err = PID(testLockPath)
+	assert.Equal(ErrOwnerUnknown, err)
+
+	err = lock.Unlock()
+	assert.NoError(err)
+}
+
+func TestReadOwner(t *testing.T) {
+	assert := assert.New(t)
+
+	// make sure there is no present lock when starting this test
+	os.Remove(testLockPath)
+
+	lock := New(testLockPath)
+	lock.SetVersion("1.2.3")
+	err := lock.Lock()
+	assert.NoError(err)
+
+	hostname, err := os.Hostname()
+	assert.NoError(err)
+
+	owner, err := ReadOwner(testLockPath)
+	assert.NoError(err)
+	assert.Equal(os.Getpid(), owner.PID)
+	assert.Equal(hostname, owner.Hostname)
+	assert.Equal("1.2.3", owner.Version)
+	assert.False(owner.Started.IsZero())
+	assert.False(owner.Stale())
+
+	err = lock.Unlock()
+	assert.NoError(err)
+
+	// a lock file left behind by a process that was killed
+	err = ioutil.WriteFile(testLockPath, []byte(`{"pid":4194305,"hostname":"`+hostname+`"}`), 0666)
+	assert.NoError(err)
+	defer os.Remove(testLockPath)
+
+	owner, err = ReadOwner(testLockPath)
+	assert.NoError(err)
+	assert.True(owner.Stale())
+
+	owner.Hostname = hostname + ".elsewhere"
+	assert.False(owner.Stale())
+
+	// the lock file doesn't prevent taking the lock
+	locked, err := lock.TryLock()
+	assert.True(locked)
+	assert.NoError(err)
+
+	owner, err = ReadOwner(testLockPath)
+	assert.NoError(err)
+	assert.Equal(os.Getpid(), owner.PID)
+
+	err = lock.Unlock()
+	assert.NoError(err)
+
+	// garbage in the lock file
+	err = ioutil.WriteFile(testLockPath, []byte("garbage"), 0666)
+	assert.NoError(err)
+
+	_, err = ReadOwner(testLockPath)
+	assert.Equal(ErrOwnerUnknown, err)
+}
@@ -8,7 +8,7 @@ import (
 	"golang.org/x/sys/unix"
 )
 
-func lock_sys(path string, nonBlocking bool) (_ *os.File, err error) {
+func lock_sys(path string, shared, nonBlocking bool) (_ *os.File, err error) {
 	var fh *os.File
 
 	fh, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
@@ -23,6 +23,9 @@ func lock_sys(path string, nonBlocking bool) (_ *os.File, err error) {
 	}()
 
 	flag := unix.LOCK_EX
+	if shared {
+		flag = unix.LOCK_SH
+	}
 	if nonBlocking {
 		flag |= unix.LOCK_NB
 	}
@@ -39,6 +42,26 @@ func lock_sys(path string, nonBlocking bool) (_ *os.File, err error) {
 	return fh, nil
 }
 
+// contended returns true if err, as returned by lock_sys, means that another
+// process holds the lock or replaced the lock file
+func contended(err error) bool {
+	return err == unix.EWOULDBLOCK || err == ErrInodeChangedAtPath
+}
+
+// try_upgrade tries to convert the shared lock held through fh into an
+// exclusive lock without blocking, which only succeeds if no other process
+// holds the lock
+func try_upgrade(fh *os.File) bool {
+	return unix.Flock(int(fh.Fd()), unix.LOCK_EX|unix.LOCK_NB) == nil
+}
+
+// processExists returns true if a process with the given PID is running,
+// which may be owned by another user
+func processExists(pid int) bool {
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
+
 func rm_if_match(fh *os.File, path string) error {
 	// Sanity check :
 	// before running "rm", check that the file pointed at by the
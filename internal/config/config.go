@@ -2,27 +2,67 @@ package config
 
 import (
 	"encoding/json"
-	"io/ioutil"
 	"os"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/index"
+)
+
+// SyncPolicy controls when writes to the active datafile are synced to disk
+type SyncPolicy string
+
+const (
+	// SyncNever leaves syncing to the operating system, Close() and Sync()
+	SyncNever SyncPolicy = "never"
+
+	// SyncInterval syncs the active datafile periodically from a background
+	// goroutine bounding the window of writes lost on a crash
+	SyncInterval SyncPolicy = "interval"
+
+	// SyncAlways syncs the active datafile with fsync on every write
+	SyncAlways SyncPolicy = "always"
+
+	// SyncAlwaysDatasync syncs the active datafile with fdatasync on every
+	// write, which skips flushing metadata not needed to read the data back
+	SyncAlwaysDatasync SyncPolicy = "always-fdatasync"
 )
 
+// PerWrite returns true if the policy requires every write to be synced
+func (p SyncPolicy) PerWrite() bool {
+	return p == SyncAlways || p == SyncAlwaysDatasync
+}
+
 // Config contains the bitcask configuration parameters
 type Config struct {
-	MaxDatafileSize         int    `json:"max_datafile_size"`
-	MaxKeySize              uint32 `json:"max_key_size"`
-	MaxValueSize            uint64 `json:"max_value_size"`
-	Sync                    bool   `json:"sync"`
-	AutoRecovery            bool   `json:"autorecovery"`
-	DBVersion               uint32 `json:"db_version"`
+	MaxDatafileSize         int           `json:"max_datafile_size"`
+	MaxKeySize              uint32        `json:"max_key_size"`
+	MaxValueSize            uint64        `json:"max_value_size"`
+	MergeChunkSize          int           `json:"merge_chunk_size"`
+	IndexCheckpoint         int           `json:"-"`
+	ValueCache              int           `json:"-"`
+	Preallocate             bool          `json:"preallocate"`
+	SyncPolicy              SyncPolicy    `json:"sync_policy"`
+	SyncInterval            time.Duration `json:"sync_interval"`
+	GroupCommitInterval     time.Duration `json:"group_commit_interval"`
+	GroupCommitBytes        int           `json:"group_commit_bytes"`
+	AutoRecovery            bool          `json:"autorecovery"`
+	BloomFilter             bool          `json:"bloom_filter"`
+	LockTimeout             time.Duration `json:"-"`
+	ReadOnly                bool          `json:"-"`
+	FileSystem              fs.FileSystem `json:"-"`
+	Indexer                 index.Indexer `json:"-"`
+	DBVersion               uint32        `json:"db_version"`
 	DirFileModeBeforeUmask  os.FileMode
 	FileFileModeBeforeUmask os.FileMode
 }
 
 // Load loads a configuration from the given path
-func Load(path string) (*Config, error) {
+func Load(fsys fs.FileSystem, path string) (*Config, error) {
 	var cfg Config
 
-	data, err := ioutil.ReadFile(path)
+	data, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return nil, err
 	}
@@ -31,21 +71,30 @@ func Load(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if cfg.SyncPolicy == "" {
+		// Configurations saved before sync policies only had a sync flag
+		var legacy struct {
+			Sync bool `json:"sync"`
+		}
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		cfg.SyncPolicy = SyncNever
+		if legacy.Sync {
+			cfg.SyncPolicy = SyncAlways
+		}
+	}
+
 	return &cfg, nil
 }
 
-// Save saves the configuration to the provided path
-func (c *Config) Save(path string) error {
+// Save atomically saves the configuration to the provided path
+func (c *Config) Save(fsys fs.FileSystem, path string) error {
 
 	data, err := json.Marshal(c)
 	if err != nil {
 		return err
 	}
 
-	err = ioutil.WriteFile(path, data, c.FileFileModeBeforeUmask)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return internal.WriteFileAtomic(fsys, path, data, c.FileFileModeBeforeUmask)
 }
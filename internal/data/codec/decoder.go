@@ -2,7 +2,9 @@ package codec
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io"
+	"math"
 	"time"
 
 	"github.com/pkg/errors"
@@ -61,16 +63,62 @@ func (d *Decoder) Decode(v *internal.Entry) (int64, error) {
 
 // DecodeEntry decodes a serialized entry
 func DecodeEntry(b []byte, e *internal.Entry, maxKeySize uint32, maxValueSize uint64) error {
-	valueOffset, _, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
+	if len(b) < MetaInfoSize {
+		return errTruncatedData
+	}
+	valueOffset, actualValueSize, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
 	if err != nil {
 		return errors.Wrap(err, "key/value sizes are invalid")
 	}
+	if actualValueSize > uint64(len(b)) || uint64(MetaInfoSize)+uint64(valueOffset)+actualValueSize != uint64(len(b)) {
+		return errTruncatedData
+	}
 
 	decodeWithoutPrefix(b[keySize+valueSize:], valueOffset, e)
 
 	return nil
 }
 
+// EntrySize returns the size of the entry at the start of b according to its
+// header, or 0 if the header isn't valid. Only the first MetaInfoSize bytes
+// of the entry are needed.
+func EntrySize(b []byte, maxKeySize uint32, maxValueSize uint64) int64 {
+	if len(b) < MetaInfoSize {
+		return 0
+	}
+	actualKeySize, actualValueSize, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
+	if err != nil || actualValueSize > math.MaxInt64-math.MaxUint32-MetaInfoSize {
+		return 0
+	}
+	return int64(MetaInfoSize) + int64(actualKeySize) + int64(actualValueSize)
+}
+
+// IntactSize returns the size of the entry at the start of b if it decodes
+// and checksums cleanly, or 0 if it doesn't
+func IntactSize(b []byte, maxKeySize uint32, maxValueSize uint64) int64 {
+	if len(b) < MetaInfoSize {
+		return 0
+	}
+	actualKeySize, actualValueSize, err := getKeyValueSizes(b, maxKeySize, maxValueSize)
+	if err != nil {
+		return 0
+	}
+	if actualValueSize > uint64(len(b)) {
+		return 0
+	}
+	size := uint64(MetaInfoSize) + uint64(actualKeySize) + actualValueSize
+	if size > uint64(len(b)) {
+		return 0
+	}
+
+	var e internal.Entry
+	decodeWithoutPrefix(b[keySize+valueSize:size], actualKeySize, &e)
+	if crc32.ChecksumIEEE(e.Value) != e.Checksum {
+		return 0
+	}
+	return int64(size)
+}
+
 func getKeyValueSizes(buf []byte, maxKeySize uint32, maxValueSize uint64) (uint32, uint64, error) {
 	actualKeySize := binary.BigEndian.Uint32(buf[:keySize])
 	actualValueSize := binary.BigEndian.Uint64(buf[keySize:])
@@ -99,10 +147,11 @@ func getKeyExpiry(buf []byte) *time.Time {
 	return &t
 }
 
-// IsCorruptedData indicates if the error correspondes to possible data corruption
+// IsCorruptedData indicates if the error correspondes to possible data corruption.
+// A prefix cut short, as left by a torn write, is corrupted data too.
 func IsCorruptedData(err error) bool {
 	switch err {
-	case errCantDecodeOnNilEntry, errInvalidKeyOrValueSize, errTruncatedData:
+	case errCantDecodeOnNilEntry, errInvalidKeyOrValueSize, errTruncatedData, io.ErrUnexpectedEOF:
 		return true
 	default:
 		return false
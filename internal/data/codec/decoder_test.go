@@ -128,3 +128,49 @@ func TestDecodeWithoutPrefix(t *testing.T) {
 	assert.Equal(expectedEntry.Offset, e.Offset)
 	assert.Equal(*expectedEntry.Expiry, *e.Expiry)
 }
+
+func TestIntactSize(t *testing.T) {
+	assert := assert.New(t)
+	maxKeySize, maxValueSize := uint32(10), uint64(20)
+
+	entry := Append(nil, internal.NewEntry([]byte("foo"), []byte("bar"), nil))
+	corrupted := append([]byte(nil), entry...)
+	corrupted[len(corrupted)-ttlSize-checksumSize-1] ^= 0xff
+
+	tests := []struct {
+		data []byte
+		size int64
+		name string
+	}{
+		{data: entry, size: int64(len(entry)), name: "intact"},
+		{data: append(append([]byte(nil), entry...), entry...), size: int64(len(entry)), name: "followed by another entry"},
+		{data: entry[:len(entry)-1], name: "truncated"},
+		{data: corrupted, name: "checksum mismatch"},
+		{data: make([]byte, len(entry)), name: "zeroes"},
+	}
+
+	for i := range tests {
+		i := i
+		t.Run(tests[i].name, func(t *testing.T) {
+			assert.Equal(tests[i].size, IntactSize(tests[i].data, maxKeySize, maxValueSize))
+		})
+	}
+}
+
+func TestEntrySize(t *testing.T) {
+	assert := assert.New(t)
+	maxKeySize, maxValueSize := uint32(10), uint64(20)
+
+	entry := Append(nil, internal.NewEntry([]byte("foo"), []byte("bar"), nil))
+	assert.Equal(int64(len(entry)), EntrySize(entry, maxKeySize, maxValueSize))
+	assert.Equal(int64(len(entry)), EntrySize(entry[:MetaInfoSize], maxKeySize, maxValueSize))
+	assert.Equal(int64(0), EntrySize(entry[:MetaInfoSize-1], maxKeySize, maxValueSize))
+	assert.Equal(int64(0), EntrySize(entry, 2, maxValueSize))
+	assert.Equal(int64(0), EntrySize(make([]byte, MetaInfoSize), maxKeySize, maxValueSize))
+
+	huge := append([]byte(nil), entry...)
+	for i := keySize; i < keySize+valueSize; i++ {
+		huge[i] = 0xff
+	}
+	assert.Equal(int64(0), EntrySize(huge, maxKeySize, 0))
+}
@@ -1,9 +1,9 @@
 package codec
 
 import (
-	"bufio"
 	"encoding/binary"
 	"io"
+	"sync"
 
 	"github.com/pkg/errors"
 	"github.com/prologic/bitcask/internal"
@@ -15,55 +15,74 @@ const (
 	checksumSize = 4
 	ttlSize      = 8
 	MetaInfoSize = keySize + valueSize + checksumSize + ttlSize
+
+	// maxPooledBufferSize is the size above which encoding buffers are not
+	// returned to the pool so a few huge values don't pin memory
+	maxPooledBufferSize = 1 << 20
 )
 
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
 // NewEncoder creates a streaming Entry encoder.
 func NewEncoder(w io.Writer) *Encoder {
-	return &Encoder{w: bufio.NewWriter(w)}
+	return &Encoder{w: w}
 }
 
 // Encoder wraps an underlying io.Writer and allows you to stream
 // Entry encodings on it.
 type Encoder struct {
-	w *bufio.Writer
+	w io.Writer
 }
 
 // Encode takes any Entry and streams it to the underlying writer.
 // Messages are framed with a key-length and value-length prefix.
+// The record is written with a single call to the underlying writer.
 func (e *Encoder) Encode(msg internal.Entry) (int64, error) {
-	var bufKeyValue = make([]byte, keySize+valueSize)
-	binary.BigEndian.PutUint32(bufKeyValue[:keySize], uint32(len(msg.Key)))
-	binary.BigEndian.PutUint64(bufKeyValue[keySize:keySize+valueSize], uint64(len(msg.Value)))
-	if _, err := e.w.Write(bufKeyValue); err != nil {
-		return 0, errors.Wrap(err, "failed writing key & value length prefix")
-	}
+	return e.EncodeBatch([]internal.Entry{msg})
+}
 
-	if _, err := e.w.Write(msg.Key); err != nil {
-		return 0, errors.Wrap(err, "failed writing key data")
+// EncodeBatch streams all msgs to the underlying writer coalesced in a
+// single write and returns the number of bytes written.
+func (e *Encoder) EncodeBatch(msgs []internal.Entry) (int64, error) {
+	bp := bufferPool.Get().(*[]byte)
+	buf := (*bp)[:0]
+	for _, msg := range msgs {
+		buf = Append(buf, msg)
 	}
-	if _, err := e.w.Write(msg.Value); err != nil {
-		return 0, errors.Wrap(err, "failed writing value data")
+
+	_, err := e.w.Write(buf)
+
+	if cap(buf) <= maxPooledBufferSize {
+		*bp = buf[:0]
+		bufferPool.Put(bp)
 	}
 
-	bufChecksumSize := bufKeyValue[:checksumSize]
-	binary.BigEndian.PutUint32(bufChecksumSize, msg.Checksum)
-	if _, err := e.w.Write(bufChecksumSize); err != nil {
-		return 0, errors.Wrap(err, "failed writing checksum data")
+	if err != nil {
+		return 0, errors.Wrap(err, "failed writing entry")
 	}
+	return int64(len(buf)), nil
+}
+
+// Append appends the encoding of msg to buf and returns the extended buffer
+func Append(buf []byte, msg internal.Entry) []byte {
+	var meta [MetaInfoSize]byte
 
-	bufTTL := bufKeyValue[:ttlSize]
+	binary.BigEndian.PutUint32(meta[:keySize], uint32(len(msg.Key)))
+	binary.BigEndian.PutUint64(meta[keySize:keySize+valueSize], uint64(len(msg.Value)))
+	buf = append(buf, meta[:keySize+valueSize]...)
+	buf = append(buf, msg.Key...)
+	buf = append(buf, msg.Value...)
+
+	binary.BigEndian.PutUint32(meta[:checksumSize], msg.Checksum)
 	if msg.Expiry == nil {
-		binary.BigEndian.PutUint64(bufTTL, uint64(0))
+		binary.BigEndian.PutUint64(meta[checksumSize:checksumSize+ttlSize], uint64(0))
 	} else {
-		binary.BigEndian.PutUint64(bufTTL, uint64(msg.Expiry.Unix()))
-	}
-	if _, err := e.w.Write(bufTTL); err != nil {
-		return 0, errors.Wrap(err, "failed writing ttl data")
+		binary.BigEndian.PutUint64(meta[checksumSize:checksumSize+ttlSize], uint64(msg.Expiry.Unix()))
 	}
-
-	if err := e.w.Flush(); err != nil {
-		return 0, errors.Wrap(err, "failed flushing data")
-	}
-
-	return int64(keySize + valueSize + len(msg.Key) + len(msg.Value) + checksumSize + ttlSize), nil
+	return append(buf, meta[:checksumSize+ttlSize]...)
 }
@@ -30,3 +30,49 @@ func TestEncode(t *testing.T) {
 		assert.Equal(expectedHex, hex.EncodeToString(buf.Bytes()))
 	}
 }
+
+// countingWriter counts the calls to Write
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestEncodeSingleWrite(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	var w countingWriter
+	encoder := NewEncoder(&w)
+	n, err := encoder.Encode(internal.NewEntry([]byte("mykey"), []byte("myvalue"), nil))
+	assert.NoError(err)
+	assert.Equal(int64(MetaInfoSize+len("mykey")+len("myvalue")), n)
+	assert.Equal(1, w.writes)
+}
+
+func TestEncodeBatch(t *testing.T) {
+	t.Parallel()
+	assert := assert.New(t)
+
+	entries := []internal.Entry{
+		internal.NewEntry([]byte("foo"), []byte("bar"), nil),
+		internal.NewEntry([]byte("hello"), []byte("world"), nil),
+	}
+
+	var expected bytes.Buffer
+	for _, e := range entries {
+		_, err := NewEncoder(&expected).Encode(e)
+		assert.NoError(err)
+	}
+
+	var w countingWriter
+	n, err := NewEncoder(&w).EncodeBatch(entries)
+	assert.NoError(err)
+	assert.Equal(int64(expected.Len()), n)
+	assert.Equal(1, w.writes)
+	assert.Equal(expected.Bytes(), w.Bytes())
+}
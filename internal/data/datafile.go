@@ -9,7 +9,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/data/codec"
-	"golang.org/x/exp/mmap"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 const (
@@ -19,6 +19,9 @@ const (
 var (
 	errReadonly  = errors.New("error: read only datafile")
 	errReadError = errors.New("error: read error")
+
+	// ErrClosed is the error returned when reading from a closed datafile
+	ErrClosed = errors.New("error: datafile closed")
 )
 
 // Datafile is an interface  that represents a readable and writeable datafile
@@ -27,6 +30,8 @@ type Datafile interface {
 	Name() string
 	Close() error
 	Sync() error
+	Datasync() error
+	Preallocate(size int64) error
 	Size() int64
 	Read() (internal.Entry, int64, error)
 	ReadAt(index, size int64) (internal.Entry, error)
@@ -37,35 +42,43 @@ type datafile struct {
 	sync.RWMutex
 
 	id           int
-	r            *os.File
-	ra           *mmap.ReaderAt
-	w            *os.File
+	r            fs.File
+	ra           fs.ReaderAtCloser
+	w            fs.File
 	offset       int64
+	preallocated bool
+	closed       bool
 	dec          *codec.Decoder
 	enc          *codec.Encoder
 	maxKeySize   uint32
 	maxValueSize uint64
 }
 
-// NewDatafile opens an existing datafile
-func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64, fileMode os.FileMode) (Datafile, error) {
+// Filename returns the name of the datafile with the given id
+func Filename(id int) string {
+	return fmt.Sprintf(defaultDatafileFilename, id)
+}
+
+// NewDatafile opens an existing datafile of the given file system. Read only
+// datafiles are mapped into memory if the file system supports it.
+func NewDatafile(fsys fs.FileSystem, path string, id int, readonly bool, maxKeySize uint32, maxValueSize uint64, fileMode os.FileMode) (Datafile, error) {
 	var (
-		r   *os.File
-		ra  *mmap.ReaderAt
-		w   *os.File
+		r   fs.File
+		ra  fs.ReaderAtCloser
+		w   fs.File
 		err error
 	)
 
-	fn := filepath.Join(path, fmt.Sprintf(defaultDatafileFilename, id))
+	fn := filepath.Join(path, Filename(id))
 
 	if !readonly {
-		w, err = os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
+		w, err = fsys.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, fileMode)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	r, err = os.Open(fn)
+	r, err = fs.Open(fsys, fn)
 	if err != nil {
 		return nil, err
 	}
@@ -74,9 +87,11 @@ func NewDatafile(path string, id int, readonly bool, maxKeySize uint32, maxValue
 		return nil, errors.Wrap(err, "error calling Stat()")
 	}
 
-	ra, err = mmap.Open(fn)
-	if err != nil {
-		return nil, err
+	if m, ok := fsys.(fs.Mapper); ok && readonly {
+		ra, err = m.Map(fn)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	offset := stat.Size()
@@ -105,9 +120,17 @@ func (df *datafile) Name() string {
 	return df.r.Name()
 }
 
+// Close closes the datafile. It waits for reads in progress, later reads
+// fail with ErrClosed.
 func (df *datafile) Close() error {
+	df.Lock()
+	defer df.Unlock()
+
+	df.closed = true
 	defer func() {
-		df.ra.Close()
+		if df.ra != nil {
+			df.ra.Close()
+		}
 		df.r.Close()
 	}()
 
@@ -116,6 +139,13 @@ func (df *datafile) Close() error {
 		return nil
 	}
 
+	// Release the preallocated space not used by the sealed datafile
+	if df.preallocated {
+		if err := df.w.Truncate(df.offset); err != nil {
+			return err
+		}
+	}
+
 	err := df.Sync()
 	if err != nil {
 		return err
@@ -130,6 +160,28 @@ func (df *datafile) Sync() error {
 	return df.w.Sync()
 }
 
+// Datasync flushes the written data to disk like Sync but without forcing
+// an update of file metadata that is not needed to read the data back
+func (df *datafile) Datasync() error {
+	if df.w == nil {
+		return nil
+	}
+	return internal.Fdatasync(df.w)
+}
+
+// Preallocate allocates disk space for size bytes of the datafile up front
+// to reduce fragmentation. The space not used is released by Close.
+func (df *datafile) Preallocate(size int64) error {
+	if df.w == nil {
+		return errReadonly
+	}
+	if err := internal.Fallocate(df.w, size); err != nil {
+		return err
+	}
+	df.preallocated = true
+	return nil
+}
+
 func (df *datafile) Size() int64 {
 	df.RLock()
 	defer df.RUnlock()
@@ -153,9 +205,17 @@ func (df *datafile) Read() (e internal.Entry, n int64, err error) {
 func (df *datafile) ReadAt(index, size int64) (e internal.Entry, err error) {
 	var n int
 
+	df.RLock()
+	defer df.RUnlock()
+
+	if df.closed {
+		err = ErrClosed
+		return
+	}
+
 	b := make([]byte, size)
 
-	if df.w == nil {
+	if df.ra != nil {
 		n, err = df.ra.ReadAt(b, index)
 	} else {
 		n, err = df.r.ReadAt(b, index)
@@ -168,7 +228,7 @@ func (df *datafile) ReadAt(index, size int64) (e internal.Entry, err error) {
 		return
 	}
 
-	codec.DecodeEntry(b, &e, df.maxKeySize, df.maxValueSize)
+	err = codec.DecodeEntry(b, &e, df.maxKeySize, df.maxValueSize)
 
 	return
 }
@@ -185,6 +245,11 @@ func (df *datafile) Write(e internal.Entry) (int64, int64, error) {
 
 	n, err := df.enc.Encode(e)
 	if err != nil {
+		// Cut off whatever part of the entry was written, e.g. when running
+		// out of space, so that later entries follow the last complete one
+		if terr := df.w.Truncate(df.offset); terr != nil {
+			return -1, 0, fmt.Errorf("%s (truncating datafile: %v)", err, terr)
+		}
 		return -1, 0, err
 	}
 	df.offset += n
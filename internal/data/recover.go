@@ -1,6 +1,7 @@
 package data
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"os"
@@ -9,87 +10,293 @@ import (
 	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
 	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
-// CheckAndRecover checks and recovers the last datafile.
-// If the datafile isn't corrupted, this is a noop. If it is,
-// the longest non-corrupted prefix will be kept and the rest
-// will be *deleted*. Also, the index file is also *deleted* which
-// will be automatically recreated on next startup.
-func CheckAndRecover(path string, cfg *config.Config) error {
-	dfs, err := internal.GetDatafiles(path)
-	if err != nil {
-		return fmt.Errorf("scanning datafiles: %s", err)
+// QuarantineDir is the directory of a database the damaged regions of its
+// datafiles are moved to on recovery
+const QuarantineDir = "quarantine"
+
+// Report describes the recovery of the datafiles of a database
+type Report struct {
+	Files []FileReport `json:"files"`
+}
+
+// Damaged returns the reports of the datafiles that were damaged
+func (r Report) Damaged() []FileReport {
+	var damaged []FileReport
+	for _, f := range r.Files {
+		if len(f.Regions) > 0 {
+			damaged = append(damaged, f)
+		}
 	}
-	if len(dfs) == 0 {
-		return nil
+	return damaged
+}
+
+// FileReport describes the recovery of a datafile. Each damaged region held
+// what is left of at least one entry, so LostEntries, which counts one entry
+// per region, is a lower bound.
+type FileReport struct {
+	Path        string   `json:"path"`
+	Size        int64    `json:"size"`
+	Entries     int      `json:"entries"`
+	LostEntries int      `json:"lost_entries"`
+	LostBytes   int64    `json:"lost_bytes"`
+	Regions     []Region `json:"regions,omitempty"`
+}
+
+// Region is a damaged region of a datafile
+type Region struct {
+	Offset     int64  `json:"offset"`
+	Size       int64  `json:"size"`
+	Quarantine string `json:"quarantine,omitempty"`
+}
+
+// scanBufferSize is the least size of the buffer datafiles are scanned
+// through
+const scanBufferSize = 1 << 16
+
+// Check checks the datafiles with the given ids, the live datafiles of the
+// manifest, for damaged regions without changing them. An entry is intact if
+// it decodes and checksums cleanly, after a damaged region the datafile is
+// scanned for the next one.
+func Check(fsys fs.FileSystem, path string, ids []int, cfg *config.Config) (Report, error) {
+	var report Report
+
+	for _, id := range ids {
+		f := filepath.Join(path, Filename(id))
+		fr, _, err := checkDatafile(fsys, f, cfg)
+		if err != nil {
+			return report, fmt.Errorf("reading data file %s: %w", f, err)
+		}
+		report.Files = append(report.Files, fr)
+	}
+	return report, nil
+}
+
+// Recover recovers the datafile at path. If it isn't corrupted, this is a
+// noop. If it is, the damaged regions are moved to the quarantine directory
+// and the intact entries around them are kept. As the offsets of the entries
+// change the index file must be *deleted* by the caller, it will be
+// automatically recreated on next startup.
+func Recover(fsys fs.FileSystem, path string, cfg *config.Config) (FileReport, error) {
+	f, err := fs.Open(fsys, path)
+	if err != nil {
+		return FileReport{Path: path}, fmt.Errorf("reading the datafile: %w", err)
 	}
-	f := dfs[len(dfs)-1]
-	recovered, err := recoverDatafile(f, cfg)
+	defer f.Close()
+
+	report, intact, err := scanFile(f, path, cfg)
 	if err != nil {
-		return fmt.Errorf("recovering data file")
+		return report, fmt.Errorf("reading the datafile: %w", err)
+	}
+	if len(report.Regions) == 0 {
+		return report, nil
 	}
-	if recovered {
-		if err := os.Remove(filepath.Join(path, "index")); err != nil {
-			return fmt.Errorf("error deleting the index on recovery: %s", err)
+
+	dir := filepath.Join(filepath.Dir(path), QuarantineDir)
+	if err := fsys.MkdirAll(dir, cfg.DirFileModeBeforeUmask); err != nil {
+		return report, fmt.Errorf("creating the quarantine directory: %w", err)
+	}
+	for i, r := range report.Regions {
+		name := filepath.Join(dir, fmt.Sprintf("%s.%d", filepath.Base(path), r.Offset))
+		if err := writeRegions(fsys, name, f, []Region{r}, cfg.FileFileModeBeforeUmask); err != nil {
+			return report, fmt.Errorf("quarantining damaged region: %w", err)
 		}
+		report.Regions[i].Quarantine = name
 	}
-	return nil
+	if err := internal.SyncDir(fsys, dir); err != nil {
+		return report, err
+	}
+
+	tmp := path + ".tmp"
+	if err := writeRegions(fsys, tmp, f, intact, cfg.FileFileModeBeforeUmask); err != nil {
+		return report, fmt.Errorf("writing the recovered datafile: %w", err)
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		return report, fmt.Errorf("writing the recovered datafile: %w", err)
+	}
+	if err := internal.SyncDir(fsys, filepath.Dir(path)); err != nil {
+		return report, fmt.Errorf("writing the recovered datafile: %w", err)
+	}
+	return report, nil
 }
 
-func recoverDatafile(path string, cfg *config.Config) (recovered bool, err error) {
-	f, err := os.Open(path)
+// writeRegions writes the regions of r to the file identified by path one
+// after the other and syncs it to disk
+func writeRegions(fsys fs.FileSystem, path string, r io.ReaderAt, regions []Region, mode os.FileMode) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
-		return false, fmt.Errorf("opening the datafile: %s", err)
+		return err
 	}
-	defer func() {
-		closeErr := f.Close()
-		if err == nil {
-			err = closeErr
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, scanBufferSize)
+	for _, region := range regions {
+		if _, err := io.Copy(w, io.NewSectionReader(r, region.Offset, region.Size)); err != nil {
+			return err
 		}
-	}()
-	_, file := filepath.Split(path)
-	rPath := fmt.Sprintf("%s.recovered", file)
-	fr, err := os.OpenFile(rPath, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// checkDatafile checks the datafile at path and returns its report along
+// with the intact entries
+func checkDatafile(fsys fs.FileSystem, path string, cfg *config.Config) (FileReport, []Region, error) {
+	f, err := fs.Open(fsys, path)
 	if err != nil {
-		return false, fmt.Errorf("creating the recovered datafile: %w", err)
+		return FileReport{Path: path}, nil, err
 	}
-	defer func() {
-		closeErr := fr.Close()
-		if err == nil {
-			err = closeErr
-		}
-	}()
+	defer f.Close()
+	return scanFile(f, path, cfg)
+}
 
-	dec := codec.NewDecoder(f, cfg.MaxKeySize, cfg.MaxValueSize)
-	enc := codec.NewEncoder(fr)
-	e := internal.Entry{}
+// scanFile checks the contents of the open datafile at path and returns its
+// report along with the intact entries
+func scanFile(f fs.File, path string, cfg *config.Config) (FileReport, []Region, error) {
+	report := FileReport{Path: path}
+	fi, err := f.Stat()
+	if err != nil {
+		return report, nil, err
+	}
+	report.Size = fi.Size()
 
-	corrupted := false
-	for !corrupted {
-		_, err = dec.Decode(&e)
-		if err == io.EOF {
-			break
+	intact, damaged, err := scanDatafile(f, report.Size, cfg.MaxKeySize, cfg.MaxValueSize)
+	if err != nil {
+		return report, nil, err
+	}
+	report.Entries = len(intact)
+	report.LostEntries = len(damaged)
+	report.Regions = damaged
+	for _, r := range damaged {
+		report.LostBytes += r.Size
+	}
+	return report, intact, nil
+}
+
+// window reads a datafile being scanned through a buffer starting at the
+// offset scanned, which is all the scan looks ahead of, so that datafiles
+// aren't read whole
+type window struct {
+	r     io.ReaderAt
+	end   int64
+	start int64
+	buf   []byte
+	err   error
+}
+
+// bytes returns the n bytes at offset, or those up to the end of the
+// datafile. Reads never start before the offset scanned from start. It
+// returns nil once reading failed, the error is kept in err.
+func (w *window) bytes(offset, n int64) []byte {
+	if offset+n > w.end {
+		n = w.end - offset
+	}
+	if w.err != nil || n <= 0 {
+		return nil
+	}
+	if offset+n > w.start+int64(len(w.buf)) {
+		size := offset + n - w.start
+		if size < scanBufferSize {
+			size = scanBufferSize
 		}
-		if codec.IsCorruptedData(err) {
-			corrupted = true
-			continue
+		if w.start+size > w.end {
+			size = w.end - w.start
 		}
-		if err != nil {
-			return false, fmt.Errorf("unexpected error while reading datafile: %w", err)
+		if int64(cap(w.buf)) < size {
+			w.buf = make([]byte, size)
 		}
-		if _, err := enc.Encode(e); err != nil {
-			return false, fmt.Errorf("writing to recovered datafile: %w", err)
+		w.buf = w.buf[:size]
+		if k, err := w.r.ReadAt(w.buf, w.start); k < len(w.buf) {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			w.buf, w.err = w.buf[:0], err
+			return nil
 		}
 	}
-	if !corrupted {
-		if err := os.Remove(fr.Name()); err != nil {
-			return false, fmt.Errorf("can't remove temporal recovered datafile: %w", err)
+	return w.buf[offset-w.start : offset-w.start+n]
+}
+
+// advance moves the start of the window forward to offset
+func (w *window) advance(offset int64) {
+	if offset >= w.start+int64(len(w.buf)) {
+		w.start, w.buf = offset, w.buf[:0]
+		return
+	}
+	// Only whole buffers are read, the bytes kept are moved to the front
+	// once past the first half
+	if d := offset - w.start; d > int64(len(w.buf))/2 {
+		w.buf = w.buf[:copy(w.buf, w.buf[d:])]
+		w.start = offset
+	}
+}
+
+// scanDatafile splits the datafile of the given size read from r into the
+// intact entries and the damaged regions between them.
+//
+// The checksum of an entry doesn't cover its key and is zero for tombstones,
+// so the remains of a torn entry and the start of the next one can look like
+// an intact tombstone. An entry is only taken for intact if it's followed by
+// another intact entry or the end of the datafile, or, directly following an
+// intact entry, if it doesn't overlap such an entry.
+func scanDatafile(r io.ReaderAt, end int64, maxKeySize uint32, maxValueSize uint64) (intact, damaged []Region, err error) {
+	w := &window{r: r, end: end}
+	size := func(offset int64) int64 {
+		n := codec.EntrySize(w.bytes(offset, codec.MetaInfoSize), maxKeySize, maxValueSize)
+		if n == 0 || offset+n > end {
+			return 0
+		}
+		return codec.IntactSize(w.bytes(offset, n), maxKeySize, maxValueSize)
+	}
+	chained := func(offset int64) bool {
+		n := size(offset)
+		return n > 0 && (offset+n == end || size(offset+n) > 0)
+	}
+	overlapping := func(offset, n int64) bool {
+		for p := offset + 1; p < offset+n && p < end; p++ {
+			if chained(p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var (
+		offset int64
+		start  int64 = -1
+	)
+	for offset < end {
+		w.advance(offset)
+		n := size(offset)
+		if n > 0 && !chained(offset) && (start >= 0 || overlapping(offset, n)) {
+			n = 0
+		}
+		if w.err != nil {
+			return nil, nil, w.err
+		}
+		if n > 0 {
+			if start >= 0 {
+				damaged = append(damaged, Region{Offset: start, Size: offset - start})
+				start = -1
+			}
+			intact = append(intact, Region{Offset: offset, Size: n})
+			offset += n
+			continue
+		}
+		if start < 0 {
+			start = offset
 		}
-		return false, nil
+		offset++
 	}
-	if err := os.Rename(rPath, path); err != nil {
-		return false, fmt.Errorf("removing corrupted file: %s", err)
+	if start >= 0 {
+		damaged = append(damaged, Region{Offset: start, Size: offset - start})
 	}
-	return true, nil
+	return intact, damaged, nil
 }
@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Fallocate allocates disk space for the first size bytes of f without
+// changing its apparent size. Filesystems that don't support preallocation,
+// including files that are not files of the operating system, are silently
+// ignored.
+func Fallocate(f fs.File, size int64) error {
+	osf, ok := f.(*os.File)
+	if !ok {
+		return nil
+	}
+	err := unix.Fallocate(int(osf.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if err == unix.EOPNOTSUPP || err == unix.ENOSYS {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+import (
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Fallocate allocates disk space for the first size bytes of f. It is a
+// no-op on platforms without fallocate.
+func Fallocate(f fs.File, size int64) error {
+	return nil
+}
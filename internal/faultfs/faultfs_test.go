@@ -0,0 +1,175 @@
+package faultfs
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+func TestRestart(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fsys := New(1)
+	require.NoError(fsys.MkdirAll("/db", 0700))
+
+	t.Run("SyncedFile", func(t *testing.T) {
+		require.NoError(internal.WriteFileSync(fsys, "/db/synced", []byte("synced"), 0600))
+		require.NoError(internal.SyncDir(fsys, "/db"))
+	})
+
+	t.Run("UnsyncedDir", func(t *testing.T) {
+		require.NoError(internal.WriteFileSync(fsys, "/db/unlinked", []byte("data"), 0600))
+	})
+
+	t.Run("UnsyncedAppend", func(t *testing.T) {
+		f, err := fsys.OpenFile("/db/synced", os.O_WRONLY|os.O_APPEND, 0600)
+		require.NoError(err)
+		_, err = f.Write([]byte(" and more"))
+		require.NoError(err)
+		require.NoError(f.Close())
+	})
+
+	t.Run("UnsyncedRemoveAll", func(t *testing.T) {
+		require.NoError(fsys.MkdirAll("/db/removed", 0700))
+		require.NoError(internal.WriteFileSync(fsys, "/db/removed/file", []byte("data"), 0600))
+		require.NoError(internal.SyncDir(fsys, "/db/removed"))
+		require.NoError(fsys.RemoveAll("/db/removed"))
+
+	})
+
+	t.Run("SyncedRemoveAll", func(t *testing.T) {
+		require.NoError(fsys.MkdirAll("/other/removed", 0700))
+		require.NoError(internal.WriteFileSync(fsys, "/other/removed/file", []byte("data"), 0600))
+		require.NoError(internal.SyncDir(fsys, "/other/removed"))
+		require.NoError(fsys.RemoveAll("/other/removed"))
+		require.NoError(internal.SyncDir(fsys, "/other"))
+	})
+
+	restarted := fsys.Restart()
+
+	t.Run("Durable", func(t *testing.T) {
+		data, err := fs.ReadFile(restarted, "/db/synced")
+		require.NoError(err)
+		assert.Contains(string(data), "synced")
+		assert.True(len(data) <= len("synced and more"))
+		assert.False(internal.Exists(restarted, "/db/unlinked"))
+		assert.True(internal.Exists(restarted, "/db/removed/file"))
+		assert.False(internal.Exists(restarted, "/other/removed"))
+	})
+
+	t.Run("Crashed", func(t *testing.T) {
+		_, err := fsys.OpenFile("/db/new", os.O_WRONLY|os.O_CREATE, 0600)
+		assert.Error(err)
+	})
+}
+
+func TestInject(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	t.Run("Crash", func(t *testing.T) {
+		fsys := New(1)
+		fsys.Inject(Crash, 2)
+		require.NoError(fsys.Mkdir("/db", 0700))
+		err := fs.WriteFile(fsys, "/db/file", []byte("data"), 0600)
+		assert.Error(err)
+		assert.True(fsys.Crashed())
+		assert.Equal(2, fsys.Ops())
+	})
+
+	t.Run("TornWrite", func(t *testing.T) {
+		fsys := New(1)
+		fsys.Inject(TornWrite, 2)
+		err := fs.WriteFile(fsys, "/file", []byte("data"), 0600)
+		assert.Error(err)
+		assert.True(fsys.Crashed())
+		data, err := fs.ReadFile(fsys, "/file")
+		require.NoError(err)
+		assert.True(len(data) < len("data"))
+	})
+
+	t.Run("LostSync", func(t *testing.T) {
+		fsys := New(1)
+		fsys.Inject(LostSync, 3)
+		require.NoError(internal.WriteFileSync(fsys, "/file", []byte("data"), 0600))
+		assert.False(fsys.Durable())
+		require.NoError(internal.SyncDir(fsys, "/"))
+		assert.False(internal.Exists(fsys.Restart(), "/file"))
+	})
+
+	t.Run("NoSpace", func(t *testing.T) {
+		fsys := New(1)
+		fsys.Inject(NoSpace, 2)
+		err := fs.WriteFile(fsys, "/file", []byte("data"), 0600)
+		if assert.Error(err) {
+			assert.Equal(syscall.ENOSPC, err.(*os.PathError).Err)
+		}
+		assert.False(fsys.Crashed())
+
+		fsys.Clear()
+		assert.NoError(fs.WriteFile(fsys, "/file", []byte("data"), 0600))
+	})
+
+	t.Run("SyncError", func(t *testing.T) {
+		fsys := New(1)
+		fsys.Inject(SyncError, 1)
+		err := internal.WriteFileSync(fsys, "/file", []byte("data"), 0600)
+		if assert.Error(err) {
+			assert.Equal(syscall.EIO, err.(*os.PathError).Err)
+		}
+		assert.False(fsys.Crashed())
+
+		fsys.Clear()
+		require.NoError(internal.WriteFileSync(fsys, "/file", []byte("data"), 0600))
+		require.NoError(internal.SyncDir(fsys, "/"))
+		data, err := fs.ReadFile(fsys.Restart(), "/file")
+		require.NoError(err)
+		assert.Equal([]byte("data"), data)
+	})
+}
+
+func TestModel(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewModel()
+	m.Put([]byte("foo"), []byte("1")).Ack()
+	m.Put([]byte("foo"), []byte("2"))
+	m.Put([]byte("bar"), []byte("1"))
+
+	store := map[string]string{}
+	get := func(key []byte) ([]byte, bool, error) {
+		value, ok := store[string(key)]
+		return []byte(value), ok, nil
+	}
+	keys := func() (keys [][]byte) {
+		for key := range store {
+			keys = append(keys, []byte(key))
+		}
+		return
+	}
+
+	assert.EqualError(m.Check(keys(), get), `lost key "foo"`)
+
+	store["foo"] = "2"
+	assert.NoError(m.Check(keys(), get))
+
+	store["bar"] = "2"
+	assert.EqualError(m.Check(keys(), get), `unexpected value "2" for key "bar"`)
+
+	delete(store, "bar")
+	store["baz"] = "1"
+	assert.EqualError(m.Check(keys(), get), `unexpected key "baz"`)
+
+	delete(store, "baz")
+	m.Delete([]byte("foo")).Ack()
+	assert.EqualError(m.Check(keys(), get), `unexpected value "2" for key "foo"`)
+	delete(store, "foo")
+	assert.NoError(m.Check(keys(), get))
+}
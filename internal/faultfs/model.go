@@ -0,0 +1,96 @@
+package faultfs
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// Model keeps track of the puts and deletes made to a key-value store, to
+// check the store against after a crash
+type Model struct {
+	ops map[string][]*Op
+}
+
+// Op is a put or delete recorded in a Model
+type Op struct {
+	value   []byte
+	deleted bool
+	acked   bool
+}
+
+// NewModel returns a new empty model
+func NewModel() *Model {
+	return &Model{ops: make(map[string][]*Op)}
+}
+
+// Put records a put of the key, which is yet to be acknowledged
+func (m *Model) Put(key, value []byte) *Op {
+	op := &Op{value: append([]byte(nil), value...)}
+	m.ops[string(key)] = append(m.ops[string(key)], op)
+	return op
+}
+
+// Delete records a delete of the key, which is yet to be acknowledged
+func (m *Model) Delete(key []byte) *Op {
+	op := &Op{deleted: true}
+	m.ops[string(key)] = append(m.ops[string(key)], op)
+	return op
+}
+
+// Ack records that the operation succeeded and is durable
+func (op *Op) Ack() {
+	op.acked = true
+}
+
+// allowed returns the operations one of which must be the last one found
+// in the store for the key: the last acknowledged one or any later one
+func (m *Model) allowed(key string) []*Op {
+	ops := m.ops[key]
+	for i := len(ops) - 1; i >= 0; i-- {
+		if ops[i].acked {
+			return ops[i:]
+		}
+	}
+	// Nothing was acknowledged, so the key may not exist at all
+	return append([]*Op{{deleted: true}}, ops...)
+}
+
+// Check checks the keys and values of a store against the model. It
+// returns an error if the store lost an acknowledged operation, has a value
+// which was never put, or has a key which was never put.
+func (m *Model) Check(keys [][]byte, get func(key []byte) ([]byte, bool, error)) error {
+	for _, key := range keys {
+		if _, ok := m.ops[string(key)]; !ok {
+			return fmt.Errorf("unexpected key %q", key)
+		}
+	}
+
+	names := make([]string, 0, len(m.ops))
+	for key := range m.ops {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		value, found, err := get([]byte(key))
+		if err != nil {
+			return fmt.Errorf("error getting key %q: %w", key, err)
+		}
+
+		ok := false
+		for _, op := range m.allowed(key) {
+			if op.deleted && !found || !op.deleted && found && bytes.Equal(op.value, value) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			if !found {
+				return fmt.Errorf("lost key %q", key)
+			}
+			return fmt.Errorf("unexpected value %q for key %q", value, key)
+		}
+	}
+	return nil
+}
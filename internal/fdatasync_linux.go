@@ -0,0 +1,22 @@
+//go:build linux
+// +build linux
+
+package internal
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Fdatasync flushes the data of f to disk along with only the metadata
+// needed to read it back, skipping e.g. the modification time. Files that
+// are not files of the operating system are synced with f.Sync()
+func Fdatasync(f fs.File) error {
+	osf, ok := f.(*os.File)
+	if !ok {
+		return f.Sync()
+	}
+	return syscall.Fdatasync(int(osf.Fd()))
+}
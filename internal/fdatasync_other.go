@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+import (
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Fdatasync flushes the data of f to disk. On platforms without fdatasync
+// it is equivalent to f.Sync()
+func Fdatasync(f fs.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,136 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadWriteFile(t *testing.T) {
+	assert := assert.New(t)
+
+	tempdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(tempdir)
+
+	name := filepath.Join(tempdir, "file")
+	assert.NoError(WriteFile(OS, name, []byte("test123"), 0600))
+
+	data, err := ReadFile(OS, name)
+	assert.NoError(err)
+	assert.Equal([]byte("test123"), data)
+
+	_, err = ReadFile(OS, filepath.Join(tempdir, "missing"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestTempDir(t *testing.T) {
+	assert := assert.New(t)
+
+	tempdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(tempdir)
+
+	dir1, err := TempDir(OS, tempdir, "merge")
+	assert.NoError(err)
+	dir2, err := TempDir(OS, tempdir, "merge")
+	assert.NoError(err)
+
+	assert.NotEqual(dir1, dir2)
+	for _, dir := range []string{dir1, dir2} {
+		assert.Equal(tempdir, filepath.Dir(dir))
+		assert.True(strings.HasPrefix(filepath.Base(dir), "merge"))
+		info, err := os.Stat(dir)
+		assert.NoError(err)
+		assert.True(info.IsDir())
+	}
+}
+
+func TestWalk(t *testing.T) {
+	assert := assert.New(t)
+
+	tempdir, err := ioutil.TempDir("", "bitcask")
+	assert.NoError(err)
+	defer os.RemoveAll(tempdir)
+
+	assert.NoError(os.MkdirAll(filepath.Join(tempdir, "a", "b"), 0700))
+	assert.NoError(os.MkdirAll(filepath.Join(tempdir, "skipped"), 0700))
+	for _, name := range []string{"file1", "a/file2", "a/b/file3", "skipped/file4"} {
+		assert.NoError(WriteFile(OS, filepath.Join(tempdir, name), nil, 0600))
+	}
+
+	var walked []string
+	err = Walk(OS, tempdir, func(path string, info os.FileInfo, err error) error {
+		assert.NoError(err)
+		if info.IsDir() && info.Name() == "skipped" {
+			return filepath.SkipDir
+		}
+		rel, _ := filepath.Rel(tempdir, path)
+		walked = append(walked, rel)
+		return nil
+	})
+	assert.NoError(err)
+	assert.Equal([]string{".", "a", "a/b", "a/b/file3", "a/file2", "file1"}, walked)
+
+	err = Walk(OS, filepath.Join(tempdir, "missing"), func(path string, info os.FileInfo, err error) error {
+		return err
+	})
+	assert.True(os.IsNotExist(err))
+}
+
+func TestMemory(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := NewMemory()
+	assert.NoError(fsys.MkdirAll("/db/merge", 0700))
+
+	// Appends to a file are read back by readers opened before them
+	w, err := fsys.OpenFile("/db/file", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	assert.NoError(err)
+	r, err := Open(fsys, "/db/file")
+	assert.NoError(err)
+	for _, s := range []string{"foo", "bar"} {
+		_, err = w.Write([]byte(s))
+		assert.NoError(err)
+	}
+	b := make([]byte, 6)
+	n, err := r.ReadAt(b, 0)
+	assert.NoError(err)
+	assert.Equal("foobar", string(b[:n]))
+
+	// Files grow with zeros and shrink when truncated
+	assert.NoError(w.Truncate(2))
+	assert.NoError(w.Truncate(4))
+	data, err := ReadFile(fsys, "/db/file")
+	assert.NoError(err)
+	assert.Equal([]byte("fo\x00\x00"), data)
+	assert.NoError(w.Close())
+	assert.NoError(r.Close())
+	_, err = r.ReadAt(b, 0)
+	assert.Error(err)
+
+	assert.NoError(WriteFile(fsys, "/db/merge/file", []byte("merged"), 0600))
+	assert.NoError(fsys.Rename("/db/merge/file", "/db/file"))
+	data, err = ReadFile(fsys, "/db/file")
+	assert.NoError(err)
+	assert.Equal([]byte("merged"), data)
+
+	infos, err := fsys.ReadDir("/db")
+	assert.NoError(err)
+	if assert.Len(infos, 2) {
+		assert.Equal("file", infos[0].Name())
+		assert.Equal(int64(6), infos[0].Size())
+		assert.True(infos[1].IsDir())
+	}
+
+	assert.Error(fsys.Remove("/db"))
+	assert.NoError(fsys.RemoveAll("/db"))
+	_, err = fsys.Stat("/db/file")
+	assert.True(os.IsNotExist(err))
+	_, err = Open(fsys, "/db/file")
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,397 @@
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// memFS is a FileSystem held in memory. Syncing is a no-op, as there is
+// nothing to flush.
+type memFS struct {
+	mu    sync.RWMutex
+	dirs  map[string]bool
+	files map[string]*memInode
+}
+
+// memInode is the contents of a file of a memFS, shared by the open files
+type memInode struct {
+	mu   sync.RWMutex
+	data []byte
+	mode os.FileMode
+}
+
+// NewMemory returns a new empty FileSystem held in memory, whose contents
+// are lost once it's no longer referenced
+func NewMemory() FileSystem {
+	return &memFS{
+		dirs:  map[string]bool{"/": true, ".": true},
+		files: make(map[string]*memInode),
+	}
+}
+
+func (fsys *memFS) checkParent(op, name string) error {
+	if !fsys.dirs[filepath.Dir(name)] {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (fsys *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = filepath.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.dirs[name] {
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return &memFile{fsys: fsys, name: name, dir: true}, nil
+	}
+
+	ino, ok := fsys.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		if err := fsys.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		ino = &memInode{mode: perm}
+		fsys.files[name] = ino
+	} else if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if flag&os.O_TRUNC != 0 {
+		ino.mu.Lock()
+		ino.data = nil
+		ino.mu.Unlock()
+	}
+
+	return &memFile{fsys: fsys, name: name, ino: ino, flag: flag}, nil
+}
+
+func (fsys *memFS) Stat(name string) (os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	if fsys.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), mode: os.ModeDir | 0700}, nil
+	}
+	ino, ok := fsys.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return ino.stat(name), nil
+}
+
+func (fsys *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = filepath.Clean(name)
+
+	fsys.mu.RLock()
+	defer fsys.mu.RUnlock()
+
+	if !fsys.dirs[name] {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+
+	var infos []os.FileInfo
+	for dir := range fsys.dirs {
+		if dir != name && filepath.Dir(dir) == name {
+			infos = append(infos, &memFileInfo{name: filepath.Base(dir), mode: os.ModeDir | 0700})
+		}
+	}
+	for fn, ino := range fsys.files {
+		if filepath.Dir(fn) == name {
+			infos = append(infos, ino.stat(fn))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fsys *memFS) Mkdir(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.dirs[name] || fsys.files[name] != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := fsys.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	fsys.dirs[name] = true
+	return nil
+}
+
+func (fsys *memFS) MkdirAll(name string, perm os.FileMode) error {
+	name = filepath.Clean(name)
+	if _, err := fsys.Stat(name); err == nil {
+		return nil
+	}
+	if parent := filepath.Dir(name); parent != name {
+		if err := fsys.MkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := fsys.Mkdir(name, perm); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (fsys *memFS) Remove(name string) error {
+	name = filepath.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	if fsys.dirs[name] {
+		for fn := range fsys.files {
+			if filepath.Dir(fn) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+		for dir := range fsys.dirs {
+			if dir != name && filepath.Dir(dir) == name {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+		delete(fsys.dirs, name)
+		return nil
+	}
+	if fsys.files[name] == nil {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, name)
+	return nil
+}
+
+func (fsys *memFS) RemoveAll(name string) error {
+	name = filepath.Clean(name)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	delete(fsys.files, name)
+	if !fsys.dirs[name] {
+		return nil
+	}
+	prefix := name + string(filepath.Separator)
+	for dir := range fsys.dirs {
+		if dir == name || strings.HasPrefix(dir, prefix) {
+			delete(fsys.dirs, dir)
+		}
+	}
+	for fn := range fsys.files {
+		if strings.HasPrefix(fn, prefix) {
+			delete(fsys.files, fn)
+		}
+	}
+	return nil
+}
+
+// Rename renames the file oldname to newname, replacing newname if it
+// exists. Renaming directories is not supported.
+func (fsys *memFS) Rename(oldname, newname string) error {
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+
+	fsys.mu.Lock()
+	defer fsys.mu.Unlock()
+
+	ino, ok := fsys.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if fsys.dirs[newname] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EISDIR}
+	}
+	if !fsys.dirs[filepath.Dir(newname)] {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(fsys.files, oldname)
+	fsys.files[newname] = ino
+	return nil
+}
+
+func (ino *memInode) stat(name string) os.FileInfo {
+	ino.mu.RLock()
+	defer ino.mu.RUnlock()
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(ino.data)), mode: ino.mode}
+}
+
+// resize resizes the file to size, zeroing the bytes it grows by. Appends
+// grow the capacity geometrically so that they're amortized.
+func (ino *memInode) resize(size int64) {
+	n := int64(len(ino.data))
+	switch {
+	case size <= n:
+		ino.data = ino.data[:size]
+		return
+	case size <= int64(cap(ino.data)):
+		ino.data = ino.data[:size]
+	default:
+		data := make([]byte, size, 2*size)
+		copy(data, ino.data)
+		ino.data = data
+	}
+	for i := n; i < size; i++ {
+		ino.data[i] = 0
+	}
+}
+
+// memFile is an open file of a memFS
+type memFile struct {
+	fsys   *memFS
+	name   string
+	ino    *memInode
+	dir    bool
+	flag   int
+	mu     sync.RWMutex
+	offset int64
+	closed bool
+}
+
+func (f *memFile) check(op string) error {
+	if f.closed {
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	if f.dir && op != "sync" && op != "close" && op != "stat" {
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	n, err := f.ino.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	err := f.check("read")
+	f.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+	return f.ino.readAt(p, off)
+}
+
+func (ino *memInode) readAt(p []byte, off int64) (int, error) {
+	ino.mu.RLock()
+	defer ino.mu.RUnlock()
+
+	if off >= int64(len(ino.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, ino.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, &os.PathError{Op: "write", Path: f.name, Err: syscall.EBADF}
+	}
+
+	f.ino.mu.Lock()
+	defer f.ino.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.ino.data))
+	}
+	if end := f.offset + int64(len(p)); end > int64(len(f.ino.data)) {
+		f.ino.resize(end)
+	}
+	copy(f.ino.data[f.offset:], p)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("truncate"); err != nil {
+		return err
+	}
+	f.ino.mu.Lock()
+	defer f.ino.mu.Unlock()
+	f.ino.resize(size)
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check("sync")
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	if f.dir {
+		return &memFileInfo{name: filepath.Base(f.name), mode: os.ModeDir | 0700}, nil
+	}
+	return f.ino.stat(f.name), nil
+}
+
+func (f *memFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.check("close"); err != nil {
+		return err
+	}
+	f.closed = true
+	return nil
+}
+
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() interface{}   { return nil }
@@ -2,10 +2,11 @@ package index
 
 import (
 	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
 
 	"github.com/pkg/errors"
-	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask/internal"
 )
 
@@ -14,6 +15,12 @@ var (
 	errTruncatedKeyData = errors.New("key data is truncated")
 	errTruncatedData    = errors.New("data is truncated")
 	errKeySizeTooLarge  = errors.New("key size too large")
+	errTruncatedHeader  = errors.New("header is truncated")
+	errTruncatedTrailer = errors.New("checksum is truncated")
+	errInvalidMagic     = errors.New("invalid magic")
+	errInvalidVersion   = errors.New("unsupported version")
+	errInvalidChecksum  = errors.New("invalid checksum")
+	errTrailingData     = errors.New("trailing data after checksum")
 )
 
 const (
@@ -22,6 +29,18 @@ const (
 	fileIDSize = int32Size
 	offsetSize = int64Size
 	sizeSize   = int64Size
+
+	// The index starts with a header of the magic, the version of the format
+	// and the number of items, followed by the items and the checksum of all
+	// of it
+	magicSize    = int32Size
+	versionSize  = int32Size
+	countSize    = int64Size
+	headerSize   = magicSize + versionSize + countSize
+	checksumSize = int32Size
+
+	magic   = "BCIX"
+	version = uint32(1)
 )
 
 func readKeyBytes(r io.Reader, maxKeySize uint32) ([]byte, error) {
@@ -86,40 +105,122 @@ func writeItem(item internal.Item, w io.Writer) error {
 	return nil
 }
 
-// ReadIndex reads a persisted from a io.Reader into a Tree
-func readIndex(r io.Reader, t art.Tree, maxKeySize uint32) error {
-	for {
-		key, err := readKeyBytes(r, maxKeySize)
+// readIndex reads a persisted index from a io.Reader into a Tree. The header,
+// the number of items and the checksum must match, a partial or corrupted
+// index is never loaded.
+func readIndex(r io.Reader, t Keydir, maxKeySize uint32) error {
+	return scanIndex(r, maxKeySize, func(key []byte, item internal.Item) error {
+		return t.Put(key, item)
+	})
+}
+
+// scanIndex reads a persisted index from a io.Reader calling f for each of
+// its items. The checksum is only verified once all the items were read.
+func scanIndex(r io.Reader, maxKeySize uint32, f func(key []byte, item internal.Item) error) error {
+	h := crc32.NewIEEE()
+	tr := io.TeeReader(r, h)
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(tr, header); err != nil {
+		return errors.Wrap(errTruncatedHeader, err.Error())
+	}
+	if string(header[:magicSize]) != magic {
+		return errInvalidMagic
+	}
+	if v := binary.BigEndian.Uint32(header[magicSize:]); v != version {
+		return errors.Wrapf(errInvalidVersion, "version %d", v)
+	}
+	count := binary.BigEndian.Uint64(header[magicSize+versionSize:])
+
+	for i := uint64(0); i < count; i++ {
+		key, err := readKeyBytes(tr, maxKeySize)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return errors.Wrap(errTruncatedKeySize, err.Error())
 			}
 			return err
 		}
 
-		item, err := readItem(r)
+		item, err := readItem(tr)
 		if err != nil {
 			return err
 		}
 
-		t.Insert(key, item)
+		if err := f(key, item); err != nil {
+			return err
+		}
+	}
+
+	checksum := h.Sum32()
+	trailer := make([]byte, checksumSize)
+	if _, err := io.ReadFull(r, trailer); err != nil {
+		return errors.Wrap(errTruncatedTrailer, err.Error())
+	}
+	if binary.BigEndian.Uint32(trailer) != checksum {
+		return errInvalidChecksum
+	}
+	if n, _ := r.Read(make([]byte, 1)); n > 0 {
+		return errTrailingData
 	}
 
 	return nil
 }
 
-func writeIndex(t art.Tree, w io.Writer) (err error) {
-	t.ForEach(func(node art.Node) bool {
-		err = writeBytes(node.Key(), w)
-		if err != nil {
-			return false
-		}
+func writeIndex(t Keydir, w io.Writer) (err error) {
+	e, err := newEncoder(w, uint64(t.Len()))
+	if err != nil {
+		return err
+	}
 
-		item := node.Value().(internal.Item)
-		err := writeItem(item, w)
+	ferr := t.ForEach(func(key []byte, item internal.Item) bool {
+		err = e.encode(key, item)
 		return err == nil
 	})
-	return
+	if err != nil {
+		return err
+	}
+	if ferr != nil {
+		return ferr
+	}
+
+	return e.close()
+}
+
+// encoder writes the items of an index between its header and checksum
+type encoder struct {
+	w  io.Writer
+	h  hash.Hash32
+	mw io.Writer
+}
+
+// newEncoder writes the header of an index of count items to w
+func newEncoder(w io.Writer, count uint64) (*encoder, error) {
+	h := crc32.NewIEEE()
+	e := &encoder{w: w, h: h, mw: io.MultiWriter(w, h)}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint32(header[magicSize:], version)
+	binary.BigEndian.PutUint64(header[magicSize+versionSize:], count)
+	if _, err := e.mw.Write(header); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encoder) encode(key []byte, item internal.Item) error {
+	if err := writeBytes(key, e.mw); err != nil {
+		return err
+	}
+	return writeItem(item, e.mw)
+}
+
+// close writes the checksum of the index
+func (e *encoder) close() error {
+	trailer := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(trailer, e.h.Sum32())
+	_, err := e.w.Write(trailer)
+	return err
 }
 
 // IsIndexCorruption returns a boolean indicating whether the error
@@ -127,7 +228,9 @@ func writeIndex(t art.Tree, w io.Writer) (err error) {
 func IsIndexCorruption(err error) bool {
 	cause := errors.Cause(err)
 	switch cause {
-	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize:
+	case errKeySizeTooLarge, errTruncatedData, errTruncatedKeyData, errTruncatedKeySize,
+		errTruncatedHeader, errTruncatedTrailer, errInvalidMagic, errInvalidVersion,
+		errInvalidChecksum, errTrailingData:
 		return true
 	}
 	return false
@@ -4,10 +4,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"hash/crc32"
 	"testing"
 
 	"github.com/pkg/errors"
-	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask/internal"
 )
 
@@ -15,6 +15,20 @@ const (
 	base64SampleTree = "AAAABGFiY2QAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAARhYmNlAAAAAQAAAAAAAAABAAAAAAAAAAEAAAAEYWJjZgAAAAIAAAAAAAAAAgAAAAAAAAACAAAABGFiZ2QAAAADAAAAAAAAAAMAAAAAAAAAAw=="
 )
 
+// sampleIndex returns the sample tree with the header and checksum of the
+// index around it
+func sampleIndex() []byte {
+	items, _ := base64.StdEncoding.DecodeString(base64SampleTree)
+	b := make([]byte, headerSize, headerSize+len(items)+checksumSize)
+	copy(b, magic)
+	binary.BigEndian.PutUint32(b[magicSize:], version)
+	binary.BigEndian.PutUint64(b[magicSize+versionSize:], 4)
+	b = append(b, items...)
+	trailer := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(trailer, crc32.ChecksumIEEE(b))
+	return append(b, trailer...)
+}
+
 func TestWriteIndex(t *testing.T) {
 	at, expectedSerializedSize := getSampleTree()
 
@@ -26,37 +40,42 @@ func TestWriteIndex(t *testing.T) {
 	if b.Len() != expectedSerializedSize {
 		t.Fatalf("incorrect size of serialied index: expected %d, got: %d", expectedSerializedSize, b.Len())
 	}
-	sampleTreeBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
-	if !bytes.Equal(b.Bytes(), sampleTreeBytes) {
+	if !bytes.Equal(b.Bytes(), sampleIndex()) {
 		t.Fatalf("unexpected serialization of the tree")
 	}
 }
 
 func TestReadIndex(t *testing.T) {
-	sampleTreeBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
-	b := bytes.NewBuffer(sampleTreeBytes)
+	b := bytes.NewBuffer(sampleIndex())
 
-	at := art.New()
+	at := NewTree()
 	err := readIndex(b, at, 1024)
 	if err != nil {
 		t.Fatalf("error while deserializing correct sample tree: %v", err)
 	}
 
 	atsample, _ := getSampleTree()
-	if atsample.Size() != at.Size() {
-		t.Fatalf("trees aren't the same size, expected %v, got %v", atsample.Size(), at.Size())
+	if atsample.Len() != at.Len() {
+		t.Fatalf("trees aren't the same size, expected %v, got %v", atsample.Len(), at.Len())
 	}
-	atsample.ForEach(func(node art.Node) bool {
-		_, found := at.Search(node.Key())
+	atsample.ForEach(func(key []byte, item internal.Item) bool {
+		value, found, err := at.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
 		if !found {
-			t.Fatalf("expected node wasn't found: %s", node.Key())
+			t.Fatalf("expected node wasn't found: %s", key)
+		}
+		if value != item {
+			t.Fatalf("unexpected item for %s: expected %v, got %v", key, item, value)
 		}
 		return true
 	})
 }
 
 func TestReadCorruptedData(t *testing.T) {
-	sampleBytes, _ := base64.StdEncoding.DecodeString(base64SampleTree)
+	sampleBytes := sampleIndex()
+	itemSize := int32Size + 4 + fileIDSize + offsetSize + sizeSize
 
 	t.Run("truncated", func(t *testing.T) {
 		table := []struct {
@@ -64,18 +83,22 @@ func TestReadCorruptedData(t *testing.T) {
 			err  error
 			data []byte
 		}{
-			{name: "key-size-first-item", err: errTruncatedKeySize, data: sampleBytes[:2]},
-			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:6]},
-			{name: "key-size-second-item", err: errTruncatedKeySize, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+2]},
-			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:(int32Size+4+fileIDSize+offsetSize+sizeSize)+6]},
-			{name: "data", err: errTruncatedData, data: sampleBytes[:int32Size+4+(fileIDSize+offsetSize+sizeSize-3)]},
+			{name: "empty", err: errTruncatedHeader, data: nil},
+			{name: "header", err: errTruncatedHeader, data: sampleBytes[:headerSize-1]},
+			{name: "key-size-first-item", err: errTruncatedKeySize, data: sampleBytes[:headerSize+2]},
+			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:headerSize+6]},
+			{name: "key-size-second-item", err: errTruncatedKeySize, data: sampleBytes[:headerSize+itemSize+2]},
+			{name: "key-data-second-item", err: errTruncatedKeyData, data: sampleBytes[:headerSize+itemSize+6]},
+			{name: "data", err: errTruncatedData, data: sampleBytes[:headerSize+int32Size+4+(fileIDSize+offsetSize+sizeSize-3)]},
+			{name: "item-boundary", err: errTruncatedKeySize, data: sampleBytes[:headerSize+2*itemSize]},
+			{name: "checksum", err: errTruncatedTrailer, data: sampleBytes[:len(sampleBytes)-1]},
 		}
 
 		for i := range table {
 			t.Run(table[i].name, func(t *testing.T) {
 				bf := bytes.NewBuffer(table[i].data)
 
-				if err := readIndex(bf, art.New(), 1024); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
+				if err := readIndex(bf, NewTree(), 1024); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
 					t.Fatalf("expected %v, got %v", table[i].err, err)
 				}
 			})
@@ -85,11 +108,11 @@ func TestReadCorruptedData(t *testing.T) {
 	t.Run("overflow", func(t *testing.T) {
 		overflowKeySize := make([]byte, len(sampleBytes))
 		copy(overflowKeySize, sampleBytes)
-		binary.BigEndian.PutUint32(overflowKeySize, 1025)
+		binary.BigEndian.PutUint32(overflowKeySize[headerSize:], 1025)
 
 		overflowDataSize := make([]byte, len(sampleBytes))
 		copy(overflowDataSize, sampleBytes)
-		binary.BigEndian.PutUint32(overflowDataSize[int32Size+4+fileIDSize+offsetSize:], 1025)
+		binary.BigEndian.PutUint32(overflowDataSize[headerSize+int32Size+4+fileIDSize+offsetSize:], 1025)
 
 		table := []struct {
 			name       string
@@ -104,21 +127,67 @@ func TestReadCorruptedData(t *testing.T) {
 			t.Run(table[i].name, func(t *testing.T) {
 				bf := bytes.NewBuffer(table[i].data)
 
-				if err := readIndex(bf, art.New(), table[i].maxKeySize); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
+				if err := readIndex(bf, NewTree(), table[i].maxKeySize); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
 					t.Fatalf("expected %v, got %v", table[i].err, err)
 				}
 			})
 		}
 	})
 
+	t.Run("invalid", func(t *testing.T) {
+		modified := func(f func(b []byte) []byte) []byte {
+			b := make([]byte, len(sampleBytes))
+			copy(b, sampleBytes)
+			return f(b)
+		}
+
+		table := []struct {
+			name string
+			err  error
+			data []byte
+		}{
+			{name: "magic", err: errInvalidMagic, data: modified(func(b []byte) []byte {
+				b[0] = 'X'
+				return b
+			})},
+			{name: "version", err: errInvalidVersion, data: modified(func(b []byte) []byte {
+				binary.BigEndian.PutUint32(b[magicSize:], version+1)
+				return b
+			})},
+			{name: "count", err: errInvalidChecksum, data: modified(func(b []byte) []byte {
+				binary.BigEndian.PutUint64(b[magicSize+versionSize:], 3)
+				return b
+			})},
+			{name: "checksum", err: errInvalidChecksum, data: modified(func(b []byte) []byte {
+				b[headerSize+int32Size+4+fileIDSize] ^= 0xff
+				return b
+			})},
+			{name: "trailing-data", err: errTrailingData, data: modified(func(b []byte) []byte {
+				return append(b, 0)
+			})},
+			{name: "legacy", err: errInvalidMagic, data: modified(func(b []byte) []byte {
+				return b[headerSize : len(b)-checksumSize]
+			})},
+		}
+
+		for i := range table {
+			t.Run(table[i].name, func(t *testing.T) {
+				bf := bytes.NewBuffer(table[i].data)
+
+				if err := readIndex(bf, NewTree(), 1024); !IsIndexCorruption(err) || errors.Cause(err) != table[i].err {
+					t.Fatalf("expected %v, got %v", table[i].err, err)
+				}
+			})
+		}
+	})
 }
 
-func getSampleTree() (art.Tree, int) {
-	at := art.New()
+func getSampleTree() (Keydir, int) {
+	at := NewTree()
 	keys := [][]byte{[]byte("abcd"), []byte("abce"), []byte("abcf"), []byte("abgd")}
-	expectedSerializedSize := 0
+	expectedSerializedSize := headerSize + checksumSize
 	for i := range keys {
-		at.Insert(keys[i], internal.Item{FileID: i, Offset: int64(i), Size: int64(i)})
+		at.Put(keys[i], internal.Item{FileID: i, Offset: int64(i), Size: int64(i)})
 		expectedSerializedSize += int32Size + len(keys[i]) + fileIDSize + offsetSize + sizeSize
 	}
 
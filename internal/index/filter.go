@@ -0,0 +1,290 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+const (
+	// filterBitsPerKey and filterHashes give a false positive rate of about
+	// 1% to a filter holding as many keys as its capacity
+	filterBitsPerKey = 10
+	filterHashes     = 7
+	// minFilterCapacity is the capacity of the filter of an empty keydir
+	minFilterCapacity = 1024
+
+	// The saved filter starts with a header of the magic, the version of the
+	// format, the generation of the index it was saved with, the number of
+	// keys of the keydir and the number of layers. Every layer follows with
+	// its number of hashes, keys added, capacity and words of bits, then its
+	// bits, and the checksum of all of it ends the file. Version 1 filters
+	// only had a single layer, without the number of layers or words.
+	filterMagic      = "BCBF"
+	filterVersion    = uint32(2)
+	filterHeaderSize = magicSize + versionSize + 2*int64Size + int32Size
+)
+
+// Filter is a Bloom filter of the keys of a keydir, telling keys that are
+// definitely missing apart without looking them up. Keys can't be removed,
+// so deleted keys may still be reported as present until the filter is
+// rebuilt. It's not safe for concurrent use with Add.
+//
+// The filter grows as keys are added: once its last layer holds as many keys
+// as its capacity, a layer of twice the capacity is added for the keys added
+// next. Every layer spends more bits per key than the one before, so that the
+// false positive rate of all of them stays below about 2%.
+type Filter struct {
+	layers []*filterLayer
+}
+
+// filterLayer is a Bloom filter of a fixed capacity
+type filterLayer struct {
+	bits     []uint64
+	k        uint32
+	count    uint64
+	capacity uint64
+}
+
+// NewFilter returns an empty filter sized for capacity keys
+func NewFilter(capacity int) *Filter {
+	c := uint64(capacity)
+	if c < minFilterCapacity {
+		c = minFilterCapacity
+	}
+	return &Filter{layers: []*filterLayer{newFilterLayer(c, 0)}}
+}
+
+// newFilterLayer returns the empty nth layer of a filter, sized for capacity
+// keys. The false positive rate of each layer is about 40% of the previous.
+func newFilterLayer(capacity uint64, n int) *filterLayer {
+	bitsPerKey := uint64(filterBitsPerKey + 2*n)
+	return &filterLayer{
+		bits:     make([]uint64, (capacity*bitsPerKey+63)/64),
+		k:        uint32(filterHashes + n),
+		capacity: capacity,
+	}
+}
+
+// BuildFilter returns a filter of the keys of t with room for as many more
+func BuildFilter(t Keydir) (*Filter, error) {
+	f := NewFilter(2 * t.Len())
+	err := t.ForEach(func(key []byte, _ internal.Item) bool {
+		f.Add(key)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Add adds key to the filter
+func (f *Filter) Add(key []byte) {
+	l := f.layers[len(f.layers)-1]
+	if l.count >= l.capacity {
+		l = newFilterLayer(2*l.capacity, len(f.layers))
+		f.layers = append(f.layers, l)
+	}
+
+	h1, h2 := filterHash(key)
+	m := uint64(len(l.bits)) * 64
+	for i := uint64(0); i < uint64(l.k); i++ {
+		bit := (h1 + i*h2) % m
+		l.bits[bit/64] |= 1 << (bit % 64)
+	}
+	l.count++
+}
+
+// Has returns false if key was never added to the filter, and true if it may
+// have been
+func (f *Filter) Has(key []byte) bool {
+	h1, h2 := filterHash(key)
+	for _, l := range f.layers {
+		if l.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *filterLayer) has(h1, h2 uint64) bool {
+	m := uint64(len(l.bits)) * 64
+	for i := uint64(0); i < uint64(l.k); i++ {
+		bit := (h1 + i*h2) % m
+		if l.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Layers returns the number of layers of the filter, which is rebuilt into a
+// single one by BuildFilter
+func (f *Filter) Layers() int {
+	return len(f.layers)
+}
+
+// filterHash returns the two hashes of key the bits of the filter are
+// derived from
+func filterHash(key []byte) (uint64, uint64) {
+	// The FNV-1a hash is mixed with the finalizer of SplitMix64 so that all
+	// of its bits depend on all of the key
+	h := hashKey(key)
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	h ^= h >> 31
+	return h, h>>32 | 1
+}
+
+// LoadFilter loads the filter saved at path, returning the generation of the
+// index and the number of keys of the keydir it was saved with. Filters that
+// don't match their header or checksum fail with an index corruption error.
+func LoadFilter(fsys fs.FileSystem, path string) (*Filter, uint64, int, error) {
+	r, err := fs.Open(fsys, path)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if len(b) < magicSize+versionSize+2*int64Size+checksumSize {
+		return nil, 0, 0, errTruncatedHeader
+	}
+	if string(b[:magicSize]) != filterMagic {
+		return nil, 0, 0, errInvalidMagic
+	}
+	version := binary.BigEndian.Uint32(b[magicSize:])
+	if version != 1 && version != filterVersion {
+		return nil, 0, 0, errInvalidVersion
+	}
+	n := len(b) - checksumSize
+	if crc32.ChecksumIEEE(b[:n]) != binary.BigEndian.Uint32(b[n:]) {
+		return nil, 0, 0, errInvalidChecksum
+	}
+
+	body := b[magicSize+versionSize : n]
+	generation := binary.BigEndian.Uint64(body[0:])
+	keys := binary.BigEndian.Uint64(body[8:])
+	body = body[16:]
+
+	var f *Filter
+	if version == 1 {
+		f, err = loadFilterV1(body)
+	} else {
+		f, err = loadFilterLayers(body)
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return f, generation, int(keys), nil
+}
+
+// loadFilterV1 loads the single layer of a version 1 filter, which takes up
+// the rest of the body
+func loadFilterV1(body []byte) (*Filter, error) {
+	const layerHeaderSize = int32Size + 2*int64Size
+	if len(body) < layerHeaderSize {
+		return nil, errTruncatedData
+	}
+	l := &filterLayer{
+		k:        binary.BigEndian.Uint32(body[0:]),
+		count:    binary.BigEndian.Uint64(body[4:]),
+		capacity: binary.BigEndian.Uint64(body[12:]),
+	}
+	body = body[layerHeaderSize:]
+	if len(body)%int64Size != 0 || len(body) == 0 || l.k == 0 {
+		return nil, errTruncatedData
+	}
+	l.bits = readFilterBits(body, len(body)/int64Size)
+	return &Filter{layers: []*filterLayer{l}}, nil
+}
+
+// loadFilterLayers loads the layers of a filter
+func loadFilterLayers(body []byte) (*Filter, error) {
+	const layerHeaderSize = int32Size + 3*int64Size
+	if len(body) < int32Size {
+		return nil, errTruncatedData
+	}
+	layers := binary.BigEndian.Uint32(body)
+	body = body[int32Size:]
+	if layers == 0 {
+		return nil, errTruncatedData
+	}
+
+	f := &Filter{}
+	for i := uint32(0); i < layers; i++ {
+		if len(body) < layerHeaderSize {
+			return nil, errTruncatedData
+		}
+		l := &filterLayer{
+			k:        binary.BigEndian.Uint32(body[0:]),
+			count:    binary.BigEndian.Uint64(body[4:]),
+			capacity: binary.BigEndian.Uint64(body[12:]),
+		}
+		words := binary.BigEndian.Uint64(body[20:])
+		body = body[layerHeaderSize:]
+		if words == 0 || words > uint64(len(body)/int64Size) || l.k == 0 {
+			return nil, errTruncatedData
+		}
+		l.bits = readFilterBits(body, int(words))
+		body = body[words*int64Size:]
+		f.layers = append(f.layers, l)
+	}
+	if len(body) != 0 {
+		return nil, errTruncatedData
+	}
+	return f, nil
+}
+
+func readFilterBits(b []byte, words int) []uint64 {
+	bits := make([]uint64, words)
+	for i := range bits {
+		bits[i] = binary.BigEndian.Uint64(b[i*int64Size:])
+	}
+	return bits
+}
+
+// SaveFilter saves the filter at path with the generation of the index and
+// the number of keys of the keydir it's saved with
+func SaveFilter(fsys fs.FileSystem, f *Filter, generation uint64, keys int, path string) error {
+	size := filterHeaderSize + checksumSize
+	for _, l := range f.layers {
+		size += int32Size + 3*int64Size + len(l.bits)*int64Size
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(size)
+	buf.WriteString(filterMagic)
+	for _, v := range []interface{}{filterVersion, generation, uint64(keys), uint32(len(f.layers))} {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	for _, l := range f.layers {
+		for _, v := range []interface{}{l.k, l.count, l.capacity, uint64(len(l.bits)), l.bits} {
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+
+	file, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,94 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/faultfs"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+func TestFilter(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	k := NewHashMap()
+	for i := 0; i < 5000; i++ {
+		require.NoError(k.Put([]byte(fmt.Sprintf("key%d", i)), internal.Item{}))
+	}
+	build := func() *Filter {
+		f, err := BuildFilter(k)
+		require.NoError(err)
+		return f
+	}
+	f := build()
+	assert.Equal(1, f.Layers())
+
+	check := func(f *Filter, keys int) {
+		for i := 0; i < keys; i++ {
+			assert.True(f.Has([]byte(fmt.Sprintf("key%d", i))))
+		}
+		positives := 0
+		for i := 0; i < 10000; i++ {
+			if f.Has([]byte(fmt.Sprintf("missing%d", i))) {
+				positives++
+			}
+		}
+		assert.True(positives < 300, "%d false positives", positives)
+	}
+	check(f, 5000)
+
+	// The filter grows past its capacity keeping its false positive rate
+	for i := 5000; i < 100000; i++ {
+		f.Add([]byte(fmt.Sprintf("key%d", i)))
+	}
+	assert.True(f.Layers() > 1)
+	check(f, 100000)
+
+	t.Run("SaveLoad", func(t *testing.T) {
+		fsys := faultfs.New(1)
+		require.NoError(SaveFilter(fsys, build(), 3, k.Len(), "/filter"))
+
+		loaded, generation, keys, err := LoadFilter(fsys, "/filter")
+		require.NoError(err)
+		assert.Equal(uint64(3), generation)
+		assert.Equal(5000, keys)
+		check(loaded, 5000)
+
+		b, err := fs.ReadFile(fsys, "/filter")
+		require.NoError(err)
+		b[filterHeaderSize] ^= 0xff
+		require.NoError(fs.WriteFile(fsys, "/filter", b, 0600))
+		_, _, _, err = LoadFilter(fsys, "/filter")
+		assert.True(IsIndexCorruption(err))
+
+		require.NoError(SaveFilter(fsys, f, 4, 100000, "/filter"))
+		loaded, _, _, err = LoadFilter(fsys, "/filter")
+		require.NoError(err)
+		assert.Equal(f, loaded)
+
+		// Filters saved with a single layer by version 1 are still loaded
+		l := build().layers[0]
+		var buf bytes.Buffer
+		buf.WriteString(filterMagic)
+		for _, v := range []interface{}{uint32(1), uint64(3), uint64(k.Len()), l.k, l.count, l.capacity, l.bits} {
+			binary.Write(&buf, binary.BigEndian, v)
+		}
+		binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+		require.NoError(fs.WriteFile(fsys, "/filter", buf.Bytes(), 0600))
+		loaded, _, _, err = LoadFilter(fsys, "/filter")
+		require.NoError(err)
+		check(loaded, 5000)
+
+		_, _, _, err = LoadFilter(fsys, "/missing")
+		assert.True(os.IsNotExist(err))
+	})
+}
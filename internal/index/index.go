@@ -1,53 +1,185 @@
 package index
 
 import (
+	"bufio"
 	"os"
 
 	art "github.com/plar/go-adaptive-radix-tree"
 	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
-// Indexer is an interface for loading and saving the index (an Adaptive Radix Tree)
+// Indexer creates the keydir of the database and persists it as the index
+// of the database, which is loaded instead of replaying all the datafiles
+// when the database is opened
 type Indexer interface {
-	Load(path string, maxkeySize uint32) (art.Tree, bool, error)
-	Save(t art.Tree, path string) error
+	// New returns an empty keydir
+	New() (Keydir, error)
+	// Load loads the index saved at path, returning false if there is none
+	Load(fsys fs.FileSystem, path string, maxKeySize uint32) (Keydir, bool, error)
+	// Save saves the keydir as the index at path
+	Save(fsys fs.FileSystem, t Keydir, path string) error
+}
+
+// Updater is implemented by indexers that can apply the changes of the
+// datafiles written since the index was saved to it without loading it
+type Updater interface {
+	// Update writes the index saved at src with the changes of delta applied
+	// to dst, see Update
+	Update(fsys fs.FileSystem, src, dst string, maxKeySize uint32, delta art.Tree) error
 }
 
 // NewIndexer returns an instance of the default `Indexer` implemtnation
-// which perists the index (an Adaptive Radix Tree) as a binary blob on file
-func NewIndexer() Indexer {
-	return &indexer{}
+// which perists the keydirs created by newKeydir as a binary blob on file
+func NewIndexer(newKeydir func() Keydir) Indexer {
+	return &indexer{newKeydir: func() (Keydir, error) {
+		return newKeydir(), nil
+	}}
+}
+
+// NewSpillIndexer returns an instance of the default `Indexer` implementation
+// whose keydirs are spilled to scratch files in dir, see NewSpill
+func NewSpillIndexer(dir string, cacheSize int) Indexer {
+	return &indexer{newKeydir: func() (Keydir, error) {
+		return NewSpill(dir, cacheSize)
+	}}
 }
 
-type indexer struct{}
+type indexer struct {
+	newKeydir func() (Keydir, error)
+}
 
-func (i *indexer) Load(path string, maxKeySize uint32) (art.Tree, bool, error) {
-	t := art.New()
+func (i *indexer) New() (Keydir, error) {
+	return i.newKeydir()
+}
 
-	if !internal.Exists(path) {
+// Load loads the index saved at path. The keydir is only returned if there
+// is no error.
+func (i *indexer) Load(fsys fs.FileSystem, path string, maxKeySize uint32) (Keydir, bool, error) {
+	t, err := i.newKeydir()
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !internal.Exists(fsys, path) {
 		return t, false, nil
 	}
 
-	f, err := os.Open(path)
+	f, err := fs.Open(fsys, path)
 	if err != nil {
-		return t, true, err
+		Close(t)
+		return nil, true, err
 	}
 	defer f.Close()
 
-	if err := readIndex(f, t, maxKeySize); err != nil {
-		return t, true, err
+	if err := readIndex(bufio.NewReader(f), t, maxKeySize); err != nil {
+		Close(t)
+		return nil, true, err
 	}
 	return t, true, nil
 }
 
-func (i *indexer) Save(t art.Tree, path string) error {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+func (i *indexer) Save(fsys fs.FileSystem, t Keydir, path string) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	if err := writeIndex(t, w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+func (i *indexer) Update(fsys fs.FileSystem, src, dst string, maxKeySize uint32, delta art.Tree) error {
+	return Update(fsys, src, dst, maxKeySize, delta)
+}
+
+// Update writes the index saved at src with the changes of delta applied to
+// dst, a nil value in delta deletes its key. An empty src path stands for an
+// empty index. The index at src is streamed, only delta is held in memory.
+func Update(fsys fs.FileSystem, src, dst string, maxKeySize uint32, delta art.Tree) error {
+	// The first pass verifies src and counts the items of dst, which are
+	// written by the second one
+	existing := art.New()
+	count := uint64(0)
+	scan := func(f func(key []byte, item internal.Item) error) error {
+		if src == "" {
+			return nil
+		}
+		r, err := fs.Open(fsys, src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		return scanIndex(bufio.NewReader(r), maxKeySize, f)
+	}
+	err := scan(func(key []byte, item internal.Item) error {
+		value, found := delta.Search(key)
+		if found {
+			existing.Insert(key, nil)
+		}
+		if !found || value != nil {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	delta.ForEach(func(node art.Node) bool {
+		if _, found := existing.Search(node.Key()); !found && node.Value() != nil {
+			count++
+		}
+		return true
+	})
+
+	f, err := fsys.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	if err := writeIndex(t, f); err != nil {
+	w := bufio.NewWriter(f)
+	e, err := newEncoder(w, count)
+	if err != nil {
+		return err
+	}
+	err = scan(func(key []byte, item internal.Item) error {
+		if value, found := delta.Search(key); found {
+			if value == nil {
+				return nil
+			}
+			item = value.(internal.Item)
+		}
+		return e.encode(key, item)
+	})
+	if err != nil {
+		return err
+	}
+	delta.ForEach(func(node art.Node) bool {
+		if _, found := existing.Search(node.Key()); !found && node.Value() != nil {
+			err = e.encode(node.Key(), node.Value().(internal.Item))
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.close(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
 		return err
 	}
 
@@ -0,0 +1,71 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/faultfs"
+)
+
+func TestUpdate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	fsys := faultfs.New(1)
+	indexer := NewIndexer(NewTree)
+
+	at, _ := getSampleTree()
+	require.NoError(indexer.Save(fsys, at, "/index"))
+
+	delta := art.New()
+	delta.Insert([]byte("abcd"), nil)
+	delta.Insert([]byte("abce"), internal.Item{FileID: 5, Offset: 5, Size: 5})
+	delta.Insert([]byte("abcz"), internal.Item{FileID: 6, Offset: 6, Size: 6})
+	delta.Insert([]byte("abcy"), nil)
+
+	t.Run("Update", func(t *testing.T) {
+		require.NoError(Update(fsys, "/index", "/updated", 1024, delta))
+
+		updated, found, err := indexer.Load(fsys, "/updated", 1024)
+		require.NoError(err)
+		assert.True(found)
+		assert.Equal(4, updated.Len())
+
+		expected := map[string]internal.Item{
+			"abce": {FileID: 5, Offset: 5, Size: 5},
+			"abcf": {FileID: 2, Offset: 2, Size: 2},
+			"abgd": {FileID: 3, Offset: 3, Size: 3},
+			"abcz": {FileID: 6, Offset: 6, Size: 6},
+		}
+		for key, item := range expected {
+			value, found, err := updated.Get([]byte(key))
+			require.NoError(err)
+			if assert.True(found, key) {
+				assert.Equal(item, value)
+			}
+		}
+	})
+
+	t.Run("Empty", func(t *testing.T) {
+		require.NoError(Update(fsys, "", "/updated", 1024, delta))
+
+		updated, _, err := indexer.Load(fsys, "/updated", 1024)
+		require.NoError(err)
+		assert.Equal(2, updated.Len())
+	})
+
+	t.Run("Corrupted", func(t *testing.T) {
+		f, err := fsys.OpenFile("/index", os.O_WRONLY, 0600)
+		require.NoError(err)
+		require.NoError(f.Truncate(headerSize + 2))
+		require.NoError(f.Close())
+
+		err = Update(fsys, "/index", "/updated", 1024, delta)
+		assert.True(IsIndexCorruption(err))
+	})
+}
@@ -0,0 +1,69 @@
+package index
+
+import (
+	"math"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// item is the compact encoding of an internal.Item held by the keydirs, 12
+// bytes instead of 24. Items that don't fit, with an offset or size of 4GiB
+// or more, are held as internal.Items.
+type item struct {
+	fileID uint32
+	offset uint32
+	size   uint32
+}
+
+// packItem returns the compact encoding of it, or false if it doesn't fit
+func packItem(it internal.Item) (item, bool) {
+	if it.FileID < 0 || uint64(it.FileID) > math.MaxUint32 ||
+		it.Offset < 0 || it.Offset > math.MaxUint32 ||
+		it.Size < 0 || it.Size > math.MaxUint32 {
+		return item{}, false
+	}
+	return item{fileID: uint32(it.FileID), offset: uint32(it.Offset), size: uint32(it.Size)}, true
+}
+
+func (i item) unpack() internal.Item {
+	return internal.Item{FileID: int(i.fileID), Offset: int64(i.offset), Size: int64(i.size)}
+}
+
+// slabChunk is the number of items allocated together by a slab
+const slabChunk = 1024
+
+// slab allocates items in chunks. The values of the tree keydir are
+// interfaces, which hold a pointer as is but any other value, even an index
+// into the slab, allocated on its own. The tree holds pointers to the items
+// so that an item costs 12 bytes on top of the interface.
+type slab struct {
+	chunk []item
+	free  []*item
+	live  int
+}
+
+func (s *slab) alloc() *item {
+	s.live++
+	if n := len(s.free); n > 0 {
+		p := s.free[n-1]
+		s.free = s.free[:n-1]
+		return p
+	}
+	if len(s.chunk) == 0 {
+		s.chunk = make([]item, slabChunk)
+	}
+	p := &s.chunk[0]
+	s.chunk = s.chunk[1:]
+	return p
+}
+
+func (s *slab) release(p *item) {
+	s.live--
+	s.free = append(s.free, p)
+}
+
+// sparse returns true once most of the items allocated are free, the live
+// ones are then better moved to a new slab to release the chunks
+func (s *slab) sparse() bool {
+	return len(s.free) > slabChunk && len(s.free) > s.live
+}
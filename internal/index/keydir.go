@@ -0,0 +1,218 @@
+package index
+
+import (
+	"io"
+	"strings"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+// Keydir maps the keys of the database to the location of their live entry
+// in the datafiles. The database calls Get, Len, ForEach and ForEachPrefix
+// from any number of goroutines at once, so they must be safe to run
+// concurrently with each other. Put and Delete are only called by one
+// goroutine at a time, with no other method running.
+//
+// The errors returned are those of the storage of keydirs not held in
+// memory, such as running out of space for their scratch files.
+type Keydir interface {
+	// Get returns the item of the key, if found
+	Get(key []byte) (internal.Item, bool, error)
+	// Put sets the item of the key
+	Put(key []byte, item internal.Item) error
+	// Delete removes the key
+	Delete(key []byte) error
+	// Len returns the number of keys
+	Len() int
+	// ForEach calls f for every key until it returns false. The order of the
+	// keys is defined by the keydir.
+	ForEach(f func(key []byte, item internal.Item) bool) error
+	// ForEachPrefix calls f for every key with the given prefix until it
+	// returns false, in the same order as ForEach
+	ForEachPrefix(prefix []byte, f func(key []byte, item internal.Item) bool) error
+}
+
+// InMemory returns the number of keys of the keydir whose items are held in
+// memory, all of them unless it's spilled to disk and reports fewer with an
+// InMemory method
+func InMemory(t Keydir) int {
+	if s, ok := t.(interface{ InMemory() int }); ok {
+		return s.InMemory()
+	}
+	return t.Len()
+}
+
+// Close releases the resources held by the keydir if it's an io.Closer
+func Close(t Keydir) error {
+	if c, ok := t.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewTree returns a Keydir backed by an Adaptive Radix Tree, which visits
+// the keys in lexicographical order and scans prefixes efficiently
+func NewTree() Keydir {
+	return &tree{t: art.New()}
+}
+
+// tree holds pointers to compact items allocated from a slab
+type tree struct {
+	t    art.Tree
+	slab slab
+}
+
+func (t *tree) Get(key []byte) (internal.Item, bool, error) {
+	value, found := t.t.Search(key)
+	if !found {
+		return internal.Item{}, false, nil
+	}
+	return unpackValue(value), true, nil
+}
+
+func (t *tree) Put(key []byte, it internal.Item) error {
+	packed, ok := packItem(it)
+	if value, found := t.t.Search(key); found {
+		if p, isPacked := value.(*item); isPacked {
+			if ok {
+				*p = packed
+				return nil
+			}
+			t.slab.release(p)
+		}
+	}
+	if !ok {
+		t.t.Insert(key, it)
+		return nil
+	}
+	p := t.slab.alloc()
+	*p = packed
+	t.t.Insert(key, p)
+	return nil
+}
+
+func (t *tree) Delete(key []byte) error {
+	if value, deleted := t.t.Delete(key); deleted {
+		if p, isPacked := value.(*item); isPacked {
+			t.slab.release(p)
+			t.compact()
+		}
+	}
+	return nil
+}
+
+// compact moves the items to a new slab once the slab is sparse, as the
+// chunks of the items freed can't be released otherwise. The items moved
+// are at least as many as were freed, so its cost is amortized.
+func (t *tree) compact() {
+	if !t.slab.sparse() {
+		return
+	}
+	keys := make([]art.Key, 0, t.slab.live)
+	t.t.ForEach(func(node art.Node) bool {
+		if _, isPacked := node.Value().(*item); isPacked {
+			keys = append(keys, node.Key())
+		}
+		return true
+	})
+	var s slab
+	for _, key := range keys {
+		value, _ := t.t.Search(key)
+		p := s.alloc()
+		*p = *value.(*item)
+		t.t.Insert(key, p)
+	}
+	t.slab = s
+}
+
+func (t *tree) Len() int {
+	return t.t.Size()
+}
+
+func (t *tree) ForEach(f func(key []byte, item internal.Item) bool) error {
+	t.t.ForEach(func(node art.Node) bool {
+		return f(node.Key(), unpackValue(node.Value()))
+	})
+	return nil
+}
+
+func (t *tree) ForEachPrefix(prefix []byte, f func(key []byte, item internal.Item) bool) error {
+	t.t.ForEachPrefix(prefix, func(node art.Node) bool {
+		// Skip the root node
+		if len(node.Key()) == 0 {
+			return true
+		}
+		return f(node.Key(), unpackValue(node.Value()))
+	})
+	return nil
+}
+
+// unpackValue returns the item of a value of the tree
+func unpackValue(value art.Value) internal.Item {
+	if p, ok := value.(*item); ok {
+		return p.unpack()
+	}
+	return value.(internal.Item)
+}
+
+// NewHashMap returns a Keydir backed by a hash map, which has the fastest
+// point lookups but visits the keys in no particular order and has to visit
+// all of them to scan a prefix
+func NewHashMap() Keydir {
+	return &hashMap{items: map[string]item{}, large: map[string]internal.Item{}}
+}
+
+// hashMap holds compact items, and the items that don't fit apart
+type hashMap struct {
+	items map[string]item
+	large map[string]internal.Item
+}
+
+func (m *hashMap) Get(key []byte) (internal.Item, bool, error) {
+	if it, found := m.items[string(key)]; found {
+		return it.unpack(), true, nil
+	}
+	it, found := m.large[string(key)]
+	return it, found, nil
+}
+
+func (m *hashMap) Put(key []byte, it internal.Item) error {
+	if packed, ok := packItem(it); ok {
+		delete(m.large, string(key))
+		m.items[string(key)] = packed
+		return nil
+	}
+	delete(m.items, string(key))
+	m.large[string(key)] = it
+	return nil
+}
+
+func (m *hashMap) Delete(key []byte) error {
+	delete(m.items, string(key))
+	delete(m.large, string(key))
+	return nil
+}
+
+func (m *hashMap) Len() int {
+	return len(m.items) + len(m.large)
+}
+
+func (m *hashMap) ForEach(f func(key []byte, item internal.Item) bool) error {
+	return m.ForEachPrefix(nil, f)
+}
+
+func (m *hashMap) ForEachPrefix(prefix []byte, f func(key []byte, item internal.Item) bool) error {
+	for key, it := range m.items {
+		if strings.HasPrefix(key, string(prefix)) && !f([]byte(key), it.unpack()) {
+			return nil
+		}
+	}
+	for key, it := range m.large {
+		if strings.HasPrefix(key, string(prefix)) && !f([]byte(key), it) {
+			return nil
+		}
+	}
+	return nil
+}
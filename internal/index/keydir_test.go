@@ -0,0 +1,356 @@
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"syscall"
+	"testing"
+
+	art "github.com/plar/go-adaptive-radix-tree"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+func TestKeydir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keydir")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	newSpill := func() Keydir {
+		s, err := NewSpill(dir, 2)
+		require.NoError(t, err)
+		return s
+	}
+
+	keydirs := []struct {
+		name   string
+		new    func() Keydir
+		sorted bool
+	}{
+		{"Tree", NewTree, true},
+		{"HashMap", NewHashMap, false},
+		{"Spill", newSpill, false},
+	}
+
+	for _, kd := range keydirs {
+		kd := kd
+		t.Run(kd.name, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			k := kd.new()
+			for i, key := range []string{"foo", "bar", "foobar", "baz"} {
+				require.NoError(k.Put([]byte(key), internal.Item{FileID: i, Offset: int64(i), Size: int64(i)}))
+			}
+			require.NoError(k.Put([]byte("bar"), internal.Item{FileID: 5}))
+			require.NoError(k.Delete([]byte("baz")))
+			require.NoError(k.Delete([]byte("missing")))
+
+			assert.Equal(3, k.Len())
+			item, found, err := k.Get([]byte("bar"))
+			require.NoError(err)
+			assert.True(found)
+			assert.Equal(internal.Item{FileID: 5}, item)
+			_, found, err = k.Get([]byte("baz"))
+			require.NoError(err)
+			assert.False(found)
+
+			var keys []string
+			require.NoError(k.ForEach(func(key []byte, item internal.Item) bool {
+				keys = append(keys, string(key))
+				return true
+			}))
+			if !kd.sorted {
+				sort.Strings(keys)
+			}
+			assert.Equal([]string{"bar", "foo", "foobar"}, keys)
+
+			keys = nil
+			require.NoError(k.ForEachPrefix([]byte("foo"), func(key []byte, item internal.Item) bool {
+				keys = append(keys, string(key))
+				return true
+			}))
+			if !kd.sorted {
+				sort.Strings(keys)
+			}
+			assert.Equal([]string{"foo", "foobar"}, keys)
+
+			n := 0
+			require.NoError(k.ForEach(func(key []byte, item internal.Item) bool {
+				n++
+				return false
+			}))
+			assert.Equal(1, n)
+
+			// Items of offsets and sizes of 4GiB or more aren't compacted
+			large := internal.Item{FileID: 1, Offset: 1 << 33, Size: 1 << 32}
+			for _, item := range []internal.Item{large, {FileID: 1}, large} {
+				require.NoError(k.Put([]byte("large"), item))
+				value, found, err := k.Get([]byte("large"))
+				require.NoError(err)
+				assert.True(found)
+				assert.Equal(item, value)
+				assert.Equal(4, k.Len())
+			}
+			keys = nil
+			require.NoError(k.ForEachPrefix([]byte("l"), func(key []byte, item internal.Item) bool {
+				keys = append(keys, string(key))
+				assert.Equal(large, item)
+				return true
+			}))
+			assert.Equal([]string{"large"}, keys)
+			require.NoError(k.Delete([]byte("large")))
+			_, found, err = k.Get([]byte("large"))
+			require.NoError(err)
+			assert.False(found)
+			assert.Equal(3, k.Len())
+		})
+	}
+}
+
+func TestTreeItems(t *testing.T) {
+	const n = 100000
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key%08d", i*7919%n))
+	}
+
+	// heap returns the heap allocated and the number of allocations made
+	// by fill
+	heap := func(fill func()) (float64, float64) {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		fill()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		return float64(after.HeapAlloc - before.HeapAlloc), float64(after.Mallocs - before.Mallocs)
+	}
+
+	t.Run("Overhead", func(t *testing.T) {
+		// The tree holding nothing but its structure, as values of size
+		// zero aren't allocated
+		base := art.New()
+		baseBytes, baseAllocs := heap(func() {
+			for _, key := range keys {
+				base.Insert(key, struct{}{})
+			}
+		})
+		k := NewTree()
+		bytes, allocs := heap(func() {
+			for i, key := range keys {
+				require.NoError(t, k.Put(key, internal.Item{FileID: i / 1000, Offset: int64(i%1000) * 100, Size: 100}))
+			}
+		})
+		runtime.KeepAlive(base)
+		runtime.KeepAlive(k)
+
+		// An item costs its 12 bytes in the slab, an item held by the
+		// interface would be allocated on its own
+		perKey := (bytes - baseBytes) / n
+		assert.True(t, perKey > 0 && perKey < 14, "%.1f bytes per key", perKey)
+		assert.True(t, (allocs-baseAllocs)/n < 0.01, "%.2f allocations per key", (allocs-baseAllocs)/n)
+	})
+
+	t.Run("Compact", func(t *testing.T) {
+		k := NewTree().(*tree)
+		for i, key := range keys {
+			require.NoError(t, k.Put(key, internal.Item{FileID: i}))
+		}
+		for _, key := range keys[:n-n/10] {
+			require.NoError(t, k.Delete(key))
+		}
+
+		// The slab is compacted as soon as most of its items are free
+		assert.True(t, len(k.slab.free) <= k.slab.live, "%d free items", len(k.slab.free))
+		assert.Equal(t, n/10, k.slab.live)
+		assert.Equal(t, n/10, k.Len())
+		for i, key := range keys[n-n/10:] {
+			it, found, err := k.Get(key)
+			require.NoError(t, err)
+			assert.True(t, found)
+			assert.Equal(t, n-n/10+i, it.FileID)
+		}
+	})
+}
+
+func TestSpill(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "keydir")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	k, err := NewSpill(dir, 100)
+	require.NoError(err)
+
+	// Enough keys to grow the table and the key log, with deleted slots
+	const n = 20000
+	for i := 0; i < n; i++ {
+		require.NoError(k.Put([]byte(fmt.Sprintf("key%05d", i)), internal.Item{FileID: i, Offset: int64(i), Size: 1}))
+	}
+	for i := 0; i < n; i += 2 {
+		require.NoError(k.Delete([]byte(fmt.Sprintf("key%05d", i))))
+	}
+	for i := 0; i < n; i += 4 {
+		require.NoError(k.Put([]byte(fmt.Sprintf("key%05d", i)), internal.Item{FileID: i, Offset: int64(i), Size: 2}))
+	}
+	assert.Equal(n/2+n/4, k.Len())
+
+	for i := 0; i < n; i++ {
+		item, found, err := k.Get([]byte(fmt.Sprintf("key%05d", i)))
+		require.NoError(err)
+		switch {
+		case i%4 == 0:
+			assert.True(found)
+			assert.Equal(internal.Item{FileID: i, Offset: int64(i), Size: 2}, item)
+		case i%2 == 0:
+			assert.False(found)
+		default:
+			assert.True(found)
+			assert.Equal(internal.Item{FileID: i, Offset: int64(i), Size: 1}, item)
+		}
+	}
+
+	count := 0
+	require.NoError(k.ForEach(func(key []byte, item internal.Item) bool {
+		count++
+		return true
+	}))
+	assert.Equal(k.Len(), count)
+
+	t.Run("Cache", func(t *testing.T) {
+		// Only the most recently read keys are held in memory, and writes
+		// update them
+		assert.Equal(100, InMemory(k))
+		require.NoError(k.Put([]byte("key19999"), internal.Item{FileID: 1}))
+		item, found, err := k.Get([]byte("key19999"))
+		require.NoError(err)
+		assert.True(found)
+		assert.Equal(internal.Item{FileID: 1}, item)
+		require.NoError(k.Delete([]byte("key19999")))
+		_, found, err = k.Get([]byte("key19999"))
+		require.NoError(err)
+		assert.False(found)
+		assert.Equal(99, InMemory(k))
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		k, err := NewSpill(dir, 0)
+		require.NoError(err)
+		defer Close(k)
+		s := k.(*spill)
+		require.NoError(k.Put([]byte("foo"), internal.Item{FileID: 1}))
+
+		// Errors of the scratch files are returned, leaving the keydir as is
+		keys := s.keys
+		s.keys = &failingRegion{region: keys}
+		err = k.Put([]byte("bar"), internal.Item{FileID: 2})
+		assert.True(errors.Is(err, syscall.ENOSPC), err)
+		s.keys = keys
+		assert.Equal(1, k.Len())
+		_, found, err := k.Get([]byte("bar"))
+		require.NoError(err)
+		assert.False(found)
+
+		table := s.table
+		s.table = &failingRegion{region: table}
+		_, _, err = k.Get([]byte("foo"))
+		assert.True(errors.Is(err, syscall.EIO), err)
+		assert.Error(k.Delete([]byte("foo")))
+		assert.Error(k.ForEach(func(key []byte, item internal.Item) bool { return true }))
+		s.table = table
+
+		// Growing the table fails once its scratch files can't be created
+		s.dir = filepath.Join(dir, "missing")
+		for i := 0; err == nil; i++ {
+			err = k.Put([]byte(fmt.Sprintf("key%05d", i)), internal.Item{FileID: i})
+		}
+		assert.Error(err)
+		item, found, err := k.Get([]byte("foo"))
+		require.NoError(err)
+		assert.True(found)
+		assert.Equal(internal.Item{FileID: 1}, item)
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		require.NoError(Close(k))
+		assert.Equal(0, k.Len())
+		assert.Equal(0, InMemory(k))
+		_, found, err := k.Get([]byte("key00001"))
+		require.NoError(err)
+		assert.False(found)
+
+		files, err := ioutil.ReadDir(dir)
+		require.NoError(err)
+		assert.Empty(files)
+	})
+}
+
+// failingRegion is a region whose reads fail with EIO and whose writes fail
+// with ENOSPC
+type failingRegion struct {
+	region
+}
+
+func (r *failingRegion) ReadAt(b []byte, off int64) (int, error) {
+	return 0, syscall.EIO
+}
+
+func (r *failingRegion) WriteAt(b []byte, off int64) (int, error) {
+	return 0, syscall.ENOSPC
+}
+
+func (r *failingRegion) Grow(size int64) error {
+	return syscall.ENOSPC
+}
+
+// BenchmarkKeydirMemory reports the heap used per key by keydirs of 10M
+// keys of 16 bytes, run it with -benchtime=1x
+func BenchmarkKeydirMemory(b *testing.B) {
+	const n = 10000000
+
+	keydirs := []struct {
+		name string
+		new  func() Keydir
+	}{
+		{"Tree", NewTree},
+		{"HashMap", NewHashMap},
+	}
+
+	for _, kd := range keydirs {
+		kd := kd
+		b.Run(kd.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				k := kd.new()
+				for j := 0; j < n; j++ {
+					key := make([]byte, 16)
+					copy(key, "key:")
+					binary.BigEndian.PutUint64(key[8:], uint64(j)*7919%n)
+					if err := k.Put(key, internal.Item{FileID: j / 100000, Offset: int64(j%100000) * 100, Size: 100}); err != nil {
+						b.Fatal(err)
+					}
+				}
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/n, "bytes/key")
+				b.ReportMetric(float64(after.Mallocs-before.Mallocs)/n, "allocs/key")
+				runtime.KeepAlive(k)
+			}
+		})
+	}
+}
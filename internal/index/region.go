@@ -0,0 +1,16 @@
+package index
+
+import "io"
+
+// region is a scratch file of a keydir spilled to disk, which is mapped
+// into memory where supported. It's zero filled when grown and removed
+// when closed.
+type region interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	// Size returns the size of the region
+	Size() int64
+	// Grow grows the region to size
+	Grow(size int64) error
+}
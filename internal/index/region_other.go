@@ -0,0 +1,50 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package index
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+// fileRegion is a region read and written through its file, where files
+// can't be mapped into memory
+type fileRegion struct {
+	*os.File
+	size int64
+}
+
+func newRegion(dir, pattern string, size int64) (region, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &fileRegion{File: f}
+	if err := r.Grow(size); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *fileRegion) Size() int64 {
+	return r.size
+}
+
+func (r *fileRegion) Grow(size int64) error {
+	if err := r.Truncate(size); err != nil {
+		return err
+	}
+	r.size = size
+	return nil
+}
+
+func (r *fileRegion) Close() error {
+	err := r.File.Close()
+	if rerr := os.Remove(r.Name()); err == nil {
+		err = rerr
+	}
+	return err
+}
@@ -0,0 +1,92 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package index
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mappedRegion is a region mapped into memory. The file is unlinked once
+// created, so it's removed by the operating system when the region is
+// closed, even if the process crashes.
+type mappedRegion struct {
+	f    *os.File
+	data []byte
+}
+
+func newRegion(dir, pattern string, size int64) (region, error) {
+	f, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	r := &mappedRegion{f: f}
+	if err := r.Grow(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *mappedRegion) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off > int64(len(r.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, r.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *mappedRegion) WriteAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > int64(len(r.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(r.data[off:], b), nil
+}
+
+func (r *mappedRegion) Size() int64 {
+	return int64(len(r.data))
+}
+
+func (r *mappedRegion) Grow(size int64) error {
+	if err := r.unmap(); err != nil {
+		return err
+	}
+	if err := r.f.Truncate(size); err != nil {
+		return err
+	}
+	data, err := unix.Mmap(int(r.f.Fd()), 0, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return err
+	}
+	r.data = data
+	return nil
+}
+
+func (r *mappedRegion) unmap() error {
+	if r.data == nil {
+		return nil
+	}
+	data := r.data
+	r.data = nil
+	return unix.Munmap(data)
+}
+
+func (r *mappedRegion) Close() error {
+	err := r.unmap()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
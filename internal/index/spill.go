@@ -0,0 +1,486 @@
+package index
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/prologic/bitcask/internal"
+)
+
+const (
+	// slotSize is the size of a slot of the hash table of a spilled keydir:
+	// the hash of the key (8), the offset (8) and size (4) of the key in the
+	// key log and the item, its file id (4), offset (8) and size (8)
+	slotSize = 40
+	// minSlots is the number of slots of an empty hash table
+	minSlots = 1 << 12
+	// minKeyLog is the size of an empty key log
+	minKeyLog = 1 << 16
+	// deleted is the key size of a deleted slot, an empty slot has none
+	deleted = math.MaxUint32
+)
+
+// NewSpill returns a Keydir keeping its items in an open addressing hash
+// table spilled to scratch files in dir, mapped into memory where supported
+// so that the operating system pages it in and out as needed. The items of
+// up to cacheSize of the most recently read keys are also held in memory.
+//
+// The keys are visited in no particular order, and the table is rebuilt when
+// it grows. The scratch files are removed when the keydir is closed. They're
+// created with the os package rather than an fs.FileSystem of the database,
+// as they're mapped into memory.
+func NewSpill(dir string, cacheSize int) (Keydir, error) {
+	s := &spill{dir: dir, cache: newCache(cacheSize)}
+	if err := s.alloc(minSlots, minKeyLog); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// slot is a slot of the hash table of a spilled keydir
+type slot struct {
+	hash   uint64
+	keyOff int64
+	keyLen uint32
+	item   internal.Item
+}
+
+type spill struct {
+	dir string
+
+	// mu guards the hash table, Get and ForEach may run concurrently
+	mu       sync.RWMutex
+	table    region
+	keys     region
+	keysSize int64
+	slots    uint64
+	used     uint64
+	count    int
+
+	// cacheMu guards the cache, it's held with mu held
+	cacheMu sync.Mutex
+	cache   *cache
+}
+
+// alloc allocates an empty hash table of n slots and a key log of the given
+// size
+func (s *spill) alloc(n uint64, keyLog int64) error {
+	table, err := newRegion(s.dir, "keydir-table-", int64(n*slotSize))
+	if err != nil {
+		return err
+	}
+	keys, err := newRegion(s.dir, "keydir-keys-", keyLog)
+	if err != nil {
+		table.Close()
+		return err
+	}
+	s.table, s.keys = table, keys
+	s.keysSize, s.slots, s.used, s.count = 0, n, 0, 0
+	return nil
+}
+
+func (s *spill) Get(key []byte) (internal.Item, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.table == nil {
+		return internal.Item{}, false, nil
+	}
+
+	s.cacheMu.Lock()
+	item, found := s.cache.get(key)
+	s.cacheMu.Unlock()
+	if found {
+		return item, true, nil
+	}
+
+	_, sl, found, err := s.lookup(key, hashKey(key))
+	if err != nil || !found {
+		return internal.Item{}, false, err
+	}
+	s.cacheMu.Lock()
+	s.cache.put(key, sl.item)
+	s.cacheMu.Unlock()
+	return sl.item, true, nil
+}
+
+func (s *spill) Put(key []byte, item internal.Item) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.table == nil {
+		return nil
+	}
+
+	// Deleted slots are kept to not break probe sequences, so they count
+	// towards the load of the table. It's rehashed before the slot is used
+	// so that the keydir is left as is on errors.
+	if (s.used+1)*10 >= s.slots*7 {
+		if err := s.rehash(); err != nil {
+			return err
+		}
+	}
+
+	h := hashKey(key)
+	i, sl, found, err := s.lookup(key, h)
+	if err != nil {
+		return err
+	}
+	empty := sl.keyLen == 0
+	if !found {
+		off, err := s.appendKey(key)
+		if err != nil {
+			return err
+		}
+		sl = slot{hash: h, keyOff: off, keyLen: uint32(len(key))}
+	}
+	sl.item = item
+	if err := s.writeSlot(i, sl); err != nil {
+		return err
+	}
+	if !found {
+		if empty {
+			s.used++
+		}
+		s.count++
+	}
+
+	s.cacheMu.Lock()
+	s.cache.update(key, item)
+	s.cacheMu.Unlock()
+	return nil
+}
+
+func (s *spill) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.table == nil {
+		return nil
+	}
+
+	i, sl, found, err := s.lookup(key, hashKey(key))
+	if err != nil || !found {
+		return err
+	}
+	sl.keyLen = deleted
+	if err := s.writeSlot(i, sl); err != nil {
+		return err
+	}
+	s.count--
+
+	s.cacheMu.Lock()
+	s.cache.remove(key)
+	s.cacheMu.Unlock()
+	return nil
+}
+
+func (s *spill) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.count
+}
+
+func (s *spill) ForEach(f func(key []byte, item internal.Item) bool) error {
+	return s.ForEachPrefix(nil, f)
+}
+
+func (s *spill) ForEachPrefix(prefix []byte, f func(key []byte, item internal.Item) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.table == nil {
+		return nil
+	}
+
+	for i := uint64(0); i < s.slots; i++ {
+		sl, err := s.readSlot(i)
+		if err != nil {
+			return err
+		}
+		if sl.keyLen == 0 || sl.keyLen == deleted {
+			continue
+		}
+		key, err := s.readKey(sl)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		if !f(key, sl.item) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// InMemory returns the number of keys whose items are cached in memory
+func (s *spill) InMemory() int {
+	s.cacheMu.Lock()
+	defer s.cacheMu.Unlock()
+	return s.cache.len()
+}
+
+// Close removes the scratch files of the keydir, which is empty afterwards
+func (s *spill) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.table == nil {
+		return nil
+	}
+
+	err := s.table.Close()
+	if kerr := s.keys.Close(); err == nil {
+		err = kerr
+	}
+	s.table, s.keys, s.count = nil, nil, 0
+
+	s.cacheMu.Lock()
+	s.cache = newCache(s.cache.size)
+	s.cacheMu.Unlock()
+	return err
+}
+
+// lookup returns the index of the slot of key and true if found. Otherwise
+// it returns the index of the slot key should be inserted into, the first
+// deleted or empty slot of its probe sequence, and false.
+func (s *spill) lookup(key []byte, h uint64) (uint64, slot, bool, error) {
+	var (
+		free    slot
+		freeIdx uint64
+		hasFree bool
+	)
+	mask := s.slots - 1
+	for i := h & mask; ; i = (i + 1) & mask {
+		sl, err := s.readSlot(i)
+		if err != nil {
+			return 0, slot{}, false, err
+		}
+		switch {
+		case sl.keyLen == 0:
+			if hasFree {
+				return freeIdx, free, false, nil
+			}
+			return i, sl, false, nil
+		case sl.keyLen == deleted:
+			if !hasFree {
+				free, freeIdx, hasFree = sl, i, true
+			}
+		case sl.hash == h && int(sl.keyLen) == len(key):
+			k, err := s.readKey(sl)
+			if err != nil {
+				return 0, slot{}, false, err
+			}
+			if bytes.Equal(k, key) {
+				return i, sl, true, nil
+			}
+		}
+	}
+}
+
+// rehash moves the live keys to a new hash table sized for them, dropping
+// the deleted slots and the keys they referenced. The table is left as is
+// if it fails.
+func (s *spill) rehash() error {
+	n := uint64(minSlots)
+	for uint64(s.count)*20 > n*7 {
+		n *= 2
+	}
+	var live int64
+	for i := uint64(0); i < s.slots; i++ {
+		sl, err := s.readSlot(i)
+		if err != nil {
+			return err
+		}
+		if sl.keyLen != 0 && sl.keyLen != deleted {
+			live += int64(sl.keyLen)
+		}
+	}
+
+	r := &spill{dir: s.dir}
+	if err := r.alloc(n, live+minKeyLog); err != nil {
+		return fmt.Errorf("error rehashing spilled keydir: %w", err)
+	}
+	if err := s.copyTo(r); err != nil {
+		r.table.Close()
+		r.keys.Close()
+		return fmt.Errorf("error rehashing spilled keydir: %w", err)
+	}
+
+	s.table.Close()
+	s.keys.Close()
+	s.table, s.keys = r.table, r.keys
+	s.keysSize, s.slots, s.used, s.count = r.keysSize, r.slots, r.used, r.count
+	return nil
+}
+
+// copyTo inserts the live keys into the empty hash table of r
+func (s *spill) copyTo(r *spill) error {
+	mask := r.slots - 1
+	for i := uint64(0); i < s.slots; i++ {
+		sl, err := s.readSlot(i)
+		if err != nil {
+			return err
+		}
+		if sl.keyLen == 0 || sl.keyLen == deleted {
+			continue
+		}
+		key, err := s.readKey(sl)
+		if err != nil {
+			return err
+		}
+		j := sl.hash & mask
+		for {
+			next, err := r.readSlot(j)
+			if err != nil {
+				return err
+			}
+			if next.keyLen == 0 {
+				break
+			}
+			j = (j + 1) & mask
+		}
+		if sl.keyOff, err = r.appendKey(key); err != nil {
+			return err
+		}
+		if err := r.writeSlot(j, sl); err != nil {
+			return err
+		}
+		r.used++
+		r.count++
+	}
+	return nil
+}
+
+// appendKey appends key to the key log, growing it as needed, and returns
+// its offset
+func (s *spill) appendKey(key []byte) (int64, error) {
+	off := s.keysSize
+	if size := s.keys.Size(); off+int64(len(key)) > size {
+		size *= 2
+		if size < off+int64(len(key)) {
+			size = off + int64(len(key))
+		}
+		if err := s.keys.Grow(size); err != nil {
+			return 0, fmt.Errorf("error growing spilled keydir: %w", err)
+		}
+	}
+	if _, err := s.keys.WriteAt(key, off); err != nil {
+		return 0, fmt.Errorf("error writing spilled keydir: %w", err)
+	}
+	s.keysSize += int64(len(key))
+	return off, nil
+}
+
+func (s *spill) readKey(sl slot) ([]byte, error) {
+	key := make([]byte, sl.keyLen)
+	if _, err := s.keys.ReadAt(key, sl.keyOff); err != nil {
+		return nil, fmt.Errorf("error reading spilled keydir: %w", err)
+	}
+	return key, nil
+}
+
+func (s *spill) readSlot(i uint64) (slot, error) {
+	var buf [slotSize]byte
+	if _, err := s.table.ReadAt(buf[:], int64(i*slotSize)); err != nil {
+		return slot{}, fmt.Errorf("error reading spilled keydir: %w", err)
+	}
+	return slot{
+		hash:   binary.BigEndian.Uint64(buf[0:8]),
+		keyOff: int64(binary.BigEndian.Uint64(buf[8:16])),
+		keyLen: binary.BigEndian.Uint32(buf[16:20]),
+		item: internal.Item{
+			FileID: int(binary.BigEndian.Uint32(buf[20:24])),
+			Offset: int64(binary.BigEndian.Uint64(buf[24:32])),
+			Size:   int64(binary.BigEndian.Uint64(buf[32:40])),
+		},
+	}, nil
+}
+
+func (s *spill) writeSlot(i uint64, sl slot) error {
+	var buf [slotSize]byte
+	binary.BigEndian.PutUint64(buf[0:8], sl.hash)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(sl.keyOff))
+	binary.BigEndian.PutUint32(buf[16:20], sl.keyLen)
+	binary.BigEndian.PutUint32(buf[20:24], uint32(sl.item.FileID))
+	binary.BigEndian.PutUint64(buf[24:32], uint64(sl.item.Offset))
+	binary.BigEndian.PutUint64(buf[32:40], uint64(sl.item.Size))
+	if _, err := s.table.WriteAt(buf[:], int64(i*slotSize)); err != nil {
+		return fmt.Errorf("error writing spilled keydir: %w", err)
+	}
+	return nil
+}
+
+// hashKey returns the 64-bit FNV-1a hash of key
+func hashKey(key []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// cache is a least recently used cache of the items of keys
+type cache struct {
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	item internal.Item
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *cache) get(key []byte) (internal.Item, bool) {
+	e, found := c.items[string(key)]
+	if !found {
+		return internal.Item{}, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*cacheEntry).item, true
+}
+
+// put caches the item of key, evicting the least recently used key if full
+func (c *cache) put(key []byte, item internal.Item) {
+	if c.size <= 0 {
+		return
+	}
+	if c.update(key, item) {
+		return
+	}
+	if c.ll.Len() >= c.size {
+		e := c.ll.Back()
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+	c.items[string(key)] = c.ll.PushFront(&cacheEntry{key: string(key), item: item})
+}
+
+// update updates the item of key if it's cached, returning true if so
+func (c *cache) update(key []byte, item internal.Item) bool {
+	e, found := c.items[string(key)]
+	if !found {
+		return false
+	}
+	e.Value.(*cacheEntry).item = item
+	c.ll.MoveToFront(e)
+	return true
+}
+
+func (c *cache) remove(key []byte) {
+	if e, found := c.items[string(key)]; found {
+		c.ll.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *cache) len() int {
+	return c.ll.Len()
+}
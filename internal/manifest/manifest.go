@@ -0,0 +1,69 @@
+package manifest
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
+)
+
+// Manifest records the datafiles that make up the database. It is the only
+// source of truth for which datafiles are live: any other datafile found in
+// the database directory is ignored.
+type Manifest struct {
+	// Datafiles lists the ids of all live datafiles including the active one
+	Datafiles []int `json:"datafiles"`
+	// Active is the id of the active datafile
+	Active int `json:"active"`
+	// IndexGeneration is incremented every time the index is saved, zero
+	// means there is no valid index for these datafiles
+	IndexGeneration uint64 `json:"index_generation"`
+	// IndexDatafile is the id of the first datafile the saved index may miss
+	// entries of, it and all later datafiles are replayed loading the index
+	IndexDatafile int `json:"index_datafile"`
+}
+
+// Add adds the datafile id to the live datafiles
+func (m *Manifest) Add(id int) {
+	for _, i := range m.Datafiles {
+		if i == id {
+			return
+		}
+	}
+	m.Datafiles = append(m.Datafiles, id)
+	sort.Ints(m.Datafiles)
+}
+
+// Remove removes the datafile id from the live datafiles
+func (m *Manifest) Remove(id int) {
+	for i := range m.Datafiles {
+		if m.Datafiles[i] == id {
+			m.Datafiles = append(m.Datafiles[:i], m.Datafiles[i+1:]...)
+			return
+		}
+	}
+}
+
+// Save atomically replaces the manifest stored at path
+func (m *Manifest) Save(fsys fs.FileSystem, path string, mode os.FileMode) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return internal.WriteFileAtomic(fsys, path, data, mode)
+}
+
+// Load loads the manifest stored at path
+func Load(fsys fs.FileSystem, path string) (*Manifest, error) {
+	m := Manifest{IndexDatafile: -1}
+	err := internal.LoadFromJsonFile(fsys, path, &m)
+	if m.IndexDatafile < 0 {
+		// Manifests saved before checkpoints had the index saved every time
+		// the active datafile was sealed
+		m.IndexDatafile = m.Active
+	}
+	return &m, err
+}
@@ -2,21 +2,47 @@ package metadata
 
 import (
 	"os"
+	"sort"
 
 	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 type MetaData struct {
 	IndexUpToDate    bool  `json:"index_up_to_date"`
 	ReclaimableSpace int64 `json:"reclaimable_space"`
+
+	// CleanDatafiles lists the sorted ids of the sealed datafiles known to
+	// hold only intact entries, which auto recovery doesn't check
+	CleanDatafiles []int `json:"clean_datafiles,omitempty"`
+}
+
+// IsClean returns true if the datafile id is marked clean
+func (m *MetaData) IsClean(id int) bool {
+	i := sort.SearchInts(m.CleanDatafiles, id)
+	return i < len(m.CleanDatafiles) && m.CleanDatafiles[i] == id
+}
+
+// MarkClean marks the datafile id clean, or not
+func (m *MetaData) MarkClean(id int, clean bool) {
+	i := sort.SearchInts(m.CleanDatafiles, id)
+	found := i < len(m.CleanDatafiles) && m.CleanDatafiles[i] == id
+	switch {
+	case clean && !found:
+		m.CleanDatafiles = append(m.CleanDatafiles, 0)
+		copy(m.CleanDatafiles[i+1:], m.CleanDatafiles[i:])
+		m.CleanDatafiles[i] = id
+	case !clean && found:
+		m.CleanDatafiles = append(m.CleanDatafiles[:i], m.CleanDatafiles[i+1:]...)
+	}
 }
 
-func (m *MetaData) Save(path string, mode os.FileMode) error {
-	return internal.SaveJsonToFile(m, path, mode)
+func (m *MetaData) Save(fsys fs.FileSystem, path string, mode os.FileMode) error {
+	return internal.SaveJsonToFile(fsys, m, path, mode)
 }
 
-func Load(path string) (*MetaData, error) {
+func Load(fsys fs.FileSystem, path string) (*MetaData, error) {
 	var m MetaData
-	err := internal.LoadFromJsonFile(path, &m)
+	err := internal.LoadFromJsonFile(fsys, path, &m)
 	return &m, err
 }
@@ -24,6 +24,20 @@ func (_m *Datafile) Close() error {
 	return r0
 }
 
+// Datasync provides a mock function with given fields:
+func (_m *Datafile) Datasync() error {
+	ret := _m.Called()
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func() error); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // FileID provides a mock function with given fields:
 func (_m *Datafile) FileID() int {
 	ret := _m.Called()
@@ -52,6 +66,20 @@ func (_m *Datafile) Name() string {
 	return r0
 }
 
+// Preallocate provides a mock function with given fields: size
+func (_m *Datafile) Preallocate(size int64) error {
+	ret := _m.Called(size)
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(int64) error); ok {
+		r0 = rf(size)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
 // Read provides a mock function with given fields:
 func (_m *Datafile) Read() (internal.Entry, int64, error) {
 	ret := _m.Called()
@@ -2,7 +2,8 @@
 
 package mocks
 
-import art "github.com/plar/go-adaptive-radix-tree"
+import fs "github.com/prologic/bitcask/internal/fs"
+import index "github.com/prologic/bitcask/internal/index"
 
 import mock "github.com/stretchr/testify/mock"
 
@@ -11,29 +12,29 @@ type Indexer struct {
 	mock.Mock
 }
 
-// Load provides a mock function with given fields: path, maxkeySize
-func (_m *Indexer) Load(path string, maxkeySize uint32) (art.Tree, bool, error) {
-	ret := _m.Called(path, maxkeySize)
+// Load provides a mock function with given fields: fsys, path, maxKeySize
+func (_m *Indexer) Load(fsys fs.FileSystem, path string, maxKeySize uint32) (index.Keydir, bool, error) {
+	ret := _m.Called(fsys, path, maxKeySize)
 
-	var r0 art.Tree
-	if rf, ok := ret.Get(0).(func(string, uint32) art.Tree); ok {
-		r0 = rf(path, maxkeySize)
+	var r0 index.Keydir
+	if rf, ok := ret.Get(0).(func(fs.FileSystem, string, uint32) index.Keydir); ok {
+		r0 = rf(fsys, path, maxKeySize)
 	} else {
 		if ret.Get(0) != nil {
-			r0 = ret.Get(0).(art.Tree)
+			r0 = ret.Get(0).(index.Keydir)
 		}
 	}
 
 	var r1 bool
-	if rf, ok := ret.Get(1).(func(string, uint32) bool); ok {
-		r1 = rf(path, maxkeySize)
+	if rf, ok := ret.Get(1).(func(fs.FileSystem, string, uint32) bool); ok {
+		r1 = rf(fsys, path, maxKeySize)
 	} else {
 		r1 = ret.Get(1).(bool)
 	}
 
 	var r2 error
-	if rf, ok := ret.Get(2).(func(string, uint32) error); ok {
-		r2 = rf(path, maxkeySize)
+	if rf, ok := ret.Get(2).(func(fs.FileSystem, string, uint32) error); ok {
+		r2 = rf(fsys, path, maxKeySize)
 	} else {
 		r2 = ret.Error(2)
 	}
@@ -41,13 +42,36 @@ func (_m *Indexer) Load(path string, maxkeySize uint32) (art.Tree, bool, error)
 	return r0, r1, r2
 }
 
-// Save provides a mock function with given fields: t, path
-func (_m *Indexer) Save(t art.Tree, path string) error {
-	ret := _m.Called(t, path)
+// New provides a mock function with given fields:
+func (_m *Indexer) New() (index.Keydir, error) {
+	ret := _m.Called()
+
+	var r0 index.Keydir
+	if rf, ok := ret.Get(0).(func() index.Keydir); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(index.Keydir)
+		}
+	}
+
+	var r1 error
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// Save provides a mock function with given fields: fsys, t, path
+func (_m *Indexer) Save(fsys fs.FileSystem, t index.Keydir, path string) error {
+	ret := _m.Called(fsys, t, path)
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(art.Tree, string) error); ok {
-		r0 = rf(t, path)
+	if rf, ok := ret.Get(0).(func(fs.FileSystem, index.Keydir, string) error); ok {
+		r0 = rf(fsys, t, path)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -2,26 +2,30 @@ package internal
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+
+	"github.com/prologic/bitcask/internal/fs"
 )
 
-// Exists returns `true` if the given `path` on the current file system exists
-func Exists(path string) bool {
-	_, err := os.Stat(path)
+// Exists returns `true` if the given `path` on the file system exists
+func Exists(fsys fs.FileSystem, path string) bool {
+	_, err := fsys.Stat(path)
 	return err == nil
 }
 
-// DirSize returns the space occupied by the given `path` on disk on the current
+// DirSize returns the space occupied by the given `path` on disk on the
 // file system.
-func DirSize(path string) (int64, error) {
+func DirSize(fsys fs.FileSystem, path string) (int64, error) {
 	var size int64
-	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+	err := fs.Walk(fsys, path, func(p string, info os.FileInfo, err error) error {
+		// Files removed while walking, e.g. by a merge, are skipped
+		if os.IsNotExist(err) && p != path {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
@@ -37,11 +41,20 @@ func DirSize(path string) (int64, error) {
 // given by `path`. All datafiles are identified by the the glob `*.data` and
 // the basename is represented by a monotonic increasing integer.
 // The returned files are *sorted* in increasing order.
-func GetDatafiles(path string) ([]string, error) {
-	fns, err := filepath.Glob(fmt.Sprintf("%s/*.data", path))
+func GetDatafiles(fsys fs.FileSystem, path string) ([]string, error) {
+	infos, err := fsys.ReadDir(path)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
+	var fns []string
+	for _, info := range infos {
+		if matched, _ := filepath.Match("*.data", info.Name()); matched {
+			fns = append(fns, filepath.Join(path, info.Name()))
+		}
+	}
 	sort.Strings(fns)
 	return fns, nil
 }
@@ -66,9 +79,12 @@ func ParseIds(fns []string) ([]int, error) {
 	return ids, nil
 }
 
-// Copy copies source contents to destination
-func Copy(src, dst string, exclude []string) error {
-	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+// Copy copies source contents on srcFS to destination on dstFS
+func Copy(srcFS fs.FileSystem, src string, dstFS fs.FileSystem, dst string, exclude []string) error {
+	return fs.Walk(srcFS, src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		relPath := strings.Replace(path, src, "", 1)
 		if relPath == "" {
 			return nil
@@ -83,28 +99,72 @@ func Copy(src, dst string, exclude []string) error {
 			}
 		}
 		if info.IsDir() {
-			return os.Mkdir(filepath.Join(dst, relPath), info.Mode())
+			return dstFS.Mkdir(filepath.Join(dst, relPath), info.Mode())
 		}
-		var data, err1 = ioutil.ReadFile(filepath.Join(src, relPath))
+		var data, err1 = fs.ReadFile(srcFS, filepath.Join(src, relPath))
 		if err1 != nil {
 			return err1
 		}
-		return ioutil.WriteFile(filepath.Join(dst, relPath), data, info.Mode())
+		return fs.WriteFile(dstFS, filepath.Join(dst, relPath), data, info.Mode())
 	})
 }
 
-// SaveJsonToFile converts v into json and store in file identified by path
-func SaveJsonToFile(v interface{}, path string, mode os.FileMode) error {
+// SaveJsonToFile converts v into json and atomically replaces the file
+// identified by path with it
+func SaveJsonToFile(fsys fs.FileSystem, v interface{}, path string, mode os.FileMode) error {
 	b, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(path, b, mode)
+	return WriteFileAtomic(fsys, path, b, mode)
+}
+
+// WriteFileAtomic replaces the file identified by path with data, such that
+// after a crash the file has either its old or its new contents. It writes
+// to a temporary file which is synced and renamed over the file.
+func WriteFileAtomic(fsys fs.FileSystem, path string, data []byte, mode os.FileMode) error {
+	tmp := path + ".tmp"
+	if err := WriteFileSync(fsys, tmp, data, mode); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmp, path); err != nil {
+		return err
+	}
+	return SyncDir(fsys, filepath.Dir(path))
+}
+
+// WriteFileSync writes data to the file identified by path and syncs it to
+// disk before returning
+func WriteFileSync(fsys fs.FileSystem, path string, data []byte, mode os.FileMode) error {
+	f, err := fsys.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// SyncDir syncs the directory identified by path so that renames and
+// removals of the files it contains are durable
+func SyncDir(fsys fs.FileSystem, path string) error {
+	d, err := fs.Open(fsys, path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
 
 // LoadFromJsonFile reads file located at `path` and put its content in json format in v
-func LoadFromJsonFile(path string, v interface{}) error {
-	b, err := ioutil.ReadFile(path)
+func LoadFromJsonFile(fsys fs.FileSystem, path string, v interface{}) error {
+	b, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return err
 	}
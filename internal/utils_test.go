@@ -8,6 +8,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 func Test_Copy(t *testing.T) {
@@ -42,11 +44,11 @@ func Test_Copy(t *testing.T) {
 		tempdst, err := ioutil.TempDir("", "backup")
 		assert.NoError(err)
 		defer os.RemoveAll(tempdst)
-		err = Copy(tempsrc, tempdst, []string{"file3"})
+		err = Copy(fs.OS, tempsrc, fs.OS, tempdst, []string{"file3"})
 		assert.NoError(err)
 		buf := make([]byte, 10)
 
-		exists := Exists(filepath.Join(tempdst, filepath.Base(tempdir)))
+		exists := Exists(fs.OS, filepath.Join(tempdst, filepath.Base(tempdir)))
 		assert.Equal(true, exists)
 
 		f, err = os.Open(filepath.Join(tempdst, "file1"))
@@ -69,7 +71,7 @@ func Test_Copy(t *testing.T) {
 		assert.Equal(io.EOF, err)
 		f.Close()
 
-		exists = Exists(filepath.Join(tempdst, "file3"))
+		exists = Exists(fs.OS, filepath.Join(tempdst, "file3"))
 		assert.Equal(false, exists)
 	})
 }
@@ -84,10 +86,10 @@ func Test_SaveAndLoad(t *testing.T) {
 			Value bool `json:"value"`
 		}
 		m := test{Value: true}
-		err = SaveJsonToFile(&m, filepath.Join(tempdir, "meta.json"), 0755)
+		err = SaveJsonToFile(fs.OS, &m, filepath.Join(tempdir, "meta.json"), 0755)
 		assert.NoError(err)
 		m1 := test{}
-		err = LoadFromJsonFile(filepath.Join(tempdir, "meta.json"), &m1)
+		err = LoadFromJsonFile(fs.OS, filepath.Join(tempdir, "meta.json"), &m1)
 		assert.NoError(err)
 		assert.Equal(m, m1)
 	})
@@ -99,10 +101,10 @@ func Test_SaveAndLoad(t *testing.T) {
 		type test struct {
 			Value bool `json:"value"`
 		}
-		err = SaveJsonToFile(make(chan int), filepath.Join(tempdir, "meta.json"), 0755)
+		err = SaveJsonToFile(fs.OS, make(chan int), filepath.Join(tempdir, "meta.json"), 0755)
 		assert.Error(err)
 		m1 := test{}
-		err = LoadFromJsonFile(filepath.Join(tempdir, "meta.json"), &m1)
+		err = LoadFromJsonFile(fs.OS, filepath.Join(tempdir, "meta.json"), &m1)
 		assert.Error(err)
 	})
 }
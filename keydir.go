@@ -0,0 +1,61 @@
+package bitcask
+
+import (
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// maxKeydirStripes bounds the number of stripes of the keydir lock
+const maxKeydirStripes = 64
+
+// keydirStripe is a read write lock padded to a cache line of its own, so
+// that readers of different stripes don't contend on the same cache line
+type keydirStripe struct {
+	sync.RWMutex
+	_ [64 - unsafe.Sizeof(sync.RWMutex{})%64]byte
+}
+
+// keydirLock is a read write lock striped so that concurrent readers scale
+// with the number of CPUs: readers only take the stripe of the key they look
+// up, writers take all of them. Writers are rare as they are serialized by
+// the write lock already.
+type keydirLock struct {
+	stripes []keydirStripe
+}
+
+func newKeydirLock() *keydirLock {
+	n := 1
+	for n < runtime.GOMAXPROCS(0) && n < maxKeydirStripes {
+		n *= 2
+	}
+	return &keydirLock{stripes: make([]keydirStripe, n)}
+}
+
+// Lock locks all the stripes for writing
+func (l *keydirLock) Lock() {
+	for i := range l.stripes {
+		l.stripes[i].Lock()
+	}
+}
+
+// Unlock unlocks all the stripes
+func (l *keydirLock) Unlock() {
+	for i := len(l.stripes) - 1; i >= 0; i-- {
+		l.stripes[i].Unlock()
+	}
+}
+
+// RLock locks the stripe of key for reading and returns it to be unlocked
+// with RUnlock. Readers not looking up a key pass a nil key.
+func (l *keydirLock) RLock(key []byte) *sync.RWMutex {
+	// FNV-1a
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	mu := &l.stripes[h&uint32(len(l.stripes)-1)].RWMutex
+	mu.RLock()
+	return mu
+}
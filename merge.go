@@ -0,0 +1,669 @@
+package bitcask
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/manifest"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	mergeDirPrefix = "merge"
+	mergeMarker    = "merge.json"
+)
+
+// mergeCheckpoint is called at every step of committing a merge. It is a
+// no-op outside of tests, which use it to simulate a crash at each step.
+var mergeCheckpoint = func(step string) {}
+
+// MergeOptions configures a merge started with MergeWithOptions
+type MergeOptions struct {
+	// Context cancels the merge when it is done. Chunks of datafiles that
+	// were already merged are kept.
+	Context context.Context
+
+	// RateLimit limits the number of bytes per second read from the
+	// datafiles being merged. Zero means no limit.
+	RateLimit int64
+
+	// Progress if not nil is called each time a chunk of datafiles has
+	// been merged.
+	Progress func(MergeProgress)
+}
+
+// MergeProgress reports the progress of a merge
+type MergeProgress struct {
+	Files      int   `json:"files"`
+	TotalFiles int   `json:"total_files"`
+	Bytes      int64 `json:"bytes"`
+	Keys       int   `json:"keys"`
+}
+
+// mergeState tracks the progress of a merge and throttles it
+type mergeState struct {
+	ctx       context.Context
+	rateLimit int64
+	start     time.Time
+	read      int64
+	progress  MergeProgress
+
+	// merged counts the chunks swapped in, partial is set while a chunk
+	// committed isn't fully swapped in, the keydir may not match the
+	// datafiles if it fails then
+	merged  int
+	partial bool
+}
+
+// throttle accounts for n bytes read by the merge, waiting as long as needed
+// to stay under the rate limit. It returns an error once the merge has been
+// cancelled.
+func (s *mergeState) throttle(n int64) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
+	}
+	s.read += n
+	if s.rateLimit <= 0 {
+		return nil
+	}
+
+	ahead := time.Duration(float64(s.read)/float64(s.rateLimit)*float64(time.Second)) - time.Since(s.start)
+	if ahead <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(ahead)
+	defer timer.Stop()
+	select {
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Merge merges all datafiles in the database. Old keys are squashed
+// and deleted keys removes. Duplicate key/value pairs are also removed.
+// Call this function periodically to reclaim disk space.
+//
+// Datafiles are merged incrementally, a chunk of at most MergeChunkSize
+// bytes at a time (configured with WithMergeChunkSize), and each merged
+// chunk replaces the datafiles it was merged from straight away. This bounds
+// the extra disk space needed by a merge to the size of a chunk. Each chunk
+// is installed atomically: if the process crashes part way through a merge,
+// the chunk is either rolled back or rolled forward the next time the
+// database is opened.
+//
+// Merge fails with ErrMergeInProgress if a merge is already running and with
+// ErrVerifyInProgress while the database is being verified.
+func (b *Bitcask) Merge() error {
+	return b.MergeWithOptions(MergeOptions{})
+}
+
+// MergeWithOptions merges all datafiles in the database like Merge, with
+// the given options to throttle it, report its progress or cancel it.
+func (b *Bitcask) MergeWithOptions(opts MergeOptions) error {
+	if b.config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	b.mu.Lock()
+	if b.isMerging {
+		b.mu.Unlock()
+		return ErrMergeInProgress
+	}
+	if b.verifying > 0 {
+		b.mu.Unlock()
+		return ErrVerifyInProgress
+	}
+	b.isMerging = true
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		b.isMerging = false
+		b.mu.Unlock()
+	}()
+	// The datafiles merged must not be replaced under a checkpoint being
+	// written, no other one starts while merging
+	b.waitCheckpoint()
+	b.mu.Lock()
+	err := b.closeCurrentFile()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	filesToMerge := make([]int, 0, len(b.datafiles))
+	for k := range b.datafiles {
+		filesToMerge = append(filesToMerge, k)
+	}
+	err = b.openNewWritableFile()
+	if err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	sort.Ints(filesToMerge)
+	chunks := b.mergeChunks(filesToMerge)
+	b.mu.Unlock()
+
+	state := &mergeState{
+		ctx:       ctx,
+		rateLimit: opts.RateLimit,
+		start:     time.Now(),
+		progress:  MergeProgress{TotalFiles: len(filesToMerge)},
+	}
+	for _, chunk := range chunks {
+		if err := b.mergeChunk(chunk, state); err != nil {
+			// The index removed by the chunks already swapped in is saved
+			// again, unless the keydir no longer matches the datafiles
+			if state.merged > 0 && !state.partial {
+				b.mu.Lock()
+				if serr := b.saveMergedIndex(); serr != nil {
+					err = fmt.Errorf("%w, and saving the index failed: %v", err, serr)
+				}
+				b.mu.Unlock()
+			}
+			return err
+		}
+		if opts.Progress != nil {
+			opts.Progress(state.progress)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.saveMergedIndex()
+}
+
+// saveMergedIndex saves the index and the filter, removed when a chunk is
+// swapped in, along with the metadata. It must be called with the write lock
+// held.
+func (b *Bitcask) saveMergedIndex() error {
+	if err := b.rebuildFilter(); err != nil {
+		return err
+	}
+	if err := b.saveIndex(); err != nil {
+		return err
+	}
+	b.metadata.IndexUpToDate = true
+	return b.saveMetadata()
+}
+
+// mergeChunks splits the sorted datafile ids to be merged into chunks of
+// consecutive datafiles of at most MergeChunkSize bytes in total
+func (b *Bitcask) mergeChunks(ids []int) [][]int {
+	var (
+		chunks [][]int
+		chunk  []int
+		size   int64
+	)
+	// databases created before chunked merges have no chunk size configured
+	limit := int64(b.config.MergeChunkSize)
+	if limit <= 0 {
+		limit = DefaultMergeChunkSize
+	}
+	for _, id := range ids {
+		n := b.datafiles[id].Size()
+		if len(chunk) > 0 && size+n > limit {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+		chunk = append(chunk, id)
+		size += n
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// movedItem records a live key copied by a merge from its old location to
+// its new location
+type movedItem struct {
+	key []byte
+	old internal.Item
+	new internal.Item
+}
+
+// mergeChunk rewrites the live entries of the given consecutive datafiles
+// into new datafiles reusing the same ids, and swaps them in. Chunks must be
+// merged in increasing order of ids starting from the oldest datafile: as
+// all older entries have then already been merged, tombstones and stale
+// entries can be dropped without older entries becoming visible again when
+// the index is rebuilt from the datafiles.
+func (b *Bitcask) mergeChunk(ids []int, state *mergeState) error {
+	temp, err := fs.TempDir(b.fs, b.path, mergeDirPrefix)
+	if err != nil {
+		return err
+	}
+	// Until the chunk starts being committed any failure rolls it back
+	committing := false
+	defer func() {
+		if !committing {
+			b.fs.RemoveAll(temp)
+		}
+	}()
+
+	var (
+		moved   []movedItem
+		expired []movedItem
+		outputs []data.Datafile
+	)
+	defer func() {
+		for _, df := range outputs {
+			df.Close()
+		}
+	}()
+	newOutput := func() (data.Datafile, error) {
+		df, err := data.NewDatafile(b.fs, temp, ids[len(outputs)], false, b.config.MaxKeySize, b.config.MaxValueSize, b.config.FileFileModeBeforeUmask)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, df)
+		return df, nil
+	}
+	out, err := newOutput()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, id := range ids {
+		df, err := b.openDatafile(id, true)
+		if err != nil {
+			return err
+		}
+		var offset int64
+		for {
+			e, n, err := df.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				df.Close()
+				return err
+			}
+			old := internal.Item{FileID: id, Offset: offset, Size: n}
+			offset += n
+			if err := state.throttle(n); err != nil {
+				df.Close()
+				return err
+			}
+
+			// Skip stale entries, tombstones and entries of keys that were
+			// updated since the merge started
+			mu := b.keydirMu.RLock(e.Key)
+			value, found, err := b.keydir.Get(e.Key)
+			mu.RUnlock()
+			if err != nil {
+				df.Close()
+				return err
+			}
+			if !found || value != old {
+				continue
+			}
+			// expired keys are dropped
+			if e.Expiry != nil && e.Expiry.Before(now) {
+				expired = append(expired, movedItem{key: e.Key, old: old})
+				continue
+			}
+			if crc32.ChecksumIEEE(e.Value) != e.Checksum {
+				df.Close()
+				return ErrChecksumFailed
+			}
+
+			// Merged datafiles are sealed before an entry would make them
+			// cross the limit. They can only reuse the ids of the chunk, so
+			// the last one absorbs whatever does not fit
+			if out.Size() > 0 && out.Size()+n > int64(b.config.MaxDatafileSize) && len(outputs) < len(ids) {
+				if out, err = newOutput(); err != nil {
+					df.Close()
+					return err
+				}
+			}
+			off, size, err := out.Write(e)
+			if err != nil {
+				df.Close()
+				return err
+			}
+			moved = append(moved, movedItem{
+				key: e.Key,
+				old: old,
+				new: internal.Item{FileID: out.FileID(), Offset: off, Size: size},
+			})
+		}
+		if err := df.Close(); err != nil {
+			return err
+		}
+	}
+
+	// The merged datafiles must be durable before the merge is committed,
+	// otherwise a crash could leave a merge marker installing lost files
+	mc := &mergeCommit{Dir: filepath.Base(temp)}
+	for _, df := range outputs {
+		if df.Size() > 0 {
+			mc.Install = append(mc.Install, filepath.Base(df.Name()))
+		}
+		if err := df.Sync(); err != nil {
+			return err
+		}
+		if err := df.Close(); err != nil {
+			return err
+		}
+	}
+	outputs = nil
+	if err := internal.SyncDir(b.fs, temp); err != nil {
+		return err
+	}
+	mergeCheckpoint("merge-datafiles")
+
+	// no writes till the chunk is swapped in
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, id := range ids {
+		mc.Remove = append(mc.Remove, filepath.Base(b.datafiles[id].Name()))
+	}
+
+	committing = true
+	state.partial = true
+	if err = commitMerge(b.fs, b.path, mc, b.config.FileFileModeBeforeUmask); err != nil {
+		return err
+	}
+	state.progress.Files += len(ids)
+	state.progress.Keys += len(moved)
+	for _, m := range moved {
+		state.progress.Bytes += m.new.Size
+	}
+	if err = applyMerge(b.fs, b.path, mc); err != nil {
+		return err
+	}
+	installed := make(map[int]data.Datafile, len(mc.Install))
+	for _, name := range mc.Install {
+		parsed, err := internal.ParseIds([]string{name})
+		if err != nil {
+			return err
+		}
+		id := parsed[0]
+		df, err := b.openDatafile(id, true)
+		if err != nil {
+			return err
+		}
+		installed[id] = df
+	}
+
+	// Readers see the merged datafiles and the new location of the keys
+	// that were not updated in the meantime at once. Reads of the replaced
+	// datafiles still in progress are retried once these are closed. The
+	// chunk is committed, so the keydir is updated as far as it can be even
+	// if it fails, and the database must then be reopened to rebuild it.
+	var kerr error
+	keydirErr := func(err error) {
+		if kerr == nil && err != nil {
+			kerr = fmt.Errorf("error updating the keydir with a merged chunk, reopen the database: %w", err)
+		}
+	}
+	replaced := make([]data.Datafile, 0, len(ids))
+	b.keydirMu.Lock()
+	for _, id := range ids {
+		replaced = append(replaced, b.datafiles[id])
+		delete(b.datafiles, id)
+	}
+	for id, df := range installed {
+		b.datafiles[id] = df
+	}
+	// The locations of the replaced datafiles are reused, so the values
+	// read from them before can't be cached anymore
+	b.cache.invalidate(false)
+	for _, m := range moved {
+		value, found, err := b.keydir.Get(m.key)
+		if err == nil && found && value == m.old {
+			err = b.keydir.Put(m.key, m.new)
+			b.cache.move(m.key, m.old, m.new)
+		}
+		keydirErr(err)
+	}
+	// The expired entries dropped were live, so unlike the other entries
+	// dropped their space wasn't counted as reclaimable
+	var reclaimed int64
+	for _, m := range expired {
+		value, found, err := b.keydir.Get(m.key)
+		if err == nil && found && value == m.old {
+			err = b.keydir.Delete(m.key)
+			b.cache.remove(m.key)
+			if err == nil {
+				reclaimed -= m.old.Size
+			}
+		}
+		keydirErr(err)
+	}
+	b.keydirMu.Unlock()
+	for _, df := range replaced {
+		reclaimed += df.Size()
+	}
+	for _, df := range installed {
+		reclaimed -= df.Size()
+	}
+	b.metadata.ReclaimableSpace -= reclaimed
+	if b.metadata.ReclaimableSpace < 0 {
+		b.metadata.ReclaimableSpace = 0
+	}
+	// The merged datafiles were synced whole
+	for _, id := range ids {
+		b.metadata.MarkClean(id, false)
+	}
+	for id := range installed {
+		b.metadata.MarkClean(id, true)
+	}
+	for _, df := range replaced {
+		if err := df.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := mc.saveManifest(b.fs, b.path, b.manifest, b.config.FileFileModeBeforeUmask); err != nil {
+		return err
+	}
+
+	if err := finishMerge(b.fs, b.path, mc); err != nil {
+		return err
+	}
+	if kerr != nil {
+		return kerr
+	}
+	state.merged++
+	state.partial = false
+	return nil
+}
+
+// mergeCommit describes a merge that has been committed but possibly not
+// yet fully applied. The datafiles named in Install (found in Dir) replace
+// the datafiles named in Remove. Applying a commit is idempotent so it can
+// be safely rolled forward on Open after a crash.
+type mergeCommit struct {
+	Dir     string   `json:"dir"`
+	Install []string `json:"install"`
+	Remove  []string `json:"remove"`
+}
+
+// updateManifest replaces the datafiles removed by the merge with the merged
+// datafiles in the manifest. As the index on disk refers to the removed
+// datafiles, it is no longer valid.
+func (mc *mergeCommit) updateManifest(m *manifest.Manifest) error {
+	removed, err := internal.ParseIds(mc.Remove)
+	if err != nil {
+		return err
+	}
+	installed, err := internal.ParseIds(mc.Install)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range removed {
+		m.Remove(id)
+	}
+	for _, id := range installed {
+		m.Add(id)
+	}
+	m.IndexGeneration = 0
+	return nil
+}
+
+// saveManifest saves the manifest updated for the merge and removes the index
+// and its filter, which still point at the replaced datafiles. It has to be
+// done before the merge is finished, as once the merge marker is gone a
+// crash must not leave a manifest listing removed datafiles or a stale index.
+func (mc *mergeCommit) saveManifest(fsys fs.FileSystem, path string, m *manifest.Manifest, mode os.FileMode) error {
+	if err := mc.updateManifest(m); err != nil {
+		return err
+	}
+	if err := m.Save(fsys, filepath.Join(path, manifestFile), mode); err != nil {
+		return err
+	}
+	mergeCheckpoint("save-manifest")
+
+	for _, name := range []string{"index", filterFile} {
+		if err := fsys.Remove(filepath.Join(path, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	mergeCheckpoint("remove-index")
+	return nil
+}
+
+// commitMerge atomically commits the merge by writing the merge marker. Once
+// the marker is in place the merge is guaranteed to be rolled forward.
+func commitMerge(fsys fs.FileSystem, path string, mc *mergeCommit, mode os.FileMode) error {
+	data, err := json.Marshal(mc)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(path, mergeMarker+".tmp")
+	if err := internal.WriteFileSync(fsys, tmp, data, mode); err != nil {
+		return err
+	}
+	mergeCheckpoint("write-marker")
+
+	if err := fsys.Rename(tmp, filepath.Join(path, mergeMarker)); err != nil {
+		return err
+	}
+	mergeCheckpoint("rename-marker")
+
+	return internal.SyncDir(fsys, path)
+}
+
+// applyMerge installs the merged datafiles of a committed merge, replacing
+// the datafiles that were merged. It may be called any number of times for
+// the same commit. Nothing is removed if a merged datafile is missing, which
+// can't be told apart from one already installed if it replaces a datafile
+// of the same name.
+func applyMerge(fsys fs.FileSystem, path string, mc *mergeCommit) error {
+	installed := make(map[string]bool, len(mc.Install))
+	for _, name := range mc.Install {
+		installed[name] = true
+		if !internal.Exists(fsys, filepath.Join(path, mc.Dir, name)) && !internal.Exists(fsys, filepath.Join(path, name)) {
+			return fmt.Errorf("merged datafile %s is missing", name)
+		}
+	}
+
+	for _, name := range mc.Remove {
+		// Datafiles being replaced by a merged datafile of the same name are
+		// atomically overwritten by the rename below
+		if installed[name] {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(path, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		mergeCheckpoint("remove-datafile")
+	}
+
+	for _, name := range mc.Install {
+		src := filepath.Join(path, mc.Dir, name)
+		if !internal.Exists(fsys, src) {
+			// already installed, as checked above
+			continue
+		}
+		if err := fsys.Rename(src, filepath.Join(path, name)); err != nil {
+			return err
+		}
+		mergeCheckpoint("install-datafile")
+	}
+
+	return internal.SyncDir(fsys, path)
+}
+
+// finishMerge removes the merge directory and the merge marker once a merge
+// has been fully applied.
+func finishMerge(fsys fs.FileSystem, path string, mc *mergeCommit) error {
+	if err := fsys.RemoveAll(filepath.Join(path, mc.Dir)); err != nil {
+		return err
+	}
+	mergeCheckpoint("remove-merge-dir")
+
+	if err := fsys.Remove(filepath.Join(path, mergeMarker)); err != nil {
+		return err
+	}
+	mergeCheckpoint("remove-marker")
+
+	return nil
+}
+
+// recoverMerge detects a merge that was interrupted. A committed merge is
+// rolled forward, saving the updated manifest and removing the index so that
+// it is rebuilt from the merged datafiles. Any uncommitted merge is rolled
+// back by discarding its temporary directory.
+func recoverMerge(fsys fs.FileSystem, path string, m *manifest.Manifest, mode os.FileMode) error {
+	markerPath := filepath.Join(path, mergeMarker)
+	if internal.Exists(fsys, markerPath) {
+		mc := new(mergeCommit)
+		if err := internal.LoadFromJsonFile(fsys, markerPath, mc); err != nil {
+			return fmt.Errorf("loading merge marker: %w", err)
+		}
+
+		log.Warn("rolling forward interrupted merge")
+		if err := applyMerge(fsys, path, mc); err != nil {
+			return fmt.Errorf("rolling forward merge: %w", err)
+		}
+		if err := mc.saveManifest(fsys, path, m, mode); err != nil {
+			return fmt.Errorf("rolling forward merge: %w", err)
+		}
+		if err := finishMerge(fsys, path, mc); err != nil {
+			return fmt.Errorf("rolling forward merge: %w", err)
+		}
+	}
+
+	files, err := fsys.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() && strings.HasPrefix(file.Name(), mergeDirPrefix) {
+			log.Warnf("rolling back interrupted merge %s", file.Name())
+			if err := fsys.RemoveAll(filepath.Join(path, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := fsys.Remove(markerPath + ".tmp"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -4,7 +4,10 @@ import (
 	"os"
 	"time"
 
+	"github.com/prologic/bitcask/internal"
 	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/index"
 )
 
 const (
@@ -23,31 +26,109 @@ const (
 	// DefaultMaxValueSize is the default value size in bytes
 	DefaultMaxValueSize = uint64(1 << 16) // 65KB
 
-	// DefaultSync is the default file synchronization action
-	DefaultSync = false
+	// DefaultMergeChunkSize is the default maximum size in bytes of the
+	// datafiles merged together in one step of a merge
+	DefaultMergeChunkSize = 1 << 24 // 16MB
+
+	// DefaultIndexCheckpoint is the default number of sealed datafiles the
+	// saved index falls behind by before a checkpoint of it is written
+	DefaultIndexCheckpoint = 8
+
+	// DefaultSyncPolicy is the default file synchronization policy
+	DefaultSyncPolicy = SyncNever
 
 	// DefaultAutoRecovery is the default auto-recovery action.
 
 	CurrentDBVersion = uint32(1)
 )
 
-// Option is a function that takes a config struct and modifies it
-type Option func(*config.Config) error
+// SyncPolicy controls when writes to the active datafile are synced to disk
+type SyncPolicy = config.SyncPolicy
 
-func withConfig(src *config.Config) Option {
-	return func(cfg *config.Config) error {
-		cfg.MaxDatafileSize = src.MaxDatafileSize
-		cfg.MaxKeySize = src.MaxKeySize
-		cfg.MaxValueSize = src.MaxValueSize
-		cfg.Sync = src.Sync
-		cfg.AutoRecovery = src.AutoRecovery
-		cfg.DirFileModeBeforeUmask = src.DirFileModeBeforeUmask
-		cfg.FileFileModeBeforeUmask = src.FileFileModeBeforeUmask
-		return nil
-	}
+const (
+	// SyncNever leaves syncing to the operating system, Close() and Sync()
+	SyncNever = config.SyncNever
+
+	// SyncInterval syncs the active datafile periodically, see WithSyncInterval
+	SyncInterval = config.SyncInterval
+
+	// SyncAlways syncs the active datafile with fsync on every write
+	SyncAlways = config.SyncAlways
+
+	// SyncAlwaysDatasync syncs the active datafile with fdatasync on every write
+	SyncAlwaysDatasync = config.SyncAlwaysDatasync
+)
+
+// FileSystem is the interface to the file system a database is stored on,
+// see WithFileSystem. Its methods behave like the functions of the same name
+// of the os and io/ioutil packages.
+type FileSystem = fs.FileSystem
+
+// File is an open file of a FileSystem, its methods behave like those of
+// os.File
+type File = fs.File
+
+// DefaultFileSystem is the file system of the operating system, used unless
+// another one is configured with WithFileSystem
+var DefaultFileSystem FileSystem = fs.OS
+
+// Keydir maps the keys of the database to the location of their live entry
+// in the datafiles, see WithIndexer. Get, Len, ForEach and ForEachPrefix are
+// called concurrently with each other, Put and Delete by one goroutine at a
+// time with no other method running.
+type Keydir = index.Keydir
+
+// Indexer creates the keydir of the database and persists it as the index
+// of the database, see WithIndexer
+type Indexer = index.Indexer
+
+// Item is the location of the live entry of a key in the datafiles
+type Item = internal.Item
+
+// NewIndexer returns an Indexer of the keydirs returned by newKeydir, which
+// are persisted in the index format of the database
+func NewIndexer(newKeydir func() Keydir) Indexer {
+	return index.NewIndexer(newKeydir)
+}
+
+// NewSpillIndexer returns an Indexer of keydirs spilled to disk, for
+// databases with more keys than fit in memory. The items of the keys are
+// kept in a hash table in scratch files created in dir, which are mapped
+// into memory where supported so that the operating system pages them in
+// and out as needed, and removed when the keydir is closed. The items of up
+// to cacheSize of the most recently read keys are also held in memory. Like
+// NewHashMapKeydir, the keys are visited in no particular order.
+//
+// The scratch files are the only files not created on the file system set
+// with WithFileSystem: they have to be mapped into memory, so they're always
+// created in dir on the file system of the operating system. They hold no
+// data of the database and never outlive the keydir.
+func NewSpillIndexer(dir string, cacheSize int) Indexer {
+	return index.NewSpillIndexer(dir, cacheSize)
+}
+
+// NewTreeKeydir returns the default keydir, an Adaptive Radix Tree. It
+// visits the keys in lexicographical order and scans prefixes efficiently.
+func NewTreeKeydir() Keydir {
+	return index.NewTree()
 }
 
+// NewHashMapKeydir returns a keydir backed by a hash map. It has the fastest
+// point lookups but visits the keys in no particular order and has to visit
+// all of them to scan a prefix.
+func NewHashMapKeydir() Keydir {
+	return index.NewHashMap()
+}
+
+// Option is a function that takes a config struct and modifies it
+type Option func(*config.Config) error
+
 // WithAutoRecovery sets auto recovery of data and index file recreation.
+// Damaged regions of the datafiles are cut out and moved to the quarantine
+// directory of the database, keeping the intact entries around them. Only
+// the active datafile and the sealed datafiles not known to be intact are
+// checked on open, those sealed after being written whole by the database
+// aren't, use Repair to check all of them.
 // IMPORTANT: This flag MUST BE used only if a proper backup was made of all
 // the existing datafiles.
 func WithAutoRecovery(enabled bool) Option {
@@ -97,11 +178,175 @@ func WithMaxValueSize(size uint64) Option {
 	}
 }
 
+// WithMergeChunkSize sets the maximum size in bytes of the datafiles merged
+// together in one step of a merge. This bounds the extra disk space needed
+// while merging.
+func WithMergeChunkSize(size int) Option {
+	return func(cfg *config.Config) error {
+		cfg.MergeChunkSize = size
+		return nil
+	}
+}
+
+// WithIndexer sets the indexer creating the keydir of the database and
+// persisting it as its index, by default NewIndexer(NewTreeKeydir). The
+// keydir decides the order of the keys visited by Keys, Fold and Scan. See
+// Keydir for the concurrent calls it must support.
+func WithIndexer(indexer Indexer) Option {
+	return func(cfg *config.Config) error {
+		cfg.Indexer = indexer
+		return nil
+	}
+}
+
+// WithIndexCheckpoint sets the number of sealed datafiles the saved index
+// may fall behind by before a checkpoint of it is written in the background.
+// Sealing a datafile doesn't save the index, the datafiles it's behind by
+// are replayed when the database is opened. A checkpoint applies their
+// entries to the saved index without holding the write lock. Zero disables
+// checkpoints, the index is then only saved by Close and Merge. The setting
+// isn't saved in config.json, every Open without it uses
+// DefaultIndexCheckpoint.
+func WithIndexCheckpoint(datafiles int) Option {
+	return func(cfg *config.Config) error {
+		cfg.IndexCheckpoint = datafiles
+		return nil
+	}
+}
+
+// WithBloomFilter sets whether a Bloom filter of the keys is kept in front of
+// the keydir. Lookups of most missing keys are answered by the filter alone,
+// which saves reading a keydir spilled to disk, see NewSpillIndexer. The
+// filter takes about 1.25 bytes per key and is saved with the index. Writes
+// grow it by adding layers as it fills up, it's rebuilt from the keydir when
+// the index was saved without it or the datafiles were replayed, and by
+// Merge to drop the deleted keys and its extra layers.
+func WithBloomFilter(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.BloomFilter = enabled
+		return nil
+	}
+}
+
+// WithValueCache sets the size in bytes of a least recently used cache of the
+// values read by Get, zero disables it. Hits skip reading, decoding and
+// checksumming the entry. Writes and deletes drop the cached value of their
+// key, and cached values stay valid across merges. Only values that passed
+// their checksum and haven't expired are cached. Stats reports the hits and
+// misses of the cache. The size isn't saved in config.json, the cache has to
+// be enabled again every time the database is opened.
+func WithValueCache(size int) Option {
+	return func(cfg *config.Config) error {
+		cfg.ValueCache = size
+		return nil
+	}
+}
+
+// WithPreallocate causes the active datafile to be preallocated to the
+// maximum datafile size when it is created, reducing fragmentation and
+// filesystem metadata updates. The unused space is released when the
+// datafile is sealed.
+func WithPreallocate(enabled bool) Option {
+	return func(cfg *config.Config) error {
+		cfg.Preallocate = enabled
+		return nil
+	}
+}
+
+// WithReadOnly opens the database for reading only. The database is not
+// locked and nothing is written to it, so any number of processes can read
+// it while another one writes to it. Put, Delete and Merge fail with
+// ErrReadOnly, and Refresh() picks up the changes made by the writer.
+func WithReadOnly() Option {
+	return func(cfg *config.Config) error {
+		cfg.ReadOnly = true
+		return nil
+	}
+}
+
+// WithFileSystem sets the file system the database is stored on, which all
+// files of the database are read from and written to. Databases stored on
+// a file system other than DefaultFileSystem are not locked against other
+// processes. The scratch files of NewSpillIndexer are the exception, they're
+// always created on the file system of the operating system.
+func WithFileSystem(fsys FileSystem) Option {
+	return func(cfg *config.Config) error {
+		if fsys == nil {
+			fsys = DefaultFileSystem
+		}
+		cfg.FileSystem = fsys
+		return nil
+	}
+}
+
+// WithLockTimeout causes Open to wait up to timeout for another process to
+// release the database lock before failing with ErrDatabaseLocked. This is
+// useful when a new process is started before the old one has exited.
+func WithLockTimeout(timeout time.Duration) Option {
+	return func(cfg *config.Config) error {
+		cfg.LockTimeout = timeout
+		return nil
+	}
+}
+
 // WithSync causes Sync() to be called on every key/value written increasing
-// durability and safety at the expense of performance
+// durability and safety at the expense of performance. It is a shorthand for
+// WithSyncPolicy(SyncAlways) or WithSyncPolicy(SyncNever).
 func WithSync(sync bool) Option {
+	if sync {
+		return WithSyncPolicy(SyncAlways)
+	}
+	return WithSyncPolicy(SyncNever)
+}
+
+// WithSyncPolicy sets the policy controlling when writes are synced to disk.
+// Use WithSyncInterval to sync periodically.
+func WithSyncPolicy(policy SyncPolicy) Option {
+	return func(cfg *config.Config) error {
+		switch policy {
+		case SyncNever, SyncAlways, SyncAlwaysDatasync:
+		case SyncInterval:
+			if cfg.SyncInterval <= 0 {
+				return ErrInvalidSyncPolicy
+			}
+		default:
+			return ErrInvalidSyncPolicy
+		}
+		cfg.SyncPolicy = policy
+		return nil
+	}
+}
+
+// WithSyncInterval causes the active datafile to be synced every interval
+// from a background goroutine, so at most the writes of the last interval
+// are lost on a crash without paying for a sync on every write
+func WithSyncInterval(interval time.Duration) Option {
 	return func(cfg *config.Config) error {
-		cfg.Sync = sync
+		if interval <= 0 {
+			return ErrInvalidSyncPolicy
+		}
+		cfg.SyncPolicy = SyncInterval
+		cfg.SyncInterval = interval
+		return nil
+	}
+}
+
+// WithGroupCommit enables group commit when used with a per-write sync
+// policy such as WithSync(true). Instead of
+// every Put syncing the active datafile while holding the write lock,
+// concurrent writers append their entries and then wait for a shared fsync
+// issued at most interval after the first of them, or as soon as bytes are
+// pending. Put still only returns once its entry is durable.
+//
+// The keydir is updated before the shared fsync, so a value written is
+// visible to readers while its writer still waits for it to be durable. If
+// the fsync fails, Put and Delete return its error but the value written,
+// or the deletion, stays visible and may or may not survive a crash: the
+// write isn't undone, its outcome is unknown.
+func WithGroupCommit(interval time.Duration, bytes int) Option {
+	return func(cfg *config.Config) error {
+		cfg.GroupCommitInterval = interval
+		cfg.GroupCommitBytes = bytes
 		return nil
 	}
 }
@@ -111,11 +356,27 @@ func newDefaultConfig() *config.Config {
 		MaxDatafileSize:         DefaultMaxDatafileSize,
 		MaxKeySize:              DefaultMaxKeySize,
 		MaxValueSize:            DefaultMaxValueSize,
-		Sync:                    DefaultSync,
+		MergeChunkSize:          DefaultMergeChunkSize,
+		IndexCheckpoint:         DefaultIndexCheckpoint,
+		SyncPolicy:              DefaultSyncPolicy,
 		DirFileModeBeforeUmask:  DefaultDirFileModeBeforeUmask,
 		FileFileModeBeforeUmask: DefaultFileFileModeBeforeUmask,
 		DBVersion:               CurrentDBVersion,
+		FileSystem:              DefaultFileSystem,
+		Indexer:                 NewIndexer(NewTreeKeydir),
+	}
+}
+
+// fileSystem returns the file system configured by the options, which has
+// to be known before the configuration of the database can be loaded
+func fileSystem(options []Option) (FileSystem, error) {
+	cfg := newDefaultConfig()
+	for _, opt := range options {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
 	}
+	return cfg.FileSystem, nil
 }
 
 type Feature struct {
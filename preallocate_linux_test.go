@@ -0,0 +1,36 @@
+//go:build linux
+// +build linux
+
+package bitcask
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocated returns the disk space allocated to the named file and the block
+// size of its file system, or false if the file system doesn't support
+// preallocation
+func allocated(t *testing.T, name string) (int64, int64, bool) {
+	probe, err := ioutil.TempFile(filepath.Dir(name), "probe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+	if err := unix.Fallocate(int(probe.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, 1); err != nil {
+		return 0, 0, false
+	}
+
+	stat, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sys := stat.Sys().(*syscall.Stat_t)
+	return sys.Blocks * 512, int64(sys.Blksize), true
+}
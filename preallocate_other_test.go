@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package bitcask
+
+import "testing"
+
+// allocated returns false as preallocation is a no-op on platforms other
+// than Linux
+func allocated(t *testing.T, name string) (int64, int64, bool) {
+	return 0, 0, false
+}
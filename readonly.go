@@ -0,0 +1,211 @@
+package bitcask
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/data/codec"
+	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/internal/manifest"
+)
+
+const (
+	// maxRefreshAttempts is the number of times a read only view is loaded
+	// again when the writer changed the datafiles while it was loaded
+	maxRefreshAttempts = 10
+)
+
+// errViewChanged is the error returned when the datafiles of the database
+// changed while a read only view of it was loaded
+var errViewChanged = errors.New("error: datafiles changed while loading")
+
+// view is a consistent read only view of the datafiles and keydir of a
+// database opened by another process
+type view struct {
+	manifest  *manifest.Manifest
+	curr      data.Datafile
+	datafiles map[int]data.Datafile
+	keydir    index.Keydir
+	filter    *index.Filter
+}
+
+func (v *view) close() {
+	for _, df := range v.datafiles {
+		df.Close()
+	}
+	if v.curr != nil {
+		v.curr.Close()
+	}
+	if v.keydir != nil {
+		index.Close(v.keydir)
+	}
+}
+
+// Refresh reloads the view of a database opened with WithReadOnly so that it
+// includes the writes made since it was opened or last refreshed, as well as
+// datafile rotations and merges done by the writer. It is a no-op for
+// databases opened for writing, which have nothing to pick up, unlike Reopen
+// which only reloads databases opened for writing.
+func (b *Bitcask) Refresh() error {
+	if !b.config.ReadOnly {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.refresh()
+}
+
+// refresh loads a new read only view and swaps it in. Views that changed
+// while being loaded are loaded again.
+func (b *Bitcask) refresh() error {
+	var (
+		v   *view
+		err error
+	)
+	for attempt := 1; ; attempt++ {
+		v, err = b.loadView()
+		if err == nil {
+			break
+		}
+		if attempt == maxRefreshAttempts || (err != errViewChanged && !os.IsNotExist(err)) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+
+	b.keydirMu.Lock()
+	old := &view{curr: b.curr, datafiles: b.datafiles, keydir: b.keydir}
+	b.manifest = v.manifest
+	b.curr = v.curr
+	b.datafiles = v.datafiles
+	b.keydir = v.keydir
+	b.filter = v.filter
+	b.keydirMu.Unlock()
+	b.cache.invalidate(true)
+
+	// Reads still in progress on the old view are retried on the new one
+	old.close()
+	return nil
+}
+
+// loadView loads a view of the live datafiles of the database. A merge can
+// replace datafiles keeping their ids, so the view is only consistent if no
+// merge was being applied and the manifest did not change while loading it.
+func (b *Bitcask) loadView() (*view, error) {
+	m, err := loadManifest(b.fs, b.path)
+	if err != nil {
+		return nil, err
+	}
+	if internal.Exists(b.fs, filepath.Join(b.path, mergeMarker)) {
+		return nil, errViewChanged
+	}
+
+	t, found, err := b.indexer.Load(b.fs, filepath.Join(b.path, "index"), b.config.MaxKeySize)
+	if err != nil && !index.IsIndexCorruption(err) {
+		return nil, err
+	}
+	if err != nil {
+		// A corrupted index is rebuilt from the datafiles
+		found = false
+	}
+	if m.IndexGeneration == 0 {
+		found = false
+	}
+	if !found {
+		if t != nil {
+			index.Close(t)
+		}
+		if t, err = b.indexer.New(); err != nil {
+			return nil, err
+		}
+	}
+
+	v := &view{manifest: m, datafiles: make(map[int]data.Datafile, len(m.Datafiles)), keydir: t}
+	for _, id := range m.Datafiles {
+		df, err := b.openDatafile(id, true)
+		if err != nil {
+			v.close()
+			return nil, err
+		}
+		if id == m.Active {
+			v.curr = df
+		} else {
+			v.datafiles[id] = df
+		}
+	}
+	if v.curr == nil {
+		v.close()
+		return nil, os.ErrNotExist
+	}
+
+	current, err := loadManifest(b.fs, b.path)
+	if err != nil {
+		v.close()
+		return nil, err
+	}
+	if internal.Exists(b.fs, filepath.Join(b.path, mergeMarker)) ||
+		current.Active != m.Active || !reflect.DeepEqual(current.Datafiles, m.Datafiles) {
+		v.close()
+		return nil, errViewChanged
+	}
+
+	for _, df := range getSortedDatafiles(v.datafiles) {
+		if found && df.FileID() < m.IndexDatafile {
+			continue
+		}
+		if err := loadIndexFromDatafile(t, df); err != nil {
+			v.close()
+			return nil, err
+		}
+	}
+	if err := replayActiveDatafile(t, v.curr); err != nil {
+		v.close()
+		return nil, err
+	}
+	if b.config.BloomFilter {
+		if v.filter, err = index.BuildFilter(t); err != nil {
+			v.close()
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// replayActiveDatafile updates t with the entries of the datafile being
+// written by another process. Only the entries within the size of the
+// datafile when it was opened are replayed, and a record being appended
+// while reading it ends the replay.
+func replayActiveDatafile(t index.Keydir, df data.Datafile) error {
+	var offset int64
+	size := df.Size()
+	for {
+		e, n, err := df.Read()
+		if err == io.EOF || codec.IsCorruptedData(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if offset+n > size {
+			return nil
+		}
+		if len(e.Value) == 0 {
+			err = t.Delete(e.Key)
+		} else {
+			err = t.Put(e.Key, internal.Item{FileID: df.FileID(), Offset: offset, Size: n})
+		}
+		if err != nil {
+			return err
+		}
+		offset += n
+	}
+}
@@ -0,0 +1,240 @@
+package bitcask
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prologic/bitcask/flock"
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/config"
+	"github.com/prologic/bitcask/internal/data"
+	"github.com/prologic/bitcask/internal/fs"
+	"github.com/prologic/bitcask/internal/index"
+	"github.com/prologic/bitcask/internal/metadata"
+)
+
+// RepairMode selects what Repair does about the damage it finds
+type RepairMode int
+
+const (
+	// RepairDryRun only reports the damage found, nothing is changed
+	RepairDryRun RepairMode = iota
+
+	// RepairBackup copies the files to be changed to the backup directory
+	// before repairing them
+	RepairBackup
+
+	// RepairApply repairs the damaged files in place
+	RepairApply
+)
+
+func (m RepairMode) String() string {
+	switch m {
+	case RepairDryRun:
+		return "dry-run"
+	case RepairBackup:
+		return "backup"
+	case RepairApply:
+		return "apply"
+	}
+	return fmt.Sprintf("RepairMode(%d)", int(m))
+}
+
+// RepairOptions configures Repair
+type RepairOptions struct {
+	// Mode selects whether the damage is only reported, the default, or
+	// repaired with or without a backup.
+	Mode RepairMode
+
+	// BackupDir is the directory the files to be changed are copied to in
+	// RepairBackup mode. It defaults to a new directory next to the
+	// database named after it and the time of the repair.
+	BackupDir string
+
+	// FileSystem is the file system of the database, nil means
+	// DefaultFileSystem.
+	FileSystem FileSystem
+
+	// Indexer is the indexer of the database, nil means the default one
+	Indexer Indexer
+}
+
+// DatafileReport describes the damage found in a datafile and the entries
+// and bytes lost repairing it
+type DatafileReport = data.FileReport
+
+// DamagedRegion is a damaged region of a datafile. Once repaired it's moved
+// to the Quarantine file.
+type DamagedRegion = data.Region
+
+// RepairReport describes the damage found by Repair and what was done
+// about it
+type RepairReport struct {
+	Datafiles      []DatafileReport `json:"datafiles"`
+	IndexCorrupted bool             `json:"index_corrupted"`
+	Repaired       bool             `json:"repaired"`
+	Backup         string           `json:"backup,omitempty"`
+}
+
+// Damaged returns true if any damage was found
+func (r RepairReport) Damaged() bool {
+	for _, f := range r.Datafiles {
+		if len(f.Regions) > 0 {
+			return true
+		}
+	}
+	return r.IndexCorrupted
+}
+
+// Repair checks the datafiles and the index of the database at path for
+// damage and repairs it according to the mode of the options.
+//
+// Damaged regions of the datafiles are moved to the quarantine directory
+// of the database, keeping the intact entries around them. An entry is
+// intact if it decodes and checksums cleanly, after a damaged region the
+// datafile is scanned for the next one. The index is removed, it's rebuilt
+// the next time the database is opened.
+//
+// The database must not be open unless in dry-run mode, Repair returns
+// ErrDatabaseLocked if it is. Opening a database with WithAutoRecovery
+// repairs it in place, checking fewer datafiles.
+func Repair(path string, opts RepairOptions) (RepairReport, error) {
+	fsys := opts.FileSystem
+	if fsys == nil {
+		fsys = DefaultFileSystem
+	}
+
+	cfg := newDefaultConfig()
+	configPath := filepath.Join(path, "config.json")
+	if internal.Exists(fsys, configPath) {
+		var err error
+		cfg, err = config.Load(fsys, configPath)
+		if err != nil {
+			return RepairReport{}, fmt.Errorf("loading config: %w", err)
+		}
+		cfg.FileSystem = fsys
+		cfg.Indexer = NewIndexer(NewTreeKeydir)
+	}
+	if opts.Indexer != nil {
+		cfg.Indexer = opts.Indexer
+	}
+
+	if opts.Mode != RepairDryRun && fsys == fs.OS {
+		lock := flock.New(filepath.Join(path, lockfile))
+		lock.SetVersion(internal.FullVersion())
+		locked, err := lock.TryLock()
+		if err != nil && err != flock.ErrLockFailed {
+			return RepairReport{}, err
+		}
+		if !locked {
+			return RepairReport{}, ErrDatabaseLocked
+		}
+		defer lock.Unlock()
+	}
+
+	return repair(fsys, path, cfg, opts, nil)
+}
+
+// repair checks and repairs the database at path, which the caller must
+// have locked unless in dry-run mode. Given the metadata of the database,
+// the datafiles it marks clean aren't checked.
+func repair(fsys FileSystem, path string, cfg *config.Config, opts RepairOptions, meta *metadata.MetaData) (RepairReport, error) {
+	var report RepairReport
+
+	if _, err := fsys.Stat(path); err != nil {
+		return report, err
+	}
+
+	// Only the live datafiles are checked, leftovers of merges or
+	// rotations aren't part of the database
+	m, err := loadManifest(fsys, path)
+	if err != nil {
+		return report, fmt.Errorf("loading the manifest: %w", err)
+	}
+	ids := m.Datafiles
+	if meta != nil {
+		ids = nil
+		for _, id := range m.Datafiles {
+			if id == m.Active || !meta.IsClean(id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	check, err := data.Check(fsys, path, ids, cfg)
+	if err != nil {
+		return report, err
+	}
+	report.Datafiles = check.Files
+
+	indexPath := filepath.Join(path, "index")
+	t, _, err := cfg.Indexer.Load(fsys, indexPath, cfg.MaxKeySize)
+	if err != nil {
+		if !index.IsIndexCorruption(err) {
+			return report, fmt.Errorf("checking the index: %w", err)
+		}
+		report.IndexCorrupted = true
+	} else {
+		index.Close(t)
+	}
+
+	if opts.Mode == RepairDryRun || !report.Damaged() {
+		return report, nil
+	}
+
+	if opts.Mode == RepairBackup {
+		dir := opts.BackupDir
+		if dir == "" {
+			dir = fmt.Sprintf("%s.repair-%s", filepath.Clean(path), time.Now().Format("20060102150405"))
+		}
+		files := []string{indexPath}
+		for _, f := range check.Damaged() {
+			files = append(files, f.Path)
+		}
+		if err := backupFiles(fsys, dir, files, cfg); err != nil {
+			return report, fmt.Errorf("backing up damaged files: %w", err)
+		}
+		report.Backup = dir
+	}
+
+	for i, f := range report.Datafiles {
+		if len(f.Regions) == 0 {
+			continue
+		}
+		fr, err := data.Recover(fsys, f.Path, cfg)
+		if err != nil {
+			return report, fmt.Errorf("repairing datafile %s: %w", f.Path, err)
+		}
+		report.Datafiles[i] = fr
+	}
+
+	// The offsets of the entries in repaired datafiles changed, the index is
+	// rebuilt the next time the database is opened
+	if err := fsys.Remove(indexPath); err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("removing the index: %w", err)
+	}
+	report.Repaired = true
+
+	return report, nil
+}
+
+// backupFiles copies the files that exist to dir
+func backupFiles(fsys FileSystem, dir string, files []string, cfg *config.Config) error {
+	if err := fsys.MkdirAll(dir, cfg.DirFileModeBeforeUmask); err != nil {
+		return err
+	}
+	for _, name := range files {
+		b, err := fs.ReadFile(fsys, name)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := internal.WriteFileSync(fsys, filepath.Join(dir, filepath.Base(name)), b, cfg.FileFileModeBeforeUmask); err != nil {
+			return err
+		}
+	}
+	return internal.SyncDir(fsys, dir)
+}
@@ -4,12 +4,12 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 
 	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 const (
@@ -20,36 +20,36 @@ const (
 	defaultDatafileFilename = "%09d.data"
 )
 
-func ApplyV0ToV1(dir string, maxDatafileSize int) error {
-	temp, err := prepare(dir)
+func ApplyV0ToV1(fsys fs.FileSystem, dir string, maxDatafileSize int) error {
+	temp, err := prepare(fsys, dir)
 	if err != nil {
 		return err
 	}
-	defer os.RemoveAll(temp)
-	err = apply(dir, temp, maxDatafileSize)
+	defer fsys.RemoveAll(temp)
+	err = apply(fsys, dir, temp, maxDatafileSize)
 	if err != nil {
 		return err
 	}
-	return cleanup(dir, temp)
+	return cleanup(fsys, dir, temp)
 }
 
-func prepare(dir string) (string, error) {
-	return ioutil.TempDir(dir, "migration")
+func prepare(fsys fs.FileSystem, dir string) (string, error) {
+	return fs.TempDir(fsys, dir, "migration")
 }
 
-func apply(dir, temp string, maxDatafileSize int) error {
-	datafilesPath, err := internal.GetDatafiles(dir)
+func apply(fsys fs.FileSystem, dir, temp string, maxDatafileSize int) error {
+	datafilesPath, err := internal.GetDatafiles(fsys, dir)
 	if err != nil {
 		return err
 	}
 	var id, newOffset int
-	datafile, err := getNewDatafile(temp, id)
+	datafile, err := getNewDatafile(fsys, temp, id)
 	if err != nil {
 		return err
 	}
 	id++
 	for _, p := range datafilesPath {
-		df, err := os.Open(p)
+		df, err := fs.Open(fsys, p)
 		if err != nil {
 			return err
 		}
@@ -67,7 +67,7 @@ func apply(dir, temp string, maxDatafileSize int) error {
 				if err != nil {
 					return err
 				}
-				datafile, err = getNewDatafile(temp, id)
+				datafile, err = getNewDatafile(fsys, temp, id)
 				if err != nil {
 					return err
 				}
@@ -87,25 +87,25 @@ func apply(dir, temp string, maxDatafileSize int) error {
 	return datafile.Sync()
 }
 
-func cleanup(dir, temp string) error {
-	files, err := ioutil.ReadDir(dir)
+func cleanup(fsys fs.FileSystem, dir, temp string) error {
+	files, err := fsys.ReadDir(dir)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
 		if !file.IsDir() {
-			err := os.RemoveAll(path.Join([]string{dir, file.Name()}...))
+			err := fsys.RemoveAll(path.Join([]string{dir, file.Name()}...))
 			if err != nil {
 				return err
 			}
 		}
 	}
-	files, err = ioutil.ReadDir(temp)
+	files, err = fsys.ReadDir(temp)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
-		err := os.Rename(
+		err := fsys.Rename(
 			path.Join([]string{temp, file.Name()}...),
 			path.Join([]string{dir, file.Name()}...),
 		)
@@ -116,12 +116,12 @@ func cleanup(dir, temp string) error {
 	return nil
 }
 
-func getNewDatafile(path string, id int) (*os.File, error) {
+func getNewDatafile(fsys fs.FileSystem, path string, id int) (fs.File, error) {
 	fn := filepath.Join(path, fmt.Sprintf(defaultDatafileFilename, id))
-	return os.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	return fsys.OpenFile(fn, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
 }
 
-func getSingleEntry(f *os.File, offset int64) ([]byte, error) {
+func getSingleEntry(f fs.File, offset int64) ([]byte, error) {
 	prefixBuf, err := readPrefix(f, offset)
 	if err != nil {
 		return nil, err
@@ -134,7 +134,7 @@ func getSingleEntry(f *os.File, offset int64) ([]byte, error) {
 	return append(prefixBuf, entryBuf...), nil
 }
 
-func readPrefix(f *os.File, offset int64) ([]byte, error) {
+func readPrefix(f fs.File, offset int64) ([]byte, error) {
 	prefixBuf := make([]byte, keySize+valueSize)
 	_, err := f.ReadAt(prefixBuf, offset)
 	if err != nil {
@@ -143,7 +143,7 @@ func readPrefix(f *os.File, offset int64) ([]byte, error) {
 	return prefixBuf, nil
 }
 
-func read(f *os.File, bufSize uint64, offset int64) ([]byte, error) {
+func read(f fs.File, bufSize uint64, offset int64) ([]byte, error) {
 	buf := make([]byte, bufSize)
 	_, err := f.ReadAt(buf, offset)
 	if err != nil {
@@ -10,6 +10,8 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/prologic/bitcask/internal/fs"
 )
 
 func Test_ApplyV0ToV1(t *testing.T) {
@@ -39,7 +41,7 @@ func Test_ApplyV0ToV1(t *testing.T) {
 	assert.NoError(err)
 	_, err = w2.Write(buf[:52])
 	assert.NoError(err)
-	err = ApplyV0ToV1(testdir, 104)
+	err = ApplyV0ToV1(fs.OS, testdir, 104)
 	assert.NoError(err)
 	r0, err := os.Open(filepath.Join(testdir, "000000000.data"))
 	assert.NoError(err)
@@ -0,0 +1,286 @@
+package bitcask
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// groupCommit batches the fsyncs of concurrent writers. Writers append their
+// entries while holding the write lock, release it and then wait until a
+// single fsync issued by the sync goroutine covers what they wrote. Progress
+// is tracked as the total number of bytes appended to the active datafiles.
+type groupCommit struct {
+	interval time.Duration
+	bytes    int64
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	written  int64
+	synced   int64
+	failures []syncFailure
+	waiters  int
+
+	wake chan struct{}
+	full chan struct{}
+}
+
+// syncFailure records that an fsync failed to make the positions after from
+// up to to durable. A later fsync succeeding doesn't make them durable, as
+// the kernel may have dropped the dirty pages the failed one didn't write.
+type syncFailure struct {
+	from, to int64
+	err      error
+}
+
+func newGroupCommit(interval time.Duration, bytes int) *groupCommit {
+	g := &groupCommit{
+		interval: interval,
+		bytes:    int64(bytes),
+		wake:     make(chan struct{}, 1),
+		full:     make(chan struct{}, 1),
+	}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// append records n bytes written to the active datafile and returns the
+// position a writer must wait for with wait, which it must call. It must be
+// called with the Bitcask write lock held.
+func (g *groupCommit) append(n int64) int64 {
+	g.mu.Lock()
+	g.written += n
+	g.waiters++
+	seq := g.written
+	pending := g.written - g.synced
+	g.mu.Unlock()
+
+	notify(g.wake)
+	if g.bytes > 0 && pending >= g.bytes {
+		notify(g.full)
+	}
+	return seq
+}
+
+// wait blocks until everything up to seq is durable or an fsync covering it
+// failed, in which case the error is returned even if a later one succeeded.
+func (g *groupCommit) wait(seq int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	defer func() {
+		// The failures are kept until no writer can be covered by them
+		g.waiters--
+		if g.waiters == 0 {
+			g.failures = nil
+		}
+	}()
+
+	for {
+		for _, f := range g.failures {
+			if seq > f.from && seq <= f.to {
+				return f.err
+			}
+		}
+		if g.synced >= seq {
+			return nil
+		}
+		g.cond.Wait()
+	}
+}
+
+// commit marks everything up to seq as durable, or as failed if err is set,
+// and wakes up the writers waiting for it.
+func (g *groupCommit) commit(seq int64, err error) {
+	g.mu.Lock()
+	if err != nil {
+		g.fail(seq, err)
+	} else if seq > g.synced {
+		g.synced = seq
+	}
+	g.mu.Unlock()
+	g.cond.Broadcast()
+}
+
+// fail records that the positions not yet durable up to seq failed to sync.
+// Failures without a successful fsync in between are merged. It must be
+// called with mu held.
+func (g *groupCommit) fail(seq int64, err error) {
+	if seq <= g.synced {
+		return
+	}
+	if n := len(g.failures); n > 0 {
+		if last := &g.failures[n-1]; last.from == g.synced {
+			if seq > last.to {
+				last.to = seq
+			}
+			return
+		}
+	}
+	g.failures = append(g.failures, syncFailure{from: g.synced, to: seq, err: err})
+}
+
+// closed marks everything written so far as durable, or as failed if err is
+// set. It is called once the active datafile has been closed, which syncs it.
+func (g *groupCommit) closed(err error) {
+	g.mu.Lock()
+	seq := g.written
+	g.mu.Unlock()
+	g.commit(seq, err)
+}
+
+// pending returns the position written so far and whether it is not yet
+// known to be durable
+func (g *groupCommit) pending() (int64, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.written, g.written > g.synced
+}
+
+// run is the sync goroutine. It waits for a writer, gives other writers up
+// to interval (or until bytes are pending) to join the batch and then calls
+// sync to fsync the active datafile on behalf of all of them.
+func (g *groupCommit) run(quit <-chan struct{}, sync func() (int64, error)) {
+	timer := time.NewTimer(g.interval)
+	timer.Stop()
+	for {
+		select {
+		case <-g.wake:
+		case <-quit:
+			return
+		}
+
+		timer.Reset(g.interval)
+		select {
+		case <-timer.C:
+		case <-g.full:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-quit:
+			timer.Stop()
+			return
+		}
+
+		g.commit(sync())
+	}
+}
+
+// startSync starts the background goroutines required by the sync policy
+func (b *Bitcask) startSync() {
+	b.quit = make(chan struct{})
+	if b.config.ReadOnly {
+		return
+	}
+
+	switch {
+	case b.config.SyncPolicy == SyncInterval:
+		b.wg.Add(1)
+		go b.syncEvery(b.config.SyncInterval)
+	case b.config.SyncPolicy.PerWrite() && b.config.GroupCommitInterval > 0:
+		b.commit = newGroupCommit(b.config.GroupCommitInterval, b.config.GroupCommitBytes)
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			b.commit.run(b.quit, b.syncActive)
+		}()
+	}
+}
+
+// stopSync stops the background goroutines started by startSync and waits
+// for them to exit
+func (b *Bitcask) stopSync() {
+	b.stop.Do(func() { close(b.quit) })
+	b.wg.Wait()
+}
+
+// syncEvery syncs the active datafile every interval until stopSync is called
+func (b *Bitcask) syncEvery(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.syncCurrent(); err != nil {
+				log.WithError(err).Error("error syncing active datafile")
+			}
+		case <-b.quit:
+			return
+		}
+	}
+}
+
+// syncActive fsyncs the active datafile on behalf of the writers waiting in
+// a group commit and returns the position up to which they are durable.
+func (b *Bitcask) syncActive() (int64, error) {
+	seq, pending := b.commit.pending()
+
+	if !pending {
+		return seq, nil
+	}
+	return seq, b.syncCurrent()
+}
+
+// syncCurrent syncs the active datafile without holding the write lock
+func (b *Bitcask) syncCurrent() error {
+	mu := b.keydirMu.RLock(nil)
+	curr, closes := b.curr, b.closes
+	mu.RUnlock()
+
+	b.syncMu.Lock()
+	defer b.syncMu.Unlock()
+
+	if b.closes != closes {
+		// curr was closed in the meantime which synced it
+		return nil
+	}
+	return b.syncDatafile(curr)
+}
+
+// syncDatafile syncs df using fdatasync or fsync as per the sync policy
+func (b *Bitcask) syncDatafile(df data.Datafile) error {
+	if b.config.SyncPolicy == SyncAlwaysDatasync {
+		return df.Datasync()
+	}
+	return df.Sync()
+}
+
+// syncWrite syncs the active datafile after a write if the sync policy
+// requires it and writes are not group committed. It must be called with
+// the write lock held.
+func (b *Bitcask) syncWrite() error {
+	if b.commit != nil || !b.config.SyncPolicy.PerWrite() {
+		return nil
+	}
+	return b.syncDatafile(b.curr)
+}
+
+// appended returns the group commit position to pass to waitDurable after
+// writing n bytes. It must be called with the write lock held.
+func (b *Bitcask) appended(n int64) int64 {
+	if b.commit == nil {
+		return 0
+	}
+	return b.commit.append(n)
+}
+
+// waitDurable waits for a group commit to cover seq. It must be called
+// without holding the write lock.
+func (b *Bitcask) waitDurable(seq int64) error {
+	if b.commit == nil || seq == 0 {
+		return nil
+	}
+	return b.commit.wait(seq)
+}
+
+// notify does a non-blocking send on ch
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
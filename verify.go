@@ -0,0 +1,426 @@
+package bitcask
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/prologic/bitcask/internal"
+	"github.com/prologic/bitcask/internal/data"
+)
+
+// ProblemKind is the kind of a problem found by Verify
+type ProblemKind string
+
+const (
+	// ProblemMissingDatafile is a keydir item referencing a datafile that
+	// doesn't exist
+	ProblemMissingDatafile ProblemKind = "missing-datafile"
+
+	// ProblemOutOfBounds is a keydir item referencing data past the end of
+	// its datafile
+	ProblemOutOfBounds ProblemKind = "out-of-bounds"
+
+	// ProblemUnreadable is a keydir item whose entry can't be read or decoded
+	ProblemUnreadable ProblemKind = "unreadable"
+
+	// ProblemKeyMismatch is a keydir item whose entry has another key
+	ProblemKeyMismatch ProblemKind = "key-mismatch"
+
+	// ProblemChecksum is a keydir item whose entry fails its checksum
+	ProblemChecksum ProblemKind = "checksum"
+
+	// ProblemCorruptDatafile is a datafile that can't be decoded past the
+	// offset of the problem
+	ProblemCorruptDatafile ProblemKind = "corrupt-datafile"
+
+	// ProblemStaleIndex is a keydir item referencing another entry than the
+	// last one written for its key
+	ProblemStaleIndex ProblemKind = "stale-index"
+
+	// ProblemOrphaned is a keydir item for a key that was deleted or never
+	// written according to the datafiles
+	ProblemOrphaned ProblemKind = "orphaned"
+
+	// ProblemUnreachable is the last entry written for a key which isn't in
+	// the keydir, so it can't be read
+	ProblemUnreachable ProblemKind = "unreachable"
+
+	// ProblemReclaimableSpace is a recorded ReclaimableSpace that is
+	// negative or larger than the space taken by dead entries
+	ProblemReclaimableSpace ProblemKind = "reclaimable-space"
+)
+
+// VerifyOptions configures Verify
+type VerifyOptions struct {
+	// SkipScan skips scanning the datafiles, only the live keydir items are
+	// read and checksummed. The keydir isn't cross-checked against the
+	// datafiles then.
+	SkipScan bool
+
+	// MaxProblems limits the number of problems reported. Zero means no
+	// limit.
+	MaxProblems int
+}
+
+// VerifyProblem is a problem found by Verify. The location is the one
+// referenced by the keydir, or found scanning the datafiles for problems
+// of the unreachable and corrupt-datafile kinds.
+type VerifyProblem struct {
+	Kind   ProblemKind `json:"kind"`
+	Key    []byte      `json:"key,omitempty"`
+	FileID int         `json:"file_id"`
+	Offset int64       `json:"offset"`
+	Size   int64       `json:"size"`
+	Detail string      `json:"detail,omitempty"`
+}
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	// Keys is the number of live keys verified, LiveBytes the size of
+	// their entries
+	Keys      int   `json:"keys"`
+	LiveBytes int64 `json:"live_bytes"`
+
+	// Datafiles, Entries and Bytes are the number of datafiles and entries
+	// scanned and their size
+	Datafiles int   `json:"datafiles"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+
+	// ReclaimableSpace is the space recorded as reclaimable, DeadBytes the
+	// space taken by the entries that aren't live
+	ReclaimableSpace int64 `json:"reclaimable_space"`
+	DeadBytes        int64 `json:"dead_bytes"`
+
+	Problems  []VerifyProblem `json:"problems"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// OK returns true if no problems were found
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// verification tracks the state of a verification
+type verification struct {
+	ctx    context.Context
+	opts   VerifyOptions
+	report VerifyReport
+}
+
+func (v *verification) problem(p VerifyProblem) {
+	if v.opts.MaxProblems > 0 && len(v.report.Problems) >= v.opts.MaxProblems {
+		v.report.Truncated = true
+		return
+	}
+	v.report.Problems = append(v.report.Problems, p)
+}
+
+// verifySnapshot is the state of the database verified, taken at the start
+// of a verification. The items are sorted by key.
+type verifySnapshot struct {
+	items       []verifyItem
+	sizes       map[int]int64
+	reclaimable int64
+}
+
+// verifyItem is a keydir item of a verifySnapshot
+type verifyItem struct {
+	key  []byte
+	item internal.Item
+}
+
+// find returns the item of key in the snapshot
+func (s *verifySnapshot) find(key []byte) (internal.Item, bool) {
+	i := sort.Search(len(s.items), func(i int) bool {
+		return bytes.Compare(s.items[i].key, key) >= 0
+	})
+	if i < len(s.items) && bytes.Equal(s.items[i].key, key) {
+		return s.items[i].item, true
+	}
+	return internal.Item{}, false
+}
+
+// Verify checks the integrity of the database. It reads and checksums the
+// entry of every key in the keydir, and scans the datafiles to cross-check
+// the keydir against them, finding keydir items that don't reference the
+// last entry written for their key and live entries missing from the
+// keydir. It also checks that the recorded ReclaimableSpace is plausible.
+//
+// Verify checks the database as it was when called, writes made meanwhile
+// aren't blocked and aren't verified. Merges can't be run while verifying,
+// they fail with ErrVerifyInProgress, and Verify fails with
+// ErrMergeInProgress while merging. For a database opened with WithReadOnly,
+// merges of the writing process while verifying may be reported as problems.
+//
+// The problems found are returned in the report, an error is only returned
+// if the verification couldn't be done, e.g. when ctx is cancelled.
+func (b *Bitcask) Verify(ctx context.Context, opts VerifyOptions) (*VerifyReport, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	if !b.config.ReadOnly {
+		b.mu.Lock()
+		if b.isMerging {
+			b.mu.Unlock()
+			return nil, ErrMergeInProgress
+		}
+		b.verifying++
+		b.mu.Unlock()
+		defer func() {
+			b.mu.Lock()
+			b.verifying--
+			b.mu.Unlock()
+		}()
+	}
+
+	snap, err := b.verifySnapshot()
+	if err != nil {
+		return nil, err
+	}
+	v := &verification{ctx: ctx, opts: opts}
+	v.report.ReclaimableSpace = snap.reclaimable
+	v.report.Problems = []VerifyProblem{}
+
+	for _, i := range snap.items {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		b.verifyItem(v, snap, i.key, i.item)
+	}
+
+	if opts.SkipScan {
+		for _, size := range snap.sizes {
+			v.report.Datafiles++
+			v.report.Bytes += size
+		}
+	} else {
+		scanned, err := b.verifyDatafiles(v, snap)
+		if err != nil {
+			return nil, err
+		}
+		verifyKeydir(v, snap, scanned)
+	}
+
+	v.report.DeadBytes = v.report.Bytes - v.report.LiveBytes
+	if !b.config.ReadOnly && (snap.reclaimable < 0 || snap.reclaimable > v.report.DeadBytes) {
+		v.problem(VerifyProblem{
+			Kind:   ProblemReclaimableSpace,
+			Detail: fmt.Sprintf("reclaimable space %d is not between 0 and %d dead bytes", snap.reclaimable, v.report.DeadBytes),
+		})
+	}
+
+	return &v.report, nil
+}
+
+// verifySnapshot records the sizes of the datafiles and copies the keydir.
+// The write lock is only held to record the sizes, the keydir is read locked
+// before releasing it so that the keydir copied holds exactly the entries
+// written up to those sizes. A writer meanwhile appends its entry but waits
+// for the copy to be done to update the keydir, readers aren't blocked.
+func (b *Bitcask) verifySnapshot() (*verifySnapshot, error) {
+	b.mu.Lock()
+	snap := &verifySnapshot{
+		sizes:       make(map[int]int64, len(b.datafiles)+1),
+		reclaimable: b.metadata.ReclaimableSpace,
+	}
+	for id, df := range b.datafiles {
+		snap.sizes[id] = df.Size()
+	}
+	snap.sizes[b.curr.FileID()] = b.curr.Size()
+	mu := b.keydirMu.RLock(nil)
+	b.mu.Unlock()
+
+	snap.items = make([]verifyItem, 0, b.keydir.Len())
+	err := b.keydir.ForEach(func(key []byte, item internal.Item) bool {
+		snap.items = append(snap.items, verifyItem{key: append([]byte(nil), key...), item: item})
+		return true
+	})
+	mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	// Keydirs other than the tree aren't sorted
+	sort.Slice(snap.items, func(i, j int) bool {
+		return bytes.Compare(snap.items[i].key, snap.items[j].key) < 0
+	})
+	return snap, nil
+}
+
+// verifyItem reads and checksums the entry referenced by the keydir item
+func (b *Bitcask) verifyItem(v *verification, snap *verifySnapshot, key []byte, item internal.Item) {
+	problem := VerifyProblem{Key: key, FileID: item.FileID, Offset: item.Offset, Size: item.Size}
+
+	size, ok := snap.sizes[item.FileID]
+	if !ok {
+		problem.Kind = ProblemMissingDatafile
+		v.problem(problem)
+		return
+	}
+	if item.Offset < 0 || item.Size < 0 || item.Offset+item.Size > size {
+		problem.Kind = ProblemOutOfBounds
+		problem.Detail = fmt.Sprintf("datafile size is %d", size)
+		v.problem(problem)
+		return
+	}
+
+	v.report.Keys++
+	v.report.LiveBytes += item.Size
+
+	e, changed, err := b.readItem(key, item)
+	switch {
+	case changed:
+		// The key was written to since the verification started
+		return
+	case err != nil:
+		problem.Kind = ProblemUnreadable
+		problem.Detail = err.Error()
+	case !bytes.Equal(e.Key, key):
+		problem.Kind = ProblemKeyMismatch
+		problem.Detail = fmt.Sprintf("entry has key %q", e.Key)
+	case crc32.ChecksumIEEE(e.Value) != e.Checksum:
+		problem.Kind = ProblemChecksum
+	default:
+		return
+	}
+	v.problem(problem)
+}
+
+// readItem reads the entry referenced by the keydir item like get, unless
+// the key was written to since and no longer references it
+func (b *Bitcask) readItem(key []byte, item internal.Item) (e internal.Entry, changed bool, err error) {
+	var stale data.Datafile
+	for {
+		mu := b.keydirMu.RLock(key)
+		value, found, err := b.keydir.Get(key)
+		var df data.Datafile
+		if err == nil && found && value == item {
+			df = b.datafile(item.FileID)
+		}
+		mu.RUnlock()
+		if err != nil {
+			return e, false, err
+		}
+		if df == nil {
+			return e, true, nil
+		}
+
+		e, err = df.ReadAt(item.Offset, item.Size)
+		if err == data.ErrClosed && df != stale {
+			stale = df
+			continue
+		}
+		return e, false, err
+	}
+}
+
+// verifyDatafiles scans the datafiles up to their size when the
+// verification started and returns where the last entry of every key was
+// written, or nil for keys that were deleted last
+func (b *Bitcask) verifyDatafiles(v *verification, snap *verifySnapshot) (map[string]*internal.Item, error) {
+	ids := make([]int, 0, len(snap.sizes))
+	for id := range snap.sizes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	scanned := make(map[string]*internal.Item, len(snap.items))
+	for _, id := range ids {
+		if err := b.verifyDatafile(v, id, snap.sizes[id], scanned); err != nil {
+			return nil, err
+		}
+	}
+	return scanned, nil
+}
+
+func (b *Bitcask) verifyDatafile(v *verification, id int, size int64, scanned map[string]*internal.Item) error {
+	// A datafile of its own is opened so that reads aren't affected
+	df, err := b.openDatafile(id, true)
+	if err != nil {
+		v.problem(VerifyProblem{Kind: ProblemCorruptDatafile, FileID: id, Detail: err.Error()})
+		return nil
+	}
+	defer df.Close()
+
+	v.report.Datafiles++
+	v.report.Bytes += size
+
+	var offset int64
+	for offset < size {
+		if err := v.ctx.Err(); err != nil {
+			return err
+		}
+
+		e, n, err := df.Read()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			v.problem(VerifyProblem{Kind: ProblemCorruptDatafile, FileID: id, Offset: offset, Detail: err.Error()})
+			return nil
+		}
+		if offset+n > size {
+			// Only part of the entry was written when the verification
+			// started
+			v.problem(VerifyProblem{Kind: ProblemCorruptDatafile, FileID: id, Offset: offset, Size: n, Detail: "entry crosses the end of the datafile"})
+			return nil
+		}
+
+		v.report.Entries++
+		if len(e.Value) == 0 {
+			scanned[string(e.Key)] = nil
+		} else {
+			scanned[string(e.Key)] = &internal.Item{FileID: id, Offset: offset, Size: n}
+		}
+		offset += n
+	}
+	return nil
+}
+
+// verifyKeydir cross-checks the keydir against the last entries written
+// for every key found scanning the datafiles
+func verifyKeydir(v *verification, snap *verifySnapshot, scanned map[string]*internal.Item) {
+	for _, i := range snap.items {
+		key, item := i.key, i.item
+		problem := VerifyProblem{Key: key, FileID: item.FileID, Offset: item.Offset, Size: item.Size}
+
+		last, ok := scanned[string(key)]
+		switch {
+		case !ok:
+			problem.Kind = ProblemOrphaned
+			problem.Detail = "key was never written"
+		case last == nil:
+			problem.Kind = ProblemOrphaned
+			problem.Detail = "key was deleted"
+		case *last != item:
+			problem.Kind = ProblemStaleIndex
+			problem.Detail = fmt.Sprintf("last written to datafile %d at offset %d", last.FileID, last.Offset)
+		default:
+			continue
+		}
+		v.problem(problem)
+	}
+
+	keys := make([]string, 0, len(scanned))
+	for key, last := range scanned {
+		if _, ok := snap.find([]byte(key)); !ok && last != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		last := scanned[key]
+		v.problem(VerifyProblem{
+			Kind:   ProblemUnreachable,
+			Key:    []byte(key),
+			FileID: last.FileID,
+			Offset: last.Offset,
+			Size:   last.Size,
+		})
+	}
+}